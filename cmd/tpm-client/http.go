@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	sal "github.com/shuvava/tpm/pkg/tpm"
+)
+
+// sleep waits before retry, it is replaced in tests
+var sleep = time.Sleep
+
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// headerFlags collects repeated -H flags
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlags) Set(v string) error {
+	if name, _, ok := strings.Cut(v, ":"); !ok || strings.TrimSpace(name) == "" {
+		return fmt.Errorf("header must be \"Name: value\", got %q", v)
+	}
+	*h = append(*h, v)
+	return nil
+}
+
+// body returns request body of -data flag, nil is returned when it is empty
+func (c config) body(in io.Reader) ([]byte, error) {
+	switch {
+	case c.data == "":
+		return nil, nil
+	case c.data == "@-":
+		return io.ReadAll(in)
+	case strings.HasPrefix(c.data, "@"):
+		return os.ReadFile(c.data[1:])
+	default:
+		return []byte(c.data), nil
+	}
+}
+
+// client creates HTTP client with TLS config, timeouts, HTTP/2 and proxy settings
+func (c config) client(tlsConfig *tls.Config) (*http.Client, error) {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = tlsConfig
+	tr.DialContext = (&net.Dialer{Timeout: c.connectTimeout, KeepAlive: 30 * time.Second}).DialContext
+	tr.ForceAttemptHTTP2 = c.http2
+	if !c.http2 {
+		// non-nil empty map disables HTTP/2 upgrade
+		tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	if c.proxy != "" {
+		proxyURL, err := url.Parse(c.proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		tr.Proxy = http.ProxyURL(proxyURL)
+	}
+	return &http.Client{Transport: tr, Timeout: c.timeout}, nil
+}
+
+// do sends request and retries failed connections and retryable responses with exponential backoff
+func (c config) do(client *http.Client, u *url.URL, body []byte, dump io.Writer, logger sal.Logger) (*http.Response, error) {
+	method := c.method
+	if method == "" {
+		method = http.MethodGet
+		if body != nil {
+			method = http.MethodPost
+		}
+	}
+	delay := c.retryDelay
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range c.headers {
+			name, value, _ := strings.Cut(h, ":")
+			name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+			if strings.EqualFold(name, "Host") {
+				req.Host = value
+				continue
+			}
+			req.Header.Add(name, value)
+		}
+		if c.verbose {
+			dumpRequest(dump, req)
+		}
+
+		resp, err := client.Do(req)
+		if attempt > c.retries || !retryable(resp, err) {
+			if err == nil {
+				logger.Debug("response received", "address", c.address, "status", resp.Status, "proto", resp.Proto, "attempt", attempt)
+			}
+			return resp, err
+		}
+		wait := delay
+		if err != nil {
+			logger.Warn("request failed, retrying", "address", c.address, "attempt", attempt, "delay", wait, "error", err)
+		} else {
+			if retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && retryAfter > 0 {
+				wait = time.Duration(retryAfter) * time.Second
+			}
+			logger.Warn("request failed, retrying", "address", c.address, "attempt", attempt, "delay", wait, "status", resp.Status)
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		sleep(wait)
+		delay *= 2
+	}
+}
+
+// retryable reports whether request failed with transient error: connection failure, timeout
+// or 408, 429 and 5xx response
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return true
+		}
+		var opErr *net.OpError
+		return errors.As(err, &opErr) && opErr.Op == "dial"
+	}
+	switch {
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests:
+		return true
+	case resp.StatusCode >= 500 && resp.StatusCode != http.StatusNotImplemented:
+		return true
+	}
+	return false
+}
+
+// write writes response to out or to output file, verbose dump is written to dump
+func (c config) write(resp *http.Response, out, dump io.Writer) (err error) {
+	if c.verbose {
+		dumpResponse(dump, resp)
+	}
+	if c.output != "" {
+		f, err := os.Create(c.output)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}()
+		out = f
+	}
+	if c.include {
+		fmt.Fprintf(out, "%s %s\r\n", resp.Proto, resp.Status)
+		if err = resp.Header.Write(out); err != nil {
+			return err
+		}
+		fmt.Fprint(out, "\r\n")
+	}
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
+
+// dumpRequest writes request line and headers in curl verbose format
+func dumpRequest(w io.Writer, req *http.Request) {
+	fmt.Fprintf(w, "> %s %s\n", req.Method, req.URL.RequestURI())
+	if req.Host != "" {
+		fmt.Fprintf(w, "> Host: %s\n", req.Host)
+	}
+	dumpHeader(w, "> ", req.Header)
+	fmt.Fprintln(w, ">")
+}
+
+// dumpResponse writes negotiated TLS parameters, peer certificates, status line and headers
+// in curl verbose format
+func dumpResponse(w io.Writer, resp *http.Response) {
+	if state := resp.TLS; state != nil {
+		version, ok := tlsVersions[state.Version]
+		if !ok {
+			version = fmt.Sprintf("0x%04x", state.Version)
+		}
+		fmt.Fprintf(w, "* TLS version: %s\n", version)
+		fmt.Fprintf(w, "* Cipher suite: %s\n", tls.CipherSuiteName(state.CipherSuite))
+		fmt.Fprintf(w, "* ALPN protocol: %s\n", state.NegotiatedProtocol)
+		fmt.Fprintf(w, "* Server name: %s\n", state.ServerName)
+		fmt.Fprintf(w, "* Session resumed: %t\n", state.DidResume)
+		for i, cert := range state.PeerCertificates {
+			fmt.Fprintf(w, "* Peer certificate %d: subject=%q issuer=%q notAfter=%s\n",
+				i, cert.Subject.String(), cert.Issuer.String(), cert.NotAfter.UTC().Format(time.RFC3339))
+		}
+		for i, chain := range state.VerifiedChains {
+			names := make([]string, len(chain))
+			for j, cert := range chain {
+				names[j] = cert.Subject.String()
+			}
+			fmt.Fprintf(w, "* Verified chain %d: %s\n", i, strings.Join(names, " -> "))
+		}
+	}
+	fmt.Fprintf(w, "< %s %s\n", resp.Proto, resp.Status)
+	dumpHeader(w, "< ", resp.Header)
+	fmt.Fprintln(w, "<")
+}
+
+func dumpHeader(w io.Writer, prefix string, header http.Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range header[name] {
+			fmt.Fprintf(w, "%s%s: %s\n", prefix, name, value)
+		}
+	}
+}
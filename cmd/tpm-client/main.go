@@ -6,88 +6,145 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"log"
-	"net/http"
 	"net/url"
 	"os"
+	"time"
 
+	"github.com/shuvava/tpm/internal/cli"
+	"github.com/shuvava/tpm/internal/logging"
 	sal "github.com/shuvava/tpm/pkg/tpm"
 )
 
-var (
-	cacert    = flag.String("cacert", "ca.crt", "RootCA")
-	address   = flag.String("address", "", "Address of server")
-	pubCert   = flag.String("pubCert", "client.crt", "Public Cert file")
-	keyFile   = flag.String("tpmfile", "", "TPM KeyFile")
-	keyHandle = flag.Int("tpmHandle", 0, "TPM persistent key handle")
-	tssFile   = flag.String("tpmfile", "", "TPM TSS 2.0 file generated by tpm2tss-genkey")
-	tpmPath   = flag.String("tpm-path", "/dev/tpm0", "Path to the TPM device (character device or a Unix socket).")
-)
+// openTPM opens TPM device, it is replaced by simulator in tests
+var openTPM = sal.OpenDevice
+
+// config is command line configuration of tpm-client
+type config struct {
+	cacert  string
+	address string
+	pubCert string
+	key     *cli.KeyConfig
+
+	method         string
+	headers        headerFlags
+	data           string
+	output         string
+	include        bool
+	verbose        bool
+	retries        int
+	retryDelay     time.Duration
+	timeout        time.Duration
+	connectTimeout time.Duration
+	http2          bool
+	proxy          string
+}
 
 func main() {
-	flag.Parse()
+	if err := run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+		os.Exit(1)
+	}
+}
 
-	u, err := url.Parse(*address)
+// run parses command line and executes request, errors are written to the log.
+// Request body is read from in when -data is @-
+func run(args []string, in io.Reader, out, logOut io.Writer) error {
+	var c config
+	flags := flag.NewFlagSet("tpm-client", flag.ContinueOnError)
+	flags.StringVar(&c.cacert, "cacert", "ca.crt", "RootCA, system roots are used when empty")
+	flags.StringVar(&c.address, "address", "", "Address of server, it can be also passed as argument")
+	flags.StringVar(&c.pubCert, "pubCert", "client.crt", "Public Cert file, may contain intermediate certificates")
+	c.key = cli.KeyFlags(flags)
+	flags.StringVar(&c.method, "X", "", "HTTP method, GET or POST when -data is specified by default")
+	flags.Var(&c.headers, "H", "Request header \"Name: value\", can be repeated")
+	flags.StringVar(&c.data, "data", "", "Request body, @file reads it from file and @- from stdin")
+	flags.StringVar(&c.output, "o", "", "Write response body to file instead of stdout")
+	flags.BoolVar(&c.include, "i", false, "Include response status and headers in the output")
+	flags.BoolVar(&c.verbose, "v", false, "Dump request, response headers and negotiated TLS parameters to stderr")
+	flags.IntVar(&c.retries, "retry", 0, "Number of retries of failed connections and 408, 429, 5xx responses")
+	flags.DurationVar(&c.retryDelay, "retry-delay", time.Second, "Delay before first retry, it is doubled after each retry")
+	flags.DurationVar(&c.timeout, "timeout", 0, "Timeout of single request attempt including reading response body, 0 means no timeout")
+	flags.DurationVar(&c.connectTimeout, "connect-timeout", 30*time.Second, "Timeout of TCP connection")
+	flags.BoolVar(&c.http2, "http2", true, "Use HTTP/2 when server supports it")
+	flags.StringVar(&c.proxy, "proxy", "", "Proxy URL, HTTPS_PROXY and NO_PROXY environment variables are used when empty")
+	logConf := logging.Flags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		c.address = flags.Arg(0)
+	}
+	logger, err := logConf.New(logOut)
 	if err != nil {
-		log.Println(err)
-		return
+		fmt.Fprintln(logOut, err)
+		return err
+	}
+	if err = c.request(in, out, logOut, logger); err != nil {
+		logger.Error("request failed", "address", c.address, "error", err)
 	}
+	return err
+}
 
-	caCert, err := os.ReadFile(*cacert)
+// request sends request to address with TPM backed client certificate and writes response to out,
+// verbose dump is written to dump
+func (c config) request(in io.Reader, out, dump io.Writer, logger sal.Logger) error {
+	u, err := url.Parse(c.address)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("address must be https URL, got %q", c.address)
+	}
+	body, err := c.body(in)
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
 
-	var tss *sal.TSS
-	if tssFile != nil && *tssFile != "" {
-		tss, err = sal.LoadFromFile(*tssFile)
+	var caCertPool *x509.CertPool
+	if c.cacert != "" {
+		caCert, err := os.ReadFile(c.cacert)
 		if err != nil {
-			log.Println(err)
-			return
+			return err
+		}
+		caCertPool = x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return fmt.Errorf("no CA certificates found in %s", c.cacert)
 		}
 	}
 
-	r, err := sal.NewTPMCrypto(&sal.TPM{
-		Tss:           tss,
-		TpmHandle:     uint32(*keyHandle),
-		TpmHandleFile: *keyFile,
-
-		TpmDevice:          *tpmPath,
-		PublicCertFile:     *pubCert,
-		SignatureAlgorithm: x509.SHA256WithRSAPSS, // required for go 1.15+ TLS
-		ExtTLSConfig: &tls.Config{
-			ServerName: u.Hostname(),
-			RootCAs:    caCertPool,
-			ClientCAs:  caCertPool,
-		},
-	})
-
+	conf, err := c.key.TPM(openTPM, logger)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-
-	tr := &http.Transport{
-		TLSClientConfig: r.TLSConfig(),
+	// key stays loaded for retries and redirects
+	conf.KeepOpen = true
+	conf.PublicCertFile = c.pubCert
+	conf.ExtTLSConfig = &tls.Config{
+		ServerName: u.Hostname(),
+		RootCAs:    caCertPool,
+		ClientCAs:  caCertPool,
 	}
+	r, err := sal.NewTPMCrypto(conf)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
 
-	client := &http.Client{Transport: tr}
-
-	resp, err := client.Get(fmt.Sprintf("%s", *address))
+	if _, err = r.Certificate(); err != nil {
+		return err
+	}
+	tlsConfig, err := r.BuildTLSConfig()
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
 
-	htmlData, err := io.ReadAll(resp.Body)
+	client, err := c.client(tlsConfig)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
+	}
+	resp, err := c.do(client, u, body, dump, logger)
+	if err != nil {
+		return err
 	}
 	defer resp.Body.Close()
-	fmt.Printf("%v\n", resp.Status)
-	fmt.Println(string(htmlData))
-
+	return c.write(resp, out, dump)
 }
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-tpm/tpm2"
+
+	"github.com/shuvava/tpm/pkg/tpm"
+	"github.com/shuvava/tpm/pkg/tpm/tpmtest"
+)
+
+func TestRun(t *testing.T) {
+	sim := tpmtest.Command(t, &openTPM)
+	ca := sim.NewCA()
+
+	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, err := os.ReadFile(sim.Issue(ca, serverKey.Public(), "localhost", "server.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(certPEM)
+	var flaky int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.TLS.PeerCertificates[0].Subject.CommonName)
+	})
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Echo", "yes")
+		fmt.Fprintf(w, "%s %s %s %s ", r.Method, r.Proto, r.Host, r.Header.Get("X-Test"))
+		_, _ = io.Copy(w, r.Body)
+	})
+	mux.HandleFunc("/flaky", func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&flaky, 1) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			fmt.Fprint(w, "recovered")
+		}
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+	})
+	srv := httptest.NewUnstartedServer(mux)
+	srv.EnableHTTP2 = true
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{block.Bytes}, PrivateKey: serverKey}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.Pool,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	address := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+	intermediate := sim.Intermediate(ca, "client CA")
+	var keyArgs []string
+
+	tests := []struct {
+		name   string
+		tss    *tpm.TSS
+		sigAlg string
+	}{
+		{"ECC key", sim.TSSKey(tpm2.HandleOwner, tpmtest.ECCParentTemplate, "", tpmtest.ECCSigningTemplate), "ECDSA-SHA256"},
+		{"RSA key", sim.TSSKey(tpm2.HandleOwner, tpmtest.ECCParentTemplate, "", tpmtest.RSASigningTemplate), "SHA256-RSAPSS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pub, err := tt.tss.DecodePublic()
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, err := pub.Key()
+			if err != nil {
+				t.Fatal(err)
+			}
+			tssFile := sim.TSSFile(tt.tss, "client.tss")
+			// server trusts only root CA, so client must send intermediate chain
+			certFile := sim.Issue(intermediate, key, "client.local", "client.crt")
+
+			keyArgs = []string{"-cacert", ca.File, "-pubCert", certFile, "-tssfile", tssFile, "-sigAlg", tt.sigAlg}
+			var out bytes.Buffer
+			err = run(append([]string{"-address", address}, keyArgs...), nil, &out, io.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(out.String(), "hello client.local") {
+				t.Errorf("unexpected output %q", out.String())
+			}
+		})
+	}
+
+	// request runs tpm-client with RSA key of the last test case
+	request := func(t *testing.T, in io.Reader, args ...string) (string, string) {
+		t.Helper()
+		var out, dump bytes.Buffer
+		if err := run(append(keyArgs, args...), in, &out, &dump); err != nil {
+			t.Fatalf("run() error = %v, log %s", err, dump.String())
+		}
+		return out.String(), dump.String()
+	}
+
+	t.Run("method, headers and body", func(t *testing.T) {
+		out, _ := request(t, strings.NewReader("from stdin"), "-X", "PUT", "-H", "X-Test: header value", "-H", "Host: example.local",
+			"-data", "@-", "-i", address+"/echo")
+		for _, want := range []string{"HTTP/2.0 200 OK\r\n", "X-Echo: yes\r\n", "PUT HTTP/2.0 example.local header value from stdin"} {
+			if !strings.Contains(out, want) {
+				t.Errorf("output %q doesn't contain %q", out, want)
+			}
+		}
+
+		dataFile := filepath.Join(sim.Dir, "data.txt")
+		outFile := filepath.Join(sim.Dir, "out.txt")
+		if err := os.WriteFile(dataFile, []byte("from file"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if out, _ = request(t, nil, "-data", "@"+dataFile, "-o", outFile, "-http2=false", address+"/echo"); out != "" {
+			t.Errorf("unexpected output %q", out)
+		}
+		body, err := os.ReadFile(outFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "POST HTTP/1.1 "+strings.TrimPrefix(address, "https://")+"  from file" {
+			t.Errorf("unexpected response %q", body)
+		}
+	})
+
+	t.Run("verbose", func(t *testing.T) {
+		_, dump := request(t, nil, "-v", address)
+		for _, want := range []string{"> GET /", "* TLS version: TLS 1.3", "* ALPN protocol: h2", "* Server name: localhost",
+			"* Peer certificate 0: subject=\"CN=localhost\"", "* Verified chain 0: CN=localhost -> CN=tpmtest CA", "< HTTP/2.0 200 OK"} {
+			if !strings.Contains(dump, want) {
+				t.Errorf("dump %q doesn't contain %q", dump, want)
+			}
+		}
+	})
+
+	t.Run("retries", func(t *testing.T) {
+		var delays []time.Duration
+		sleep = func(d time.Duration) {
+			delays = append(delays, d)
+		}
+		defer func() { sleep = time.Sleep }()
+		out, _ := request(t, nil, "-retry", "3", "-retry-delay", "10ms", address+"/flaky")
+		if out != "recovered" {
+			t.Errorf("unexpected output %q", out)
+		}
+		if !reflect.DeepEqual(delays, []time.Duration{10 * time.Millisecond, 7 * time.Second}) {
+			t.Errorf("unexpected retry delays %v", delays)
+		}
+
+		atomic.StoreInt32(&flaky, 0)
+		if err := run(append(keyArgs, "-retry", "1", address+"/flaky"), nil, io.Discard, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		if err := run(append(keyArgs, "-timeout", "100ms", address+"/slow"), nil, io.Discard, io.Discard); err == nil {
+			t.Error("expected timeout error")
+		}
+	})
+
+	t.Run("proxy", func(t *testing.T) {
+		var connects int32
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodConnect {
+				http.Error(w, "CONNECT expected", http.StatusMethodNotAllowed)
+				return
+			}
+			atomic.AddInt32(&connects, 1)
+			upstream, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				upstream.Close()
+				return
+			}
+			go func() {
+				_, _ = io.Copy(upstream, conn)
+				upstream.Close()
+			}()
+			_, _ = io.Copy(conn, upstream)
+			conn.Close()
+		}))
+		defer proxy.Close()
+
+		out, _ := request(t, nil, "-proxy", proxy.URL, address)
+		if out != "hello client.local" || atomic.LoadInt32(&connects) != 1 {
+			t.Errorf("unexpected output %q, %d CONNECT requests", out, connects)
+		}
+	})
+
+	var logOut bytes.Buffer
+	err = run([]string{"-address", address, "-cacert", ca.File, "-sigAlg", "MD5-RSA", "-log-format", "json"}, nil, io.Discard, &logOut)
+	if err == nil {
+		t.Error("expected error for unsupported signature algorithm")
+	}
+	var record map[string]any
+	if err = json.Unmarshal(logOut.Bytes(), &record); err != nil {
+		t.Fatalf("log record %q is not JSON: %v", logOut.String(), err)
+	}
+	if record["level"] != "ERROR" || record["msg"] != "request failed" {
+		t.Errorf("unexpected log record %v", record)
+	}
+}
@@ -4,7 +4,7 @@ import (
 	"crypto/rand"
 	"encoding/pem"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
 
 	"crypto/x509"
@@ -13,6 +13,9 @@ import (
 
 	"github.com/google/go-tpm-tools/client"
 	"github.com/google/go-tpm/tpm2"
+
+	"github.com/shuvava/tpm/internal/logging"
+	sal "github.com/shuvava/tpm/pkg/tpm"
 )
 
 var (
@@ -26,17 +29,6 @@ type certGenConfig struct {
 }
 
 var (
-	tpmPath    = flag.String("tpm-path", "/dev/tpm0", "Path to the TPM device (character device or a Unix socket).")
-	san        = flag.String("dnsSAN", "server.domain.com", "DNS SAN Value for cert")
-	pemCSRFile = flag.String("pemCSRFile", "client.csr", "CSR File to write to")
-	keyFile    = flag.String("keyFile", "client.bin", "TPM KeyFile")
-
-	handleNames = map[string][]tpm2.HandleType{
-		"all":       []tpm2.HandleType{tpm2.HandleTypeLoadedSession, tpm2.HandleTypeSavedSession, tpm2.HandleTypeTransient},
-		"loaded":    []tpm2.HandleType{tpm2.HandleTypeLoadedSession},
-		"saved":     []tpm2.HandleType{tpm2.HandleTypeSavedSession},
-		"transient": []tpm2.HandleType{tpm2.HandleTypeTransient},
-	}
 	unrestrictedKeyParams = tpm2.Public{
 		Type:    tpm2.AlgRSA,
 		NameAlg: tpm2.AlgSHA256,
@@ -53,83 +45,87 @@ var (
 	}
 )
 
+// openTPM opens TPM device, it is replaced by simulator in tests
+var openTPM = sal.OpenDevice
+
 func main() {
+	if err := run(os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		os.Exit(1)
+	}
+}
 
-	flag.Parse()
-	fmt.Fprintf(os.Stdout, "======= Init  ========")
+// run parses command line, creates key and writes CSR, errors are written to the log
+func run(args []string, out, logOut io.Writer) error {
+	flags := flag.NewFlagSet("tpm-csr", flag.ContinueOnError)
+	tpmPath := flags.String("tpm-path", "/dev/tpm0", "TPM device path or URI (device:/dev/tpmrm0, swtpm:path=/tmp/swtpm.sock, swtpm:host=127.0.0.1,port=2321, mssim:host=127.0.0.1,port=2321)")
+	san := flags.String("dnsSAN", "server.domain.com", "DNS SAN Value for cert")
+	pemCSRFile := flags.String("pemCSRFile", "client.csr", "CSR File to write to")
+	keyFile := flags.String("keyFile", "client.bin", "TPM KeyFile")
+	logConf := logging.Flags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	logger, err := logConf.New(logOut)
+	if err != nil {
+		fmt.Fprintln(logOut, err)
+		return err
+	}
+	if err = createCSR(out, logger, *tpmPath, *keyFile, *san, *pemCSRFile); err != nil {
+		logger.Error("CSR creation failed", "error", err)
+	}
+	return err
+}
 
-	rwc, err := tpm2.OpenTPM(*tpmPath)
+// createCSR creates TPM key, saves its context into keyFile and writes CSR signed by it
+func createCSR(out io.Writer, logger sal.Logger, tpmPath, keyFile, san, pemCSRFile string) (err error) {
+	rwc, err := openTPM(tpmPath)
 	if err != nil {
-		fmt.Fprintf(os.Stdout, "can't open TPM %q: %v", tpmPath, err)
-		os.Exit(1)
+		return fmt.Errorf("can't open TPM %q: %w", tpmPath, err)
 	}
 	defer func() {
-		if err := rwc.Close(); err != nil {
-			fmt.Fprintf(os.Stdout, "%v\ncan't close TPM %q: %v", tpmPath, err)
-			os.Exit(1)
+		if cerr := rwc.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("can't close TPM %q: %w", tpmPath, cerr)
 		}
 	}()
 
-	totalHandles := 0
-	for _, handleType := range handleNames["all"] {
-		handles, err := client.Handles(rwc, handleType)
-		if err != nil {
-			fmt.Fprintf(os.Stdout, "getting handles: %v", err)
-			os.Exit(1)
-		}
-		for _, handle := range handles {
-			if err = tpm2.FlushContext(rwc, handle); err != nil {
-				fmt.Fprintf(os.Stdout, "flushing handle 0x%x: %v", handle, err)
-				os.Exit(1)
-			}
-			fmt.Fprintf(os.Stdout, "Handle 0x%x flushed\n", handle)
-			totalHandles++
-		}
-	}
-
-	fmt.Fprintf(os.Stdout, "%d handles flushed\n", totalHandles)
-
 	k, err := client.NewKey(rwc, tpm2.HandleOwner, unrestrictedKeyParams)
 	if err != nil {
-		fmt.Fprintf(os.Stdout, "can't create SRK %q: %v", tpmPath, err)
-		os.Exit(1)
+		return fmt.Errorf("can't create SRK %q: %w", tpmPath, err)
 	}
 
 	kh := k.Handle()
-	fmt.Fprintf(os.Stdout, "======= ContextSave (k) ========")
 	khBytes, err := tpm2.ContextSave(rwc, kh)
 	if err != nil {
-		fmt.Fprintf(os.Stdout, "ContextSave failed for ekh: %v", err)
-		os.Exit(1)
+		return fmt.Errorf("ContextSave failed for ekh: %w", err)
 	}
-	err = ioutil.WriteFile(*keyFile, khBytes, 0644)
+	err = os.WriteFile(keyFile, khBytes, 0644)
 	if err != nil {
-		fmt.Fprintf(os.Stdout, "ContextSave failed for ekh: %v", err)
-		os.Exit(1)
+		return fmt.Errorf("ContextSave failed for ekh: %w", err)
 	}
 	tpm2.FlushContext(rwc, kh)
+	logger.Debug("key context saved", "file", keyFile)
 
-	fmt.Fprintf(os.Stdout, "======= ContextLoad (k) ========")
-	khBytes, err = ioutil.ReadFile(*keyFile)
+	khBytes, err = os.ReadFile(keyFile)
 	if err != nil {
-		fmt.Fprintf(os.Stdout, "ContextLoad failed for ekh: %v", err)
-		os.Exit(1)
+		return fmt.Errorf("ContextLoad failed for ekh: %w", err)
 	}
 	kh, err = tpm2.ContextLoad(rwc, khBytes)
 	if err != nil {
-		fmt.Fprintf(os.Stdout, "ContextLoad failed for kh: %v", err)
-		os.Exit(1)
+		return fmt.Errorf("ContextLoad failed for kh: %w", err)
 	}
-	kk, err := client.NewCachedKey(rwc, tpm2.HandleOwner, unrestrictedKeyParams, kh)
-	s, err := kk.GetSigner()
+	// go-tpm-tools signer rejects PSS salt length requested by x509, the key signs through pkg/tpm
+	s, err := sal.NewTPMCrypto(&sal.TPM{
+		TpmHandle:          uint32(kh),
+		Device:             rwc,
+		SignatureAlgorithm: x509.SHA256WithRSAPSS,
+		Logger:             logger,
+	})
 	if err != nil {
-		fmt.Fprintf(os.Stdout, "can't getSigner %q: %v", tpmPath, err)
-		os.Exit(1)
+		return fmt.Errorf("can't getSigner %q: %w", tpmPath, err)
 	}
-	fmt.Fprintf(os.Stdout, "Parent handle %X\n", tpm2.HandleOwner)
-	fmt.Fprintf(os.Stdout, "Key handle %X\n", kh)
+	logger.Info("key loaded", "parent", fmt.Sprintf("0x%X", tpm2.HandleOwner), "handle", fmt.Sprintf("0x%X", kh))
 
-	fmt.Fprintf(os.Stdout, "Creating CSR")
+	logger.Info("creating CSR", "dnsSAN", san)
 
 	var csrtemplate = x509.CertificateRequest{
 		Subject: pkix.Name{
@@ -138,16 +134,15 @@ func main() {
 			Locality:           []string{"Mountain View"},
 			Province:           []string{"California"},
 			Country:            []string{"US"},
-			CommonName:         *san,
+			CommonName:         san,
 		},
-		DNSNames:           []string{*san},
+		DNSNames:           []string{san},
 		SignatureAlgorithm: x509.SHA256WithRSAPSS,
 	}
 
 	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, &csrtemplate, s)
 	if err != nil {
-		fmt.Fprintf(os.Stdout, "Failed to create CSR: %s", err)
-		os.Exit(1)
+		return fmt.Errorf("failed to create CSR: %w", err)
 	}
 
 	pemdata := pem.EncodeToMemory(
@@ -156,13 +151,12 @@ func main() {
 			Bytes: csrBytes,
 		},
 	)
-	fmt.Fprintf(os.Stdout, "CSR \b%s\n", string(pemdata))
+	fmt.Fprint(out, string(pemdata))
 
-	err = ioutil.WriteFile(*pemCSRFile, pemdata, 0644)
+	err = os.WriteFile(pemCSRFile, pemdata, 0644)
 	if err != nil {
-		fmt.Fprintf(os.Stdout, "Could not write file %v", err)
-		os.Exit(1)
+		return fmt.Errorf("could not write file %w", err)
 	}
-	fmt.Fprintf(os.Stdout, "CSR written to: %s\n", *pemCSRFile)
-
+	logger.Info("CSR written", "file", pemCSRFile)
+	return nil
 }
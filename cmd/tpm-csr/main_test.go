@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shuvava/tpm/pkg/tpm/tpmtest"
+)
+
+func TestRun(t *testing.T) {
+	sim := tpmtest.Command(t, &openTPM)
+	csrFile := filepath.Join(sim.Dir, "client.csr")
+
+	err := run([]string{
+		"-dnsSAN", "client.local",
+		"-pemCSRFile", csrFile,
+		"-keyFile", filepath.Join(sim.Dir, "client.bin"),
+	}, io.Discard, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(csrFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		t.Fatal("CSR is not PEM encoded")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = csr.CheckSignature(); err != nil {
+		t.Error(err)
+	}
+	if len(csr.DNSNames) != 1 || csr.DNSNames[0] != "client.local" {
+		t.Errorf("unexpected DNS names %v", csr.DNSNames)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+
+	"github.com/shuvava/tpm/internal/logging"
+	sal "github.com/shuvava/tpm/pkg/tpm"
+)
+
+// schemes restrict key to signature scheme of x509 signature algorithm
+var schemes = map[string]tpm2.SigScheme{
+	x509.SHA256WithRSA.String():    {Alg: tpm2.AlgRSASSA, Hash: tpm2.AlgSHA256},
+	x509.SHA256WithRSAPSS.String(): {Alg: tpm2.AlgRSAPSS, Hash: tpm2.AlgSHA256},
+	x509.ECDSAWithSHA256.String():  {Alg: tpm2.AlgECDSA, Hash: tpm2.AlgSHA256},
+	x509.ECDSAWithSHA384.String():  {Alg: tpm2.AlgECDSA, Hash: tpm2.AlgSHA384},
+}
+
+// openTPM opens TPM device, it is replaced by simulator in tests
+var openTPM = sal.OpenDevice
+
+// config is command line configuration of tpm-import
+type config struct {
+	tpmPath     string
+	in          string
+	parentPub   string
+	sigAlg      string
+	parent      int
+	rsaParent   bool
+	parentAuth  string
+	hierAuth    string
+	keyAuth     string
+	noDA        bool
+	description string
+	out         string
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stderr); err != nil {
+		os.Exit(1)
+	}
+}
+
+// run parses command line, imports private key and writes TSS file, errors are written to the log
+func run(args []string, logOut io.Writer) error {
+	var c config
+	flags := flag.NewFlagSet("tpm-import", flag.ContinueOnError)
+	flags.StringVar(&c.tpmPath, "tpm-path", "/dev/tpm0", "TPM device path or URI (device:/dev/tpmrm0, swtpm:path=/tmp/swtpm.sock, swtpm:host=127.0.0.1,port=2321, mssim:host=127.0.0.1,port=2321)")
+	flags.StringVar(&c.in, "in", "private.pem", "PEM private key file (PKCS#1, PKCS#8 or SEC 1) to import")
+	flags.StringVar(&c.parentPub, "parentPub", "", "PEM public key of parent storage key, key is wrapped without TPM access "+
+		"and imported on first load when it is specified")
+	flags.StringVar(&c.sigAlg, "sigAlg", "", "Restrict key to signature algorithm (SHA256-RSA, SHA256-RSAPSS, ECDSA-SHA256, ECDSA-SHA384), any scheme is allowed when empty")
+	flags.IntVar(&c.parent, "parent", int(tpm2.HandleOwner), "Parent hierarchy or persistent key handle")
+	flags.BoolVar(&c.rsaParent, "rsaParent", false, "Use RSA storage primary key of hierarchy as parent, ECC primary key is used by default")
+	flags.StringVar(&c.parentAuth, "parentAuth", "", "Persistent parent key authorization value (password)")
+	flags.StringVar(&c.hierAuth, "hierarchyAuth", "", "Parent hierarchy authorization value (password)")
+	flags.StringVar(&c.keyAuth, "keyAuth", "", "Key authorization value (password)")
+	flags.BoolVar(&c.noDA, "noDA", false, "Exempt key from dictionary attack protection")
+	flags.StringVar(&c.description, "description", "", "Key description stored in TSS file")
+	flags.StringVar(&c.out, "out", "key.tss", "TSS file to write to")
+	logConf := logging.Flags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	logger, err := logConf.New(logOut)
+	if err != nil {
+		fmt.Fprintln(logOut, err)
+		return err
+	}
+	if err = c.importKey(logger); err != nil {
+		logger.Error("key import failed", "error", err)
+	}
+	return err
+}
+
+// options converts command line configuration into import options
+func (c config) options(logger sal.Logger) (sal.ImportOptions, error) {
+	opts := sal.ImportOptions{
+		ObjectOptions: sal.ObjectOptions{
+			Parent:      tpmutil.Handle(uint32(c.parent)),
+			RSAParent:   c.rsaParent,
+			KeyAuth:     c.keyAuth,
+			Description: c.description,
+			Logger:      logger,
+		},
+	}
+	if c.sigAlg != "" {
+		scheme, ok := schemes[c.sigAlg]
+		if !ok {
+			return opts, fmt.Errorf("unsupported signature algorithm %q", c.sigAlg)
+		}
+		opts.Scheme = &scheme
+	}
+	if c.noDA {
+		opts.Attributes = sal.DefaultImportAttributes | tpm2.FlagNoDA
+	}
+	if c.parentAuth != "" {
+		opts.ParentAuth = sal.StaticAuth(c.parentAuth)
+	}
+	if c.hierAuth != "" {
+		opts.HierarchyAuth = sal.StaticAuth(c.hierAuth)
+	}
+	return opts, nil
+}
+
+// importKey imports private key into TPM or wraps it to parent public key and writes TSS file
+func (c config) importKey(logger sal.Logger) error {
+	opts, err := c.options(logger)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(c.in)
+	if err != nil {
+		return err
+	}
+	key, err := sal.ParsePrivateKeyPEM(b)
+	if err != nil {
+		return err
+	}
+
+	var tss *sal.TSS
+	if c.parentPub != "" {
+		parentPub, err := readParentPublic(c.parentPub)
+		if err != nil {
+			return err
+		}
+		tss, err = sal.DuplicateKey(parentPub, key, opts)
+		if err != nil {
+			return err
+		}
+	} else {
+		rwc, err := openTPM(c.tpmPath)
+		if err != nil {
+			return err
+		}
+		defer rwc.Close()
+		tss, err = sal.ImportKey(rwc, key, opts)
+		if err != nil {
+			return err
+		}
+	}
+	if err = tss.SaveToFile(c.out); err != nil {
+		return err
+	}
+	logger.Info("file created", "file", c.out)
+	return nil
+}
+
+// readParentPublic reads PEM public key of parent storage key and converts it into its public area
+func readParentPublic(file string) (tpm2.Public, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return tpm2.Public{}, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return tpm2.Public{}, fmt.Errorf("%s is not PEM public key file", file)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return tpm2.Public{}, err
+	}
+	return sal.ParentPublic(pub)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+
+	"github.com/shuvava/tpm/pkg/tpm"
+	"github.com/shuvava/tpm/pkg/tpm/tpmtest"
+)
+
+func TestRun(t *testing.T) {
+	sim := tpmtest.Command(t, &openTPM)
+	sim.PersistPrimary(tpmtest.RSAParentTemplate, tpmtest.ParentHandle)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eccKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaFile := filepath.Join(sim.Dir, "rsa.pem")
+	if err = os.WriteFile(rsaFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	eccFile := sim.KeyFile(eccKey, "ecc.pem")
+
+	// parent public key of offline wrapping is exported from persistent parent
+	pub, _, _, err := tpm2.ReadPublic(sim.RW(), tpmtest.ParentHandle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parentKey, err := pub.Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parentFile := filepath.Join(sim.Dir, "parent.pem")
+	if err = os.WriteFile(parentFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		key     crypto.Signer
+		keyType string
+		wantErr bool
+	}{
+		{"PKCS1 RSA", []string{"-in", rsaFile, "-noDA", "-sigAlg", "SHA256-RSAPSS"}, rsaKey, tpm.OIDLoadableKey, false},
+		{"PKCS8 ECDSA under persistent parent", []string{"-in", eccFile, "-parent", fmt.Sprint(tpmtest.ParentHandle), "-keyAuth", "secret"}, eccKey, tpm.OIDLoadableKey, false},
+		{"offline", []string{"-in", eccFile, "-parent", fmt.Sprint(tpmtest.ParentHandle), "-parentPub", parentFile}, eccKey, tpm.OIDImportableKey, false},
+		{"missing key file", []string{"-in", filepath.Join(sim.Dir, "missing.pem")}, nil, "", true},
+		{"parent public is not PEM", []string{"-in", eccFile, "-parentPub", eccFile}, nil, "", true},
+		{"scheme of other key type", []string{"-in", rsaFile, "-sigAlg", "ECDSA-SHA256"}, nil, "", true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := filepath.Join(sim.Dir, fmt.Sprintf("key%d.tss", i))
+			err := run(append(tt.args, "-out", out), io.Discard)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			tss, err := tpm.LoadFromFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tss.Type != tt.keyType {
+				t.Errorf("unexpected key type %s", tss.Type)
+			}
+			pub, err := tss.DecodePublic()
+			if err != nil {
+				t.Fatal(err)
+			}
+			tssKey, err := pub.Key()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.key.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(tssKey) {
+				t.Error("TSS key doesn't match imported key")
+			}
+
+			rw, err := sim.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			h, err := tss.LoadKey(rw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sim.Flush(h)
+		})
+	}
+
+	tss, err := tpm.LoadFromFile(filepath.Join(sim.Dir, "key0.tss"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPub, err := tss.DecodePublic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyPub.Attributes&tpm2.FlagNoDA == 0 || keyPub.RSAParameters.Sign.Alg != tpm2.AlgRSAPSS {
+		t.Errorf("unexpected key attributes %v and scheme %v", keyPub.Attributes, keyPub.RSAParameters.Sign)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+
+	"github.com/shuvava/tpm/internal/logging"
+	sal "github.com/shuvava/tpm/pkg/tpm"
+)
+
+var (
+	curves = map[string]tpm2.EllipticCurve{
+		"P-256": tpm2.CurveNISTP256,
+		"P-384": tpm2.CurveNISTP384,
+	}
+
+	// schemes restrict key to signature scheme of x509 signature algorithm
+	schemes = map[string]tpm2.SigScheme{
+		x509.SHA256WithRSA.String():    {Alg: tpm2.AlgRSASSA, Hash: tpm2.AlgSHA256},
+		x509.SHA256WithRSAPSS.String(): {Alg: tpm2.AlgRSAPSS, Hash: tpm2.AlgSHA256},
+		x509.ECDSAWithSHA256.String():  {Alg: tpm2.AlgECDSA, Hash: tpm2.AlgSHA256},
+		x509.ECDSAWithSHA384.String():  {Alg: tpm2.AlgECDSA, Hash: tpm2.AlgSHA384},
+	}
+)
+
+// openTPM opens TPM device, it is replaced by simulator in tests
+var openTPM = sal.OpenDevice
+
+// config is command line configuration of tpm-keygen
+type config struct {
+	tpmPath     string
+	alg         string
+	bits        int
+	curve       string
+	sigAlg      string
+	parent      int
+	rsaParent   bool
+	parentAuth  string
+	hierAuth    string
+	keyAuth     string
+	noDA        bool
+	description string
+	pcrs        string
+	authKey     string
+	policyRef   string
+	out         string
+	pubOut      string
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stderr); err != nil {
+		os.Exit(1)
+	}
+}
+
+// run parses command line, creates key and writes TSS file, errors are written to the log
+func run(args []string, logOut io.Writer) error {
+	var c config
+	flags := flag.NewFlagSet("tpm-keygen", flag.ContinueOnError)
+	flags.StringVar(&c.tpmPath, "tpm-path", "/dev/tpm0", "TPM device path or URI (device:/dev/tpmrm0, swtpm:path=/tmp/swtpm.sock, swtpm:host=127.0.0.1,port=2321, mssim:host=127.0.0.1,port=2321)")
+	flags.StringVar(&c.alg, "alg", "rsa", "Key algorithm (rsa, ecc)")
+	flags.IntVar(&c.bits, "bits", 2048, "RSA key size (2048, 3072, 4096)")
+	flags.StringVar(&c.curve, "curve", "P-256", "ECC key curve (P-256, P-384)")
+	flags.StringVar(&c.sigAlg, "sigAlg", "", "Restrict key to signature algorithm (SHA256-RSA, SHA256-RSAPSS, ECDSA-SHA256, ECDSA-SHA384), any scheme is allowed when empty")
+	flags.IntVar(&c.parent, "parent", int(tpm2.HandleOwner), "Parent hierarchy or persistent key handle")
+	flags.BoolVar(&c.rsaParent, "rsaParent", false, "Use RSA storage primary key of hierarchy as parent, ECC primary key is used by default")
+	flags.StringVar(&c.parentAuth, "parentAuth", "", "Persistent parent key authorization value (password)")
+	flags.StringVar(&c.hierAuth, "hierarchyAuth", "", "Parent hierarchy authorization value (password)")
+	flags.StringVar(&c.keyAuth, "keyAuth", "", "Key authorization value (password)")
+	flags.BoolVar(&c.noDA, "noDA", false, "Exempt key from dictionary attack protection")
+	flags.StringVar(&c.pcrs, "pcrs", "", "Bind key to current PCR values (sha256:0,1,7), PCR policy replaces password authorization")
+	flags.StringVar(&c.authKey, "authKey", "", "PEM public key signing approved policies (tpm-policy-sign), signed policy replaces password authorization")
+	flags.StringVar(&c.policyRef, "policyRef", "", "Policy reference of signed policies, used with -authKey")
+	flags.StringVar(&c.description, "description", "", "Key description stored in TSS file")
+	flags.StringVar(&c.out, "out", "key.tss", "TSS file to write to")
+	flags.StringVar(&c.pubOut, "pubOut", "", "PEM public key file to write to")
+	logConf := logging.Flags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	logger, err := logConf.New(logOut)
+	if err != nil {
+		fmt.Fprintln(logOut, err)
+		return err
+	}
+	if err = c.generate(logger); err != nil {
+		logger.Error("key generation failed", "error", err)
+	}
+	return err
+}
+
+// options converts command line configuration into key options
+func (c config) options(logger sal.Logger) (sal.KeyOptions, error) {
+	opts := sal.KeyOptions{
+		RSABits: c.bits,
+		ObjectOptions: sal.ObjectOptions{
+			Parent:      tpmutil.Handle(uint32(c.parent)),
+			RSAParent:   c.rsaParent,
+			KeyAuth:     c.keyAuth,
+			Description: c.description,
+			Logger:      logger,
+		},
+	}
+	switch strings.ToLower(c.alg) {
+	case "rsa":
+		opts.Algorithm = tpm2.AlgRSA
+	case "ecc", "ecdsa":
+		opts.Algorithm = tpm2.AlgECC
+		curve, ok := curves[strings.ToUpper(c.curve)]
+		if !ok {
+			return opts, fmt.Errorf("unsupported curve %q", c.curve)
+		}
+		opts.Curve = curve
+	default:
+		return opts, fmt.Errorf("unsupported key algorithm %q", c.alg)
+	}
+	if c.sigAlg != "" {
+		scheme, ok := schemes[c.sigAlg]
+		if !ok {
+			return opts, fmt.Errorf("unsupported signature algorithm %q", c.sigAlg)
+		}
+		opts.Scheme = &scheme
+	}
+	if c.noDA {
+		opts.Attributes = sal.DefaultKeyAttributes | tpm2.FlagNoDA
+	}
+	if c.pcrs != "" {
+		sel, err := sal.ParsePCRSelection(c.pcrs)
+		if err != nil {
+			return opts, err
+		}
+		opts.PCRs = sel
+	}
+	if c.authKey != "" {
+		b, err := os.ReadFile(c.authKey)
+		if err != nil {
+			return opts, err
+		}
+		if opts.AuthorizeKey, err = sal.ParsePublicKeyPEM(b); err != nil {
+			return opts, err
+		}
+		opts.PolicyRef = []byte(c.policyRef)
+	}
+	if c.parentAuth != "" {
+		opts.ParentAuth = sal.StaticAuth(c.parentAuth)
+	}
+	if c.hierAuth != "" {
+		opts.HierarchyAuth = sal.StaticAuth(c.hierAuth)
+	}
+	return opts, nil
+}
+
+// generate creates key in TPM and writes TSS file and optional public key file
+func (c config) generate(logger sal.Logger) error {
+	opts, err := c.options(logger)
+	if err != nil {
+		return err
+	}
+	rwc, err := openTPM(c.tpmPath)
+	if err != nil {
+		return err
+	}
+	defer rwc.Close()
+
+	tss, err := sal.CreateKey(rwc, opts)
+	if err != nil {
+		return err
+	}
+	if err = tss.SaveToFile(c.out); err != nil {
+		return err
+	}
+	logger.Info("file created", "file", c.out)
+
+	if c.pubOut == "" {
+		return nil
+	}
+	pub, err := tss.DecodePublic()
+	if err != nil {
+		return err
+	}
+	key, err := pub.Key()
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(c.pubOut, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	logger.Info("file created", "file", c.pubOut)
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+
+	"github.com/shuvava/tpm/pkg/tpm"
+	"github.com/shuvava/tpm/pkg/tpm/tpmtest"
+)
+
+func TestRun(t *testing.T) {
+	sim := tpmtest.Command(t, &openTPM)
+	sim.PersistPrimary(tpmtest.ECCParentTemplate, tpmtest.ParentHandle)
+	authKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(authKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	authKeyFile := filepath.Join(sim.Dir, "policy.pub")
+	if err = os.WriteFile(authKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		check   func(crypto.PublicKey) bool
+		wantErr bool
+	}{
+		{"RSA", []string{"-noDA", "-sigAlg", "SHA256-RSAPSS"}, func(k crypto.PublicKey) bool {
+			return k.(*rsa.PublicKey).N.BitLen() == 2048
+		}, false},
+		{"ECC P-384", []string{"-alg", "ecc", "-curve", "P-384", "-keyAuth", "secret"}, func(k crypto.PublicKey) bool {
+			return k.(*ecdsa.PublicKey).Curve == elliptic.P384()
+		}, false},
+		{"persistent parent", []string{"-alg", "ecc", "-parent", fmt.Sprint(tpmtest.ParentHandle)}, nil, false},
+		{"PCR policy", []string{"-alg", "ecc", "-pcrs", "sha256:7"}, nil, false},
+		{"signed policy", []string{"-alg", "ecc", "-authKey", authKeyFile, "-policyRef", "web"}, nil, false},
+		{"invalid PCRs", []string{"-pcrs", "sha256:99"}, nil, true},
+		{"missing authorizing key", []string{"-authKey", filepath.Join(sim.Dir, "missing.pub")}, nil, true},
+		{"signed policy with PCRs", []string{"-authKey", authKeyFile, "-pcrs", "7"}, nil, true},
+		{"unknown algorithm", []string{"-alg", "dsa"}, nil, true},
+		{"unknown curve", []string{"-alg", "ecc", "-curve", "P-521"}, nil, true},
+		{"scheme of other key type", []string{"-sigAlg", "ECDSA-SHA256"}, nil, true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := filepath.Join(sim.Dir, fmt.Sprintf("key%d.tss", i))
+			pubOut := filepath.Join(sim.Dir, fmt.Sprintf("key%d.pem", i))
+			err := run(append(tt.args, "-out", out, "-pubOut", pubOut), io.Discard)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			tss, err := tpm.LoadFromFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pub, err := tss.DecodePublic()
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := os.ReadFile(pubOut)
+			if err != nil {
+				t.Fatal(err)
+			}
+			block, _ := pem.Decode(b)
+			if block == nil {
+				t.Fatal("public key file is not PEM encoded")
+			}
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tssKey, err := pub.Key()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tssKey.(interface{ Equal(crypto.PublicKey) bool }).Equal(key) {
+				t.Error("public key file doesn't match TSS key")
+			}
+			if tt.check != nil && !tt.check(key) {
+				t.Errorf("unexpected key %v", key)
+			}
+
+			rw, err := sim.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			h, err := tss.LoadKey(rw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sim.Flush(h)
+		})
+	}
+
+	tss, err := tpm.LoadFromFile(filepath.Join(sim.Dir, "key0.tss"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := tss.DecodePublic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub.Attributes&tpm2.FlagNoDA == 0 || pub.RSAParameters.Sign.Alg != tpm2.AlgRSAPSS {
+		t.Errorf("unexpected key attributes %v and scheme %v", pub.Attributes, pub.RSAParameters.Sign)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-tpm/tpm2"
+
+	"github.com/shuvava/tpm/internal/logging"
+	sal "github.com/shuvava/tpm/pkg/tpm"
+)
+
+// openTPM opens TPM device, it is replaced by simulator in tests
+var openTPM = sal.OpenDevice
+
+// config is command line configuration of tpm-pcr
+type config struct {
+	tpmPath  string
+	banks    string
+	pcrs     string
+	format   string
+	extend   int
+	in       string
+	eventLog string
+}
+
+// pcrValue is PCR value of JSON output
+type pcrValue struct {
+	PCR   int    `json:"pcr"`
+	Value string `json:"value"`
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+		os.Exit(1)
+	}
+}
+
+// run parses command line, extends PCR when requested and prints PCR values, errors are written to the log
+func run(args []string, in io.Reader, out, logOut io.Writer) error {
+	var c config
+	flags := flag.NewFlagSet("tpm-pcr", flag.ContinueOnError)
+	flags.StringVar(&c.tpmPath, "tpm-path", "/dev/tpm0", "TPM device path or URI (device:/dev/tpmrm0, swtpm:path=/tmp/swtpm.sock, swtpm:host=127.0.0.1,port=2321, mssim:host=127.0.0.1,port=2321)")
+	flags.StringVar(&c.banks, "banks", "", "Comma separated PCR banks to print (sha1, sha256, sha384, sha512), all allocated banks when empty")
+	flags.StringVar(&c.pcrs, "pcrs", "", "Comma separated PCR indices to print (0,1,7), all PCRs when empty")
+	flags.StringVar(&c.format, "format", "text", "Output format (text, json)")
+	flags.IntVar(&c.extend, "extend", -1, "Extend PCR of all allocated banks with digest of -in file before printing")
+	flags.StringVar(&c.in, "in", "-", "File whose digest extends PCR, - reads stdin")
+	flags.StringVar(&c.eventLog, "eventlog", "", "Verify binary event log file ("+sal.DefaultEventLogFile+") against PCRs instead of printing PCR values")
+	logConf := logging.Flags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	logger, err := logConf.New(logOut)
+	if err != nil {
+		fmt.Fprintln(logOut, err)
+		return err
+	}
+	if err = c.pcr(in, out, logger); err != nil {
+		logger.Error("PCR command failed", "error", err)
+	}
+	return err
+}
+
+// pcr extends PCR and prints selected PCR values
+func (c config) pcr(in io.Reader, out io.Writer, logger sal.Logger) error {
+	if c.format != "text" && c.format != "json" {
+		return fmt.Errorf("unsupported format %q", c.format)
+	}
+	var banks []tpm2.Algorithm
+	if c.banks != "" {
+		for _, name := range strings.Split(c.banks, ",") {
+			bank, err := sal.ParsePCRBank(name)
+			if err != nil {
+				return err
+			}
+			banks = append(banks, bank)
+		}
+	}
+	var indices []int
+	if c.pcrs != "" {
+		sel, err := sal.ParsePCRSelection(c.pcrs)
+		if err != nil {
+			return err
+		}
+		indices = sel.PCRs
+	}
+	t := sal.TPM{
+		TpmDevice: c.tpmPath,
+		Opener: func() (io.ReadWriteCloser, error) {
+			return openTPM(c.tpmPath)
+		},
+		Logger: logger,
+	}
+
+	if c.extend >= 0 {
+		var (
+			data []byte
+			err  error
+		)
+		if c.in == "-" {
+			data, err = io.ReadAll(in)
+		} else {
+			data, err = os.ReadFile(c.in)
+		}
+		if err != nil {
+			return err
+		}
+		if err = t.ExtendPCR(c.extend, data); err != nil {
+			return err
+		}
+	}
+	if c.eventLog != "" {
+		return c.verify(out, t)
+	}
+	values, err := t.ReadPCRs(banks, indices)
+	if err != nil {
+		return err
+	}
+	return c.print(out, values)
+}
+
+// verify replays event log against PCRs of TPM and prints mismatched events and PCRs
+func (c config) verify(out io.Writer, t sal.TPM) error {
+	log, err := sal.LoadEventLog(c.eventLog)
+	if err != nil {
+		return err
+	}
+	mismatches, err := t.VerifyEventLog(log)
+	if err != nil {
+		return err
+	}
+	for _, m := range mismatches {
+		if _, err = fmt.Fprintln(out, m); err != nil {
+			return err
+		}
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("event log doesn't match PCR values, %d mismatches", len(mismatches))
+	}
+	_, err = fmt.Fprintf(out, "event log of %d events matches PCRs %v\n", len(log.Events), log.PCRs())
+	return err
+}
+
+// print writes PCR values in bank and PCR index order
+func (c config) print(out io.Writer, values sal.PCRValues) error {
+	banks := make([]tpm2.Algorithm, 0, len(values))
+	for bank := range values {
+		banks = append(banks, bank)
+	}
+	sort.Slice(banks, func(i, j int) bool { return banks[i] < banks[j] })
+	result := map[string][]pcrValue{}
+	var text strings.Builder
+	for _, bank := range banks {
+		name := sal.PCRBankName(bank)
+		text.WriteString(name + ":\n")
+		pcrs := make([]int, 0, len(values[bank]))
+		for pcr := range values[bank] {
+			pcrs = append(pcrs, pcr)
+		}
+		sort.Ints(pcrs)
+		for _, pcr := range pcrs {
+			v := values[bank][pcr]
+			result[name] = append(result[name], pcrValue{PCR: pcr, Value: hex.EncodeToString(v)})
+			text.WriteString(fmt.Sprintf("  %-2s: 0x%X\n", strconv.Itoa(pcr), v))
+		}
+	}
+	if c.format == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	}
+	_, err := io.WriteString(out, text.String())
+	return err
+}
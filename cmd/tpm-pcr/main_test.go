@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+
+	sal "github.com/shuvava/tpm/pkg/tpm"
+	"github.com/shuvava/tpm/pkg/tpm/tpmtest"
+)
+
+func TestRun(t *testing.T) {
+	sim := tpmtest.Command(t, &openTPM)
+	measured := filepath.Join(sim.Dir, "initrd")
+	if err := os.WriteFile(measured, []byte("initrd image"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		args     []string
+		stdin    string
+		contains []string
+		wantErr  bool
+	}{
+		{"all banks", nil, "", []string{"sha1:\n", "sha256:\n", "  0 : 0x", "  23: 0x"}, false},
+		{"selected PCRs", []string{"-banks", "sha256", "-pcrs", "0,7"}, "", []string{"sha256:\n  0 : 0x", "  7 : 0x"}, false},
+		{"json", []string{"-banks", "sha1,sha256", "-pcrs", "7", "-format", "json"}, "", []string{`"sha1": [`, `"pcr": 7`}, false},
+		{"extend file", []string{"-extend", "16", "-in", measured, "-pcrs", "16"}, "", []string{"  16: 0x"}, false},
+		{"extend stdin", []string{"-extend", "16", "-pcrs", "16"}, "event", []string{"  16: 0x"}, false},
+		{"unsupported bank", []string{"-banks", "md5"}, "", nil, true},
+		{"invalid PCR", []string{"-pcrs", "24"}, "", nil, true},
+		{"unsupported format", []string{"-format", "yaml"}, "", nil, true},
+		{"invalid extended PCR", []string{"-extend", "24"}, "", nil, true},
+		{"missing file", []string{"-extend", "16", "-in", filepath.Join(sim.Dir, "missing")}, "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := run(tt.args, strings.NewReader(tt.stdin), &out, io.Discard)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for _, s := range tt.contains {
+				if !strings.Contains(out.String(), s) {
+					t.Errorf("output doesn't contain %q:\n%s", s, out.String())
+				}
+			}
+		})
+	}
+
+	// extended value matches software replay of the file digest
+	before, err := tpm2.ReadPCR(sim.RW(), 16, tpm2.AlgSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err = run([]string{"-extend", "16", "-in", measured, "-banks", "sha256", "-pcrs", "16", "-format", "json"}, nil, &out, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	var result map[string][]pcrValue
+	if err = json.Unmarshal(out.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("initrd image"))
+	want := sha256.Sum256(append(before, digest[:]...))
+	if len(result["sha256"]) != 1 || result["sha256"][0].Value != hex.EncodeToString(want[:]) {
+		t.Errorf("unexpected JSON output %s", out.String())
+	}
+
+	// SHA-1 event log of the extended file matches PCR 14 after TPM reset
+	sim.Reset()
+	if err = run([]string{"-extend", "14", "-in", measured, "-pcrs", "14"}, nil, io.Discard, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	var log bytes.Buffer
+	_ = binary.Write(&log, binary.LittleEndian, struct {
+		PCR    uint32
+		Type   uint32
+		Digest [20]byte
+		Size   uint32
+	}{14, uint32(sal.EvIPL), sha1.Sum([]byte("initrd image")), uint32(len("initrd image"))})
+	log.WriteString("initrd image")
+	logFile := filepath.Join(sim.Dir, "eventlog.bin")
+	if err = os.WriteFile(logFile, log.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err = run([]string{"-eventlog", logFile}, nil, &out, io.Discard); err != nil || !strings.Contains(out.String(), "matches PCRs [14]") {
+		t.Errorf("event log verification = %v:\n%s", err, out.String())
+	}
+	out.Reset()
+	err = run([]string{"-eventlog", filepath.Join("..", "..", "pkg", "tpm", "testdata", "sha1_eventlog.bin")}, nil, &out, io.Discard)
+	if err == nil || !strings.Contains(out.String(), "doesn't match") {
+		t.Errorf("foreign event log verification = %v:\n%s", err, out.String())
+	}
+	if err = run([]string{"-eventlog", filepath.Join(sim.Dir, "missing")}, nil, io.Discard, io.Discard); err == nil {
+		t.Error("expected error for missing event log")
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/shuvava/tpm/internal/logging"
+	sal "github.com/shuvava/tpm/pkg/tpm"
+)
+
+// config is command line configuration of tpm-policy-sign
+type config struct {
+	key       string
+	pcrs      string
+	pcrValues string
+	policyRef string
+	name      string
+	tss       string
+	out       string
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		os.Exit(1)
+	}
+}
+
+// run parses command line, signs approved PCR policy and writes it, errors are written to the log
+func run(args []string, out io.Writer, logOut io.Writer) error {
+	var c config
+	flags := flag.NewFlagSet("tpm-policy-sign", flag.ContinueOnError)
+	flags.StringVar(&c.key, "key", "policy.key", "PEM private key (PKCS#1, PKCS#8 or SEC 1) authorizing policies, its public key is -authKey of tpm-keygen and tpm-seal")
+	flags.StringVar(&c.pcrs, "pcrs", "", "Approved PCR selection (sha256:0,1,7)")
+	flags.StringVar(&c.pcrValues, "pcrValues", "", "Approved hex values of selected PCRs (0=3d45...,7=65ca...)")
+	flags.StringVar(&c.policyRef, "policyRef", "", "Policy reference of the key or sealed data")
+	flags.StringVar(&c.name, "name", "", "Policy name, like firmware version")
+	flags.StringVar(&c.tss, "tss", "", "TSS file to store signed policy in, policy is appended to -out file when empty")
+	flags.StringVar(&c.out, "out", "-", "Policy file to append signed policy to, - writes stdout")
+	logConf := logging.Flags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	logger, err := logConf.New(logOut)
+	if err != nil {
+		fmt.Fprintln(logOut, err)
+		return err
+	}
+	if err = c.sign(out, logger); err != nil {
+		logger.Error("policy signing failed", "error", err)
+	}
+	return err
+}
+
+// parsePCRValues parses comma separated list of PCR index and hex value pairs
+func parsePCRValues(s string) (map[int][]byte, error) {
+	values := map[int][]byte{}
+	for _, p := range strings.Split(s, ",") {
+		index, value, ok := strings.Cut(strings.TrimSpace(p), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid PCR value %q, must be index=hex", p)
+		}
+		pcr, err := strconv.Atoi(index)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PCR index %q", index)
+		}
+		if values[pcr], err = hex.DecodeString(strings.TrimPrefix(value, "0x")); err != nil {
+			return nil, fmt.Errorf("invalid PCR %d value: %w", pcr, err)
+		}
+	}
+	return values, nil
+}
+
+// sign builds approved PCR policy, signs it without TPM access and writes it into policy or TSS file
+func (c config) sign(out io.Writer, logger sal.Logger) error {
+	if c.pcrs == "" || c.pcrValues == "" {
+		return fmt.Errorf("-pcrs and -pcrValues are required")
+	}
+	sel, err := sal.ParsePCRSelection(c.pcrs)
+	if err != nil {
+		return err
+	}
+	values, err := parsePCRValues(c.pcrValues)
+	if err != nil {
+		return err
+	}
+	if len(values) != len(sel.PCRs) {
+		return fmt.Errorf("%d PCR values don't match %d selected PCRs", len(values), len(sel.PCRs))
+	}
+	policy, err := sal.PCRPolicy(sel, values)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(c.key)
+	if err != nil {
+		return err
+	}
+	signer, err := sal.ParsePrivateKeyPEM(b)
+	if err != nil {
+		return err
+	}
+	signed, err := sal.SignPolicy(signer, c.name, policy, []byte(c.policyRef))
+	if err != nil {
+		return err
+	}
+
+	if c.tss != "" {
+		tss, err := sal.LoadFromFile(c.tss)
+		if err != nil {
+			return err
+		}
+		tss.AuthPolicy = append(tss.AuthPolicy, signed)
+		if err = tss.SaveToFile(c.tss); err != nil {
+			return err
+		}
+		logger.Info("signed policy stored", "file", c.tss, "name", c.name, "policies", len(tss.AuthPolicy))
+		return nil
+	}
+	block, err := signed.EncodePEM()
+	if err != nil {
+		return err
+	}
+	if c.out == "-" {
+		_, err = out.Write(block)
+		return err
+	}
+	f, err := os.OpenFile(c.out, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(block); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	logger.Info("signed policy appended", "file", c.out, "name", c.name)
+	return nil
+}
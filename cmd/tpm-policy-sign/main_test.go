@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+
+	"github.com/shuvava/tpm/pkg/tpm"
+	"github.com/shuvava/tpm/pkg/tpm/tpmtest"
+)
+
+func TestRun(t *testing.T) {
+	sim := tpmtest.New(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := sim.KeyFile(key, "policy.key")
+	secret := []byte("secret")
+	tss, err := tpm.Seal(sim.RW(), secret, tpm.SealOptions{ObjectOptions: tpm.ObjectOptions{AuthorizeKey: key.Public(), PolicyRef: []byte("disk")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := sim.TSSFile(tss, "sealed.tss")
+	values, err := tpm2.ReadPCRs(sim.RW(), tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: []int{0, 7}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pcrValues := fmt.Sprintf("0=%x,7=0x%s", values[0], hex.EncodeToString(values[7]))
+	policyFile := filepath.Join(sim.Dir, "sealed.tss.policy")
+
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{"policy file", []string{"-pcrs", "0,7", "-pcrValues", pcrValues, "-policyRef", "disk", "-name", "v1", "-out", policyFile}, false},
+		{"TSS file", []string{"-pcrs", "0,7", "-pcrValues", pcrValues, "-policyRef", "disk", "-tss", sealed}, false},
+		{"missing values", []string{"-pcrs", "0,7", "-pcrValues", "0=00"}, true},
+		{"invalid value", []string{"-pcrs", "7", "-pcrValues", "7=xx"}, true},
+		{"short value", []string{"-pcrs", "7", "-pcrValues", "7=00"}, true},
+		{"missing PCRs", []string{"-pcrValues", pcrValues}, true},
+		{"missing key", []string{"-pcrs", "0,7", "-pcrValues", pcrValues, "-key", filepath.Join(sim.Dir, "missing.key")}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := run(append([]string{"-key", keyFile}, tt.args...), io.Discard, io.Discard)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// policy written to stdout is accepted with the one appended to policy file
+	var out bytes.Buffer
+	if err = run([]string{"-key", keyFile, "-pcrs", "0,7", "-pcrValues", pcrValues}, &out, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if policies, err := tpm.ParseAuthPolicies(out.Bytes()); err != nil || len(policies) != 1 {
+		t.Fatalf("unexpected stdout policies %v: %v", policies, err)
+	}
+	policies, err := tpm.LoadAuthPolicies(policyFile)
+	if err != nil || len(policies) != 1 || policies[0].Name != "v1" {
+		t.Fatalf("unexpected file policies %v: %v", policies, err)
+	}
+	tss.AuthPolicyFile = policyFile
+	if data, err := tpm.Unseal(sim.RW(), tss, nil); err != nil || !bytes.Equal(data, secret) {
+		t.Errorf("unseal with policy file = %q, %v", data, err)
+	}
+	tss, err = tpm.LoadFromFile(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := tpm.Unseal(sim.RW(), tss, nil); err != nil || !bytes.Equal(data, secret) {
+		t.Errorf("unseal with stored policy = %q, %v", data, err)
+	}
+}
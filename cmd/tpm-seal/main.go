@@ -0,0 +1,136 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+
+	"github.com/shuvava/tpm/internal/logging"
+	sal "github.com/shuvava/tpm/pkg/tpm"
+)
+
+// openTPM opens TPM device, it is replaced by simulator in tests
+var openTPM = sal.OpenDevice
+
+// config is command line configuration of tpm-seal
+type config struct {
+	tpmPath     string
+	in          string
+	parent      int
+	rsaParent   bool
+	parentAuth  string
+	hierAuth    string
+	keyAuth     string
+	noDA        bool
+	description string
+	pcrs        string
+	authKey     string
+	policyRef   string
+	out         string
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stderr); err != nil {
+		os.Exit(1)
+	}
+}
+
+// run parses command line, seals secret and writes TSS file, errors are written to the log
+func run(args []string, in io.Reader, logOut io.Writer) error {
+	var c config
+	flags := flag.NewFlagSet("tpm-seal", flag.ContinueOnError)
+	flags.StringVar(&c.tpmPath, "tpm-path", "/dev/tpm0", "TPM device path or URI (device:/dev/tpmrm0, swtpm:path=/tmp/swtpm.sock, swtpm:host=127.0.0.1,port=2321, mssim:host=127.0.0.1,port=2321)")
+	flags.StringVar(&c.in, "in", "-", fmt.Sprintf("File with secret to seal (up to %d bytes), - reads stdin", sal.MaxSealSize))
+	flags.IntVar(&c.parent, "parent", int(tpm2.HandleOwner), "Parent hierarchy or persistent key handle")
+	flags.BoolVar(&c.rsaParent, "rsaParent", false, "Use RSA storage primary key of hierarchy as parent, ECC primary key is used by default")
+	flags.StringVar(&c.parentAuth, "parentAuth", "", "Persistent parent key authorization value (password)")
+	flags.StringVar(&c.hierAuth, "hierarchyAuth", "", "Parent hierarchy authorization value (password)")
+	flags.StringVar(&c.keyAuth, "keyAuth", "", "Sealed object authorization value (password)")
+	flags.BoolVar(&c.noDA, "noDA", false, "Exempt sealed object from dictionary attack protection")
+	flags.StringVar(&c.pcrs, "pcrs", "", "Bind secret to current PCR values (sha256:0,1,7), PCR policy replaces password authorization")
+	flags.StringVar(&c.authKey, "authKey", "", "PEM public key signing approved policies (tpm-policy-sign), signed policy replaces password authorization")
+	flags.StringVar(&c.policyRef, "policyRef", "", "Policy reference of signed policies, used with -authKey")
+	flags.StringVar(&c.description, "description", "", "Description stored in TSS file")
+	flags.StringVar(&c.out, "out", "sealed.tss", "TSS file to write to")
+	logConf := logging.Flags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	logger, err := logConf.New(logOut)
+	if err != nil {
+		fmt.Fprintln(logOut, err)
+		return err
+	}
+	if err = c.seal(in, logger); err != nil {
+		logger.Error("sealing failed", "error", err)
+	}
+	return err
+}
+
+// seal reads secret, seals it in TPM and writes TSS file
+func (c config) seal(in io.Reader, logger sal.Logger) error {
+	var (
+		data []byte
+		err  error
+	)
+	if c.in == "-" {
+		data, err = io.ReadAll(in)
+	} else {
+		data, err = os.ReadFile(c.in)
+	}
+	if err != nil {
+		return err
+	}
+	opts := sal.SealOptions{
+		ObjectOptions: sal.ObjectOptions{
+			Parent:      tpmutil.Handle(uint32(c.parent)),
+			RSAParent:   c.rsaParent,
+			KeyAuth:     c.keyAuth,
+			Description: c.description,
+			Logger:      logger,
+		},
+	}
+	if c.noDA {
+		opts.Attributes = sal.DefaultSealAttributes | tpm2.FlagNoDA
+	}
+	if c.pcrs != "" {
+		if opts.PCRs, err = sal.ParsePCRSelection(c.pcrs); err != nil {
+			return err
+		}
+	}
+	if c.authKey != "" {
+		b, err := os.ReadFile(c.authKey)
+		if err != nil {
+			return err
+		}
+		if opts.AuthorizeKey, err = sal.ParsePublicKeyPEM(b); err != nil {
+			return err
+		}
+		opts.PolicyRef = []byte(c.policyRef)
+	}
+	if c.parentAuth != "" {
+		opts.ParentAuth = sal.StaticAuth(c.parentAuth)
+	}
+	if c.hierAuth != "" {
+		opts.HierarchyAuth = sal.StaticAuth(c.hierAuth)
+	}
+
+	rwc, err := openTPM(c.tpmPath)
+	if err != nil {
+		return err
+	}
+	defer rwc.Close()
+	tss, err := sal.Seal(rwc, data, opts)
+	if err != nil {
+		return err
+	}
+	if err = tss.SaveToFile(c.out); err != nil {
+		return err
+	}
+	logger.Info("file created", "file", c.out)
+	return nil
+}
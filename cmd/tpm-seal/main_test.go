@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+
+	"github.com/shuvava/tpm/pkg/tpm"
+	"github.com/shuvava/tpm/pkg/tpm/tpmtest"
+)
+
+func TestRun(t *testing.T) {
+	sim := tpmtest.Command(t, &openTPM)
+	sim.PersistPrimary(tpmtest.ECCParentTemplate, tpmtest.ParentHandle)
+	secretFile := filepath.Join(sim.Dir, "secret")
+	if err := os.WriteFile(secretFile, []byte("file secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		stdin   string
+		want    string
+		keyAuth string
+		wantErr bool
+	}{
+		{"stdin", []string{"-noDA", "-description", "api token"}, "stdin secret", "stdin secret", "", false},
+		{"file under persistent parent", []string{"-in", secretFile, "-parent", fmt.Sprint(tpmtest.ParentHandle), "-keyAuth", "pin"}, "", "file secret", "pin", false},
+		{"PCR policy", []string{"-pcrs", "sha1:0,7"}, "pcr secret", "pcr secret", "", false},
+		{"invalid PCRs", []string{"-pcrs", "sha1:x"}, "secret", "", "", true},
+		{"invalid authorizing key", []string{"-in", secretFile, "-authKey", secretFile}, "", "", "", true},
+		{"empty secret", nil, "", "", "", true},
+		{"too large secret", nil, strings.Repeat("x", tpm.MaxSealSize+1), "", "", true},
+		{"missing file", []string{"-in", filepath.Join(sim.Dir, "missing")}, "", "", "", true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := filepath.Join(sim.Dir, fmt.Sprintf("sealed%d.tss", i))
+			err := run(append(tt.args, "-out", out), strings.NewReader(tt.stdin), io.Discard)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			tss, err := tpm.LoadFromFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var auth tpm.AuthFunc
+			if tt.keyAuth != "" {
+				auth = tpm.StaticAuth(tt.keyAuth)
+			}
+			data, err := tpm.Unseal(sim.RW(), tss, auth)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, []byte(tt.want)) {
+				t.Errorf("unsealed %q, want %q", data, tt.want)
+			}
+		})
+	}
+
+	tss, err := tpm.LoadFromFile(filepath.Join(sim.Dir, "sealed0.tss"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := tss.DecodePublic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub.Attributes&tpm2.FlagNoDA == 0 || tss.Description != "api token" {
+		t.Errorf("unexpected attributes %v and description %q", pub.Attributes, tss.Description)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/shuvava/tpm/internal/cli"
+	"github.com/shuvava/tpm/internal/logging"
+	sal "github.com/shuvava/tpm/pkg/tpm"
+)
+
+var (
+	// openTPM opens TPM device, it is replaced by simulator in tests
+	openTPM = sal.OpenDevice
+	// listen creates server listener, it is replaced in tests to get the listening address
+	listen = net.Listen
+)
+
+// shutdownTimeout is time given to active requests to complete on shutdown
+const shutdownTimeout = 5 * time.Second
+
+// config is command line configuration of tpm-server
+type config struct {
+	address string
+	cacert  string
+	pubCert string
+	key     *cli.KeyConfig
+	dir     string
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := run(ctx, os.Args[1:], os.Stderr); err != nil {
+		os.Exit(1)
+	}
+}
+
+// run parses command line and serves HTTPS until ctx is done, errors are written to the log
+func run(ctx context.Context, args []string, logOut io.Writer) error {
+	var c config
+	flags := flag.NewFlagSet("tpm-server", flag.ContinueOnError)
+	flags.StringVar(&c.address, "address", ":8443", "Listen address")
+	flags.StringVar(&c.cacert, "cacert", "", "CA certificates verifying client certificates, client certificates aren't requested when empty")
+	flags.StringVar(&c.pubCert, "pubCert", "server.crt", "Public Cert file, may contain intermediate certificates")
+	c.key = cli.KeyFlags(flags)
+	flags.StringVar(&c.dir, "dir", "", "Directory served by the server, requests are echoed when empty")
+	logConf := logging.Flags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	logger, err := logConf.New(logOut)
+	if err != nil {
+		fmt.Fprintln(logOut, err)
+		return err
+	}
+	if err = c.serve(ctx, logger); err != nil {
+		logger.Error("server failed", "address", c.address, "error", err)
+	}
+	return err
+}
+
+// serve serves HTTPS with TPM backed server certificate until ctx is done
+func (c config) serve(ctx context.Context, logger sal.Logger) error {
+	ext := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.cacert != "" {
+		caCert, err := os.ReadFile(c.cacert)
+		if err != nil {
+			return err
+		}
+		ext.ClientCAs = x509.NewCertPool()
+		if !ext.ClientCAs.AppendCertsFromPEM(caCert) {
+			return fmt.Errorf("no CA certificates found in %s", c.cacert)
+		}
+	}
+
+	conf, err := c.key.TPM(openTPM, logger)
+	if err != nil {
+		return err
+	}
+	// key stays loaded between handshakes
+	conf.KeepOpen = true
+	conf.PublicCertFile = c.pubCert
+	conf.ExtTLSConfig = ext
+	r, err := sal.NewTPMCrypto(conf)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tlsConfig, err := r.ServerTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	handler := http.Handler(http.HandlerFunc(echo))
+	if c.dir != "" {
+		handler = http.FileServer(http.Dir(c.dir))
+	}
+	srv := &http.Server{
+		Handler:           logRequests(handler, logger),
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          log.New(logWriter{logger}, "", 0),
+	}
+
+	ln, err := listen("tcp", c.address)
+	if err != nil {
+		return err
+	}
+	logger.Info("server started", "address", ln.Addr().String(), "clientAuth", tlsConfig.ClientAuth.String())
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ServeTLS(ln, "", "")
+	}()
+	select {
+	case err = <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = srv.Shutdown(shutdownCtx)
+	if srvErr := <-errc; !errors.Is(srvErr, http.ErrServerClosed) && err == nil {
+		err = srvErr
+	}
+	logger.Info("server stopped", "address", ln.Addr().String())
+	return err
+}
+
+// echo writes request line, client certificate subject and request body back to the client
+func echo(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "%s %s %s\n", r.Method, r.URL.RequestURI(), r.Proto)
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		fmt.Fprintf(w, "client: %s\n", r.TLS.PeerCertificates[0].Subject)
+	}
+	_, _ = io.Copy(w, r.Body)
+}
+
+// logRequests logs served requests at info level
+func logRequests(next http.Handler, logger sal.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		client := ""
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			client = r.TLS.PeerCertificates[0].Subject.String()
+		}
+		logger.Info("request served", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr,
+			"client", client, "duration", time.Since(start))
+	})
+}
+
+// logWriter writes http.Server error log (TLS handshake errors) as warning records
+type logWriter struct {
+	logger sal.Logger
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w.logger.Warn(strings.TrimSpace(string(p)))
+	return len(p), nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+
+	"github.com/shuvava/tpm/pkg/tpm/tpmtest"
+)
+
+// start runs server with args and returns its address, the server is stopped on test cleanup
+func start(t *testing.T, args ...string) string {
+	t.Helper()
+	addrc := make(chan string, 1)
+	listen = func(network, address string) (net.Listener, error) {
+		ln, err := net.Listen(network, address)
+		if err == nil {
+			addrc <- ln.Addr().String()
+		}
+		return ln, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- run(ctx, append([]string{"-address", "127.0.0.1:0"}, args...), io.Discard)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-errc; err != nil {
+			t.Errorf("server error: %v", err)
+		}
+	})
+	select {
+	case addr := <-addrc:
+		return addr
+	case err := <-errc:
+		t.Fatalf("server is not started: %v", err)
+		return ""
+	}
+}
+
+func TestRun(t *testing.T) {
+	sim := tpmtest.Command(t, &openTPM)
+	ca := sim.NewCA()
+
+	tss := sim.TSSKey(tpm2.HandleOwner, tpmtest.ECCParentTemplate, "", tpmtest.ECCSigningTemplate)
+	pub, err := tss.DecodePublic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := pub.Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tssFile := sim.TSSFile(tss, "server.tss")
+	certFile := sim.Issue(ca, key, "localhost", "server.crt")
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := tls.LoadX509KeyPair(sim.Issue(ca, clientKey.Public(), "client.local", "client.crt"), sim.KeyFile(clientKey, "client.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.Pool, Certificates: certs}}}
+	}
+	url := func(addr, path string) string {
+		return "https://" + strings.Replace(addr, "127.0.0.1", "localhost", 1) + path
+	}
+
+	t.Run("echo with client certificate", func(t *testing.T) {
+		addr := start(t, "-tssfile", tssFile, "-pubCert", certFile, "-cacert", ca.File, "-sigAlg", "ECDSA-SHA256")
+		resp, err := client(clientCert).Post(url(addr, "/echo?x=1"), "text/plain", bytes.NewBufferString("ping"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{"POST /echo?x=1", "client: CN=client.local", "ping"} {
+			if !strings.Contains(string(body), want) {
+				t.Errorf("response %q doesn't contain %q", body, want)
+			}
+		}
+
+		if _, err = client().Get(url(addr, "/")); err == nil {
+			t.Error("expected error for client without certificate")
+		}
+	})
+
+	t.Run("directory", func(t *testing.T) {
+		dir := filepath.Join(sim.Dir, "www")
+		if err := os.Mkdir(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "index.txt"), []byte("served from TPM"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		addr := start(t, "-tssfile", tssFile, "-pubCert", certFile, "-dir", dir)
+		resp, err := client().Get(url(addr, "/index.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "served from TPM" {
+			t.Errorf("unexpected response %q", body)
+		}
+	})
+
+	t.Run("certificate of other key", func(t *testing.T) {
+		err := run(context.Background(), []string{"-tssfile", tssFile, "-pubCert", sim.Issue(ca, clientKey.Public(), "other", "other.crt"),
+			"-sigAlg", "ECDSA-SHA256"}, io.Discard)
+		if err == nil {
+			t.Error("expected certificate mismatch error")
+		}
+	})
+}
@@ -2,44 +2,59 @@ package main
 
 import (
 	"flag"
-	"log"
+	"fmt"
+	"io"
+	"os"
 
+	"github.com/shuvava/tpm/internal/logging"
 	sal "github.com/shuvava/tpm/pkg/tpm"
 )
 
-var (
-	ctxFile = flag.String("ctx", "key.ctx", "TPM key context")
-	handle  = flag.Int("parent", 0, "key parent object ID")
-	tpmPath = flag.String("tpm-path", "/dev/tpm0", "Path to the TPM device (character device or a Unix socket).")
-)
+// openTPM opens TPM device, it is replaced by simulator in tests
+var openTPM = sal.OpenDevice
 
 func main() {
-	flag.Parse()
-	var key sal.TPM
-	var err error
+	if err := run(os.Args[1:], os.Stderr); err != nil {
+		os.Exit(1)
+	}
+}
+
+// run parses command line and loads the key, errors are written to the log
+func run(args []string, logOut io.Writer) error {
+	flags := flag.NewFlagSet("tpm-test", flag.ContinueOnError)
+	ctxFile := flags.String("ctx", "key.ctx", "TPM key context")
+	handle := flags.Int("parent", 0, "key parent object ID")
+	tpmPath := flags.String("tpm-path", "/dev/tpm0", "TPM device path or URI (device:/dev/tpmrm0, swtpm:path=/tmp/swtpm.sock, swtpm:host=127.0.0.1,port=2321, mssim:host=127.0.0.1,port=2321)")
+	logConf := logging.Flags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	logger, err := logConf.New(logOut)
+	if err != nil {
+		fmt.Fprintln(logOut, err)
+		return err
+	}
+
+	conf := &sal.TPM{
+		TpmDevice: *tpmPath,
+		Opener: func() (io.ReadWriteCloser, error) {
+			return openTPM(*tpmPath)
+		},
+		Logger: logger,
+	}
 	if *handle > 0 {
-		key, err = sal.NewTPMCrypto(&sal.TPM{
-			TpmDevice: *tpmPath,
-			TpmHandle: uint32(*handle),
-		})
-		if err != nil {
-			log.Println(err)
-			return
-		}
+		conf.TpmHandle = uint32(*handle)
 	} else {
-		key, err = sal.NewTPMCrypto(&sal.TPM{
-			TpmDevice:     *tpmPath,
-			TpmHandleFile: *ctxFile,
-		})
-		if err != nil {
-			log.Println(err)
-			return
-		}
+		conf.TpmHandleFile = *ctxFile
 	}
-	k := key.Public()
-	if k != nil {
-		log.Println("key loaded")
-	} else {
-		log.Println("error on key load")
+	key, err := sal.NewTPMCrypto(conf)
+	if err == nil {
+		_, err = key.PublicKey()
+	}
+	if err != nil {
+		logger.Error("error on key load", "error", err)
+		return err
 	}
+	logger.Info("key loaded")
+	return nil
 }
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/shuvava/tpm/pkg/tpm/tpmtest"
+)
+
+func TestRun(t *testing.T) {
+	sim := tpmtest.Command(t, &openTPM)
+	const handle = 0x81000030
+	sim.PersistKey(tpmtest.RSASigningTemplate, "", handle)
+	ctxFile := sim.ContextFile(tpmtest.ECCSigningTemplate, "key.ctx")
+
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{"context file", []string{"-ctx", ctxFile}, false},
+		{"persistent handle", []string{"-parent", fmt.Sprint(handle)}, false},
+		{"missing context file", []string{"-ctx", filepath.Join(sim.Dir, "missing.ctx")}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := run(tt.args, io.Discard); (err != nil) != tt.wantErr {
+				t.Errorf("run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,54 +1,54 @@
 package main
 
 import (
-	"encoding/pem"
 	"flag"
 	"fmt"
-	"log"
+	"io"
 	"os"
 
 	"github.com/google/go-tpm/tpm2"
 	"github.com/google/go-tpm/tpmutil"
 
+	"github.com/shuvava/tpm/internal/logging"
 	"github.com/shuvava/tpm/pkg/tpm"
 )
 
-var (
-	pubFile = flag.String("pubFile", "key.pub", "TPM public key File")
-	keyFile = flag.String("keyFile", "key.priv", "TPM KeyFile")
-	parent  = flag.Int("parent", int(tpm2.HandleOwner), "key parent object ID")
-)
-
 func main() {
-	flag.Parse()
-	fmt.Fprintf(os.Stderr, "TSS parent objectID %X\n", *parent)
-	var tss = tpm.TSS{Parent: tpmutil.Handle(uint32(*parent)), EmptyAuth: true}
-	bpub, err := os.ReadFile(*pubFile)
-	if err != nil {
-		log.Println(err)
-		return
+	if err := run(os.Args[1:], os.Stderr); err != nil {
+		os.Exit(1)
 	}
-	bkey, err := os.ReadFile(*keyFile)
-	if err != nil {
-		log.Println(err)
-		return
+}
+
+// run parses command line and writes TSS file, errors are written to the log
+func run(args []string, logOut io.Writer) error {
+	flags := flag.NewFlagSet("tpm-tss-creator", flag.ContinueOnError)
+	pubFile := flags.String("pubFile", "key.pub", "TPM public key File")
+	keyFile := flags.String("keyFile", "key.priv", "TPM KeyFile")
+	parent := flags.Int("parent", int(tpm2.HandleOwner), "key parent object ID")
+	emptyAuth := flags.Bool("emptyAuth", true, "key has empty authorization value")
+	outFile := flags.String("out", "key.tss", "TSS file to write to")
+	logConf := logging.Flags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
 	}
-	tss.Public = bpub
-	tss.Private = bkey
-	b, err := tss.Marshal()
+	logger, err := logConf.New(logOut)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "TSS marshaaling failed%v\n", err)
-		os.Exit(1)
+		fmt.Fprintln(logOut, err)
+		return err
 	}
-	pemBlock := pem.Block{
-		Type:  "TSS2 PRIVATE KEY",
-		Bytes: b,
+
+	logger.Info("TSS parent objectID", "parent", fmt.Sprintf("0x%X", *parent))
+	var tss = tpm.TSS{Parent: tpmutil.Handle(uint32(*parent)), EmptyAuth: *emptyAuth}
+	if tss.Public, err = os.ReadFile(*pubFile); err == nil {
+		tss.Private, err = os.ReadFile(*keyFile)
+	}
+	if err == nil {
+		err = tss.SaveToFile(*outFile)
 	}
-	pemBytes := pem.EncodeToMemory(&pemBlock)
-	err = os.WriteFile("key.tss", pemBytes, 0644)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "ContextSave failed for ekh%v\n", err)
-		os.Exit(1)
+		logger.Error("TSS file saving failed", "error", err)
+		return err
 	}
-	log.Println("file created")
+	logger.Info("file created", "file", *outFile)
+	return nil
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+
+	"github.com/shuvava/tpm/pkg/tpm"
+	"github.com/shuvava/tpm/pkg/tpm/tpmtest"
+)
+
+func TestRun(t *testing.T) {
+	sim := tpmtest.New(t)
+	parent := sim.CreatePrimary(tpm2.HandleOwner, tpmtest.ECCParentTemplate)
+	public, private := sim.CreateKey(parent, "", "", tpmtest.ECCSigningTemplate)
+	sim.Flush(parent)
+
+	pubFile := filepath.Join(sim.Dir, "key.pub")
+	keyFile := filepath.Join(sim.Dir, "key.priv")
+	outFile := filepath.Join(sim.Dir, "key.tss")
+	for f, b := range map[string][]byte{pubFile: public, keyFile: private} {
+		if err := os.WriteFile(f, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := run([]string{"-pubFile", pubFile, "-keyFile", keyFile, "-out", outFile}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	tss, err := tpm.LoadFromFile(outFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tss.Parent != tpm2.HandleOwner || !tss.EmptyAuth {
+		t.Errorf("unexpected TSS %+v", tss)
+	}
+	kh, err := tss.LoadKey(sim.RW())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim.Flush(kh)
+
+	if err = run([]string{"-pubFile", filepath.Join(sim.Dir, "missing.pub"), "-out", outFile}, io.Discard); err == nil {
+		t.Error("expected error for missing public file")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/shuvava/tpm/internal/logging"
+	sal "github.com/shuvava/tpm/pkg/tpm"
+)
+
+// openTPM opens TPM device, it is replaced by simulator in tests
+var openTPM = sal.OpenDevice
+
+// config is command line configuration of tpm-unseal
+type config struct {
+	tpmPath    string
+	in         string
+	parentAuth string
+	hierAuth   string
+	keyAuth    string
+	policyFile string
+	out        string
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		os.Exit(1)
+	}
+}
+
+// run parses command line, unseals secret of TSS file and writes it to out, errors are written to the log
+func run(args []string, out io.Writer, logOut io.Writer) error {
+	var c config
+	flags := flag.NewFlagSet("tpm-unseal", flag.ContinueOnError)
+	flags.StringVar(&c.tpmPath, "tpm-path", "/dev/tpm0", "TPM device path or URI (device:/dev/tpmrm0, swtpm:path=/tmp/swtpm.sock, swtpm:host=127.0.0.1,port=2321, mssim:host=127.0.0.1,port=2321)")
+	flags.StringVar(&c.in, "in", "sealed.tss", "Sealed data TSS file")
+	flags.StringVar(&c.parentAuth, "parentAuth", "", "Persistent parent key authorization value (password)")
+	flags.StringVar(&c.hierAuth, "hierarchyAuth", "", "Parent hierarchy authorization value (password)")
+	flags.StringVar(&c.keyAuth, "keyAuth", "", "Sealed object authorization value (password)")
+	flags.StringVar(&c.policyFile, "policyFile", "", "File with signed policies (tpm-policy-sign) of sealed data created with -authKey")
+	flags.StringVar(&c.out, "out", "-", "File to write unsealed secret to, - writes stdout")
+	logConf := logging.Flags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	logger, err := logConf.New(logOut)
+	if err != nil {
+		fmt.Fprintln(logOut, err)
+		return err
+	}
+	if err = c.unseal(out, logger); err != nil {
+		logger.Error("unsealing failed", "error", err)
+	}
+	return err
+}
+
+// unseal loads TSS file, unseals secret in TPM and writes it
+func (c config) unseal(out io.Writer, logger sal.Logger) error {
+	tss, err := sal.LoadFromFile(c.in)
+	if err != nil {
+		return err
+	}
+	tss.Logger = logger
+	tss.AuthPolicyFile = c.policyFile
+	if c.parentAuth != "" {
+		tss.ParentAuth = sal.StaticAuth(c.parentAuth)
+	}
+	if c.hierAuth != "" {
+		tss.HierarchyAuth = sal.StaticAuth(c.hierAuth)
+	}
+	var auth sal.AuthFunc
+	if c.keyAuth != "" {
+		auth = sal.StaticAuth(c.keyAuth)
+	}
+
+	rwc, err := openTPM(c.tpmPath)
+	if err != nil {
+		return err
+	}
+	defer rwc.Close()
+	data, err := sal.Unseal(rwc, tss, auth)
+	if err != nil {
+		return err
+	}
+	if c.out == "-" {
+		_, err = out.Write(data)
+		return err
+	}
+	// unsealed secret is readable by owner only
+	if err = os.WriteFile(c.out, data, 0600); err != nil {
+		return err
+	}
+	logger.Info("file created", "file", c.out)
+	return nil
+}
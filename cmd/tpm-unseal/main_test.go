@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+
+	"github.com/shuvava/tpm/pkg/tpm"
+	"github.com/shuvava/tpm/pkg/tpm/tpmtest"
+)
+
+func TestRun(t *testing.T) {
+	sim := tpmtest.Command(t, &openTPM)
+	secret := []byte("api token")
+	tss, err := tpm.Seal(sim.RW(), secret, tpm.SealOptions{ObjectOptions: tpm.ObjectOptions{KeyAuth: "pin"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := sim.TSSFile(tss, "sealed.tss")
+	key, err := tpm.CreateKey(sim.RW(), tpm.KeyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := sim.TSSFile(key, "key.tss")
+
+	// sealed data authorized by signed PCR policy
+	signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorized, err := tpm.Seal(sim.RW(), secret, tpm.SealOptions{ObjectOptions: tpm.ObjectOptions{AuthorizeKey: signer.Public()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizedFile := sim.TSSFile(authorized, "authorized.tss")
+	sel := tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: []int{7}}
+	values, err := tpm2.ReadPCRs(sim.RW(), sel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := tpm.PCRPolicy(sel, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := tpm.SignPolicy(signer, "boot", policy, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := signed.EncodePEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	policyFile := filepath.Join(sim.Dir, "authorized.tss.policy")
+	if err = os.WriteFile(policyFile, block, 0644); err != nil {
+		t.Fatal(err)
+	}
+	outFile := filepath.Join(sim.Dir, "secret")
+
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{"stdout", []string{"-in", sealed, "-keyAuth", "pin"}, false},
+		{"file", []string{"-in", sealed, "-keyAuth", "pin", "-out", outFile}, false},
+		{"signed policy", []string{"-in", authorizedFile, "-policyFile", policyFile}, false},
+		{"missing auth", []string{"-in", sealed}, true},
+		{"missing signed policy", []string{"-in", authorizedFile}, true},
+		{"signing key", []string{"-in", keyFile}, true},
+		{"missing file", []string{"-in", filepath.Join(sim.Dir, "missing.tss")}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := run(tt.args, &out, io.Discard)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got := out.Bytes()
+			if len(got) == 0 {
+				if got, err = os.ReadFile(outFile); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !bytes.Equal(got, secret) {
+				t.Errorf("unsealed %q, want %q", got, secret)
+			}
+		})
+	}
+}
@@ -3,7 +3,6 @@ module github.com/shuvava/tpm
 go 1.18
 
 require (
-	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
 	github.com/google/go-tpm v0.3.3
 	github.com/google/go-tpm-tools v0.3.8
 )
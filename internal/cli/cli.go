@@ -0,0 +1,105 @@
+// Package cli provides TPM key flags shared by command line tools presenting TPM backed certificates
+package cli
+
+import (
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+
+	sal "github.com/shuvava/tpm/pkg/tpm"
+)
+
+// SignatureAlgorithms maps -sigAlg names to supported signature algorithms, empty name
+// selects the default algorithm of the key type
+var SignatureAlgorithms = map[string]x509.SignatureAlgorithm{
+	"":                             x509.UnknownSignatureAlgorithm,
+	x509.SHA256WithRSA.String():    x509.SHA256WithRSA,
+	x509.SHA256WithRSAPSS.String(): x509.SHA256WithRSAPSS,
+	x509.ECDSAWithSHA256.String():  x509.ECDSAWithSHA256,
+	x509.ECDSAWithSHA384.String():  x509.ECDSAWithSHA384,
+}
+
+// KeyConfig is TPM key configuration set by command line flags
+type KeyConfig struct {
+	KeyFile    string
+	KeyHandle  int
+	TSSFile    string
+	TPMPath    string
+	KeyAuth    string
+	PolicyFile string
+	ParentAuth string
+	HierAuth   string
+	RewriteImp bool
+	SigAlg     string
+}
+
+// KeyFlags registers TPM device, key, authorization and signature algorithm flags in fs
+func KeyFlags(fs *flag.FlagSet) *KeyConfig {
+	c := &KeyConfig{}
+	fs.StringVar(&c.KeyFile, "tpmfile", "", "TPM KeyFile")
+	fs.IntVar(&c.KeyHandle, "tpmHandle", 0, "TPM persistent key handle")
+	fs.StringVar(&c.TSSFile, "tssfile", "", "TPM TSS 2.0 file generated by tpm2tss-genkey")
+	fs.StringVar(&c.TPMPath, "tpm-path", "/dev/tpm0", "TPM device path or URI (device:/dev/tpmrm0, swtpm:path=/tmp/swtpm.sock, swtpm:host=127.0.0.1,port=2321, mssim:host=127.0.0.1,port=2321)")
+	fs.StringVar(&c.KeyAuth, "keyAuth", "", "TPM key authorization value (password)")
+	fs.StringVar(&c.PolicyFile, "policyFile", "", "File with signed policies (tpm-policy-sign) of TSS key created with -authKey")
+	fs.StringVar(&c.ParentAuth, "parentAuth", "", "TPM TSS key persistent parent authorization value (password)")
+	fs.StringVar(&c.HierAuth, "hierarchyAuth", "", "TPM TSS key parent hierarchy authorization value (password)")
+	fs.BoolVar(&c.RewriteImp, "rewriteImported", false, "Rewrite importable TSS file as loadable key after import")
+	fs.StringVar(&c.SigAlg, "sigAlg", "", "Signature algorithm (SHA256-RSA, SHA256-RSAPSS, ECDSA-SHA256, ECDSA-SHA384), derived from the key by default")
+	return c
+}
+
+// TPM returns configuration of the key for sal.NewTPMCrypto, TPM device is opened by open
+func (c *KeyConfig) TPM(open func(path string) (io.ReadWriteCloser, error), logger sal.Logger) (*sal.TPM, error) {
+	signatureAlgorithm, ok := SignatureAlgorithms[c.SigAlg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported signature algorithm %q", c.SigAlg)
+	}
+	tss, err := c.TSS()
+	if err != nil {
+		return nil, err
+	}
+	var auth sal.AuthFunc
+	if c.KeyAuth != "" {
+		auth = sal.StaticAuth(c.KeyAuth)
+	}
+	return &sal.TPM{
+		Tss:           tss,
+		TpmHandle:     uint32(c.KeyHandle),
+		TpmHandleFile: c.KeyFile,
+		KeyAuth:       auth,
+		Logger:        logger,
+
+		TpmDevice: c.TPMPath,
+		Opener: func() (io.ReadWriteCloser, error) {
+			return open(c.TPMPath)
+		},
+		SignatureAlgorithm: signatureAlgorithm,
+	}, nil
+}
+
+// TSS loads TSS key file with its parent authorization and signed policies,
+// nil is returned when TSS file is not specified
+func (c *KeyConfig) TSS() (*sal.TSS, error) {
+	if c.TSSFile == "" {
+		return nil, nil
+	}
+	tss, err := sal.LoadFromFile(c.TSSFile)
+	if err != nil {
+		return nil, err
+	}
+	tss.AuthPolicyFile = c.PolicyFile
+	if c.ParentAuth != "" {
+		tss.ParentAuth = sal.StaticAuth(c.ParentAuth)
+	}
+	if c.HierAuth != "" {
+		tss.HierarchyAuth = sal.StaticAuth(c.HierAuth)
+	}
+	if c.RewriteImp {
+		tss.OnImport = func(imported *sal.TSS) error {
+			return imported.SaveToFile(c.TSSFile)
+		}
+	}
+	return tss, nil
+}
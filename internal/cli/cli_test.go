@@ -0,0 +1,95 @@
+package cli
+
+import (
+	"crypto/x509"
+	"flag"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+
+	sal "github.com/shuvava/tpm/pkg/tpm"
+	"github.com/shuvava/tpm/pkg/tpm/tpmtest"
+)
+
+func TestKeyConfig(t *testing.T) {
+	sim := tpmtest.New(t)
+	tss := sim.TSSKey(tpm2.HandleOwner, tpmtest.ECCParentTemplate, "", tpmtest.ECCSigningTemplate)
+	tssFile := sim.TSSFile(tss, "key.tss")
+
+	tests := []struct {
+		name    string
+		args    []string
+		wantTSS bool
+		wantErr bool
+	}{
+		{"handle", []string{"-tpmHandle", "0x81000000"}, false, false},
+		{"TSS file", []string{"-tssfile", tssFile, "-parentAuth", "parent", "-policyFile", "key.policy", "-sigAlg", "ECDSA-SHA256"}, true, false},
+		{"missing TSS file", []string{"-tssfile", filepath.Join(sim.Dir, "missing.tss")}, false, true},
+		{"unsupported signature algorithm", []string{"-sigAlg", "SHA1-RSA"}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			c := KeyFlags(fs)
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			var opened string
+			conf, err := c.TPM(func(path string) (io.ReadWriteCloser, error) {
+				opened = path
+				return sim.Open()
+			}, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("TPM() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if (conf.Tss != nil) != tt.wantTSS {
+				t.Fatalf("unexpected TSS key %v", conf.Tss)
+			}
+			if tt.wantTSS && (conf.Tss.ParentAuth == nil || conf.Tss.AuthPolicyFile != "key.policy" ||
+				conf.SignatureAlgorithm != x509.ECDSAWithSHA256) {
+				t.Errorf("TSS key flags are not applied: %+v", conf)
+			}
+			rwc, err := conf.Opener()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = rwc.Close()
+			if opened != "/dev/tpm0" {
+				t.Errorf("opened TPM device %q", opened)
+			}
+		})
+	}
+}
+
+func TestKeyConfigDefaultSignatureAlgorithm(t *testing.T) {
+	sim := tpmtest.New(t)
+	tss := sim.TSSKey(tpm2.HandleOwner, tpmtest.ECCParentTemplate, "", tpmtest.ECCSigningTemplate)
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	c := KeyFlags(fs)
+	if err := fs.Parse([]string{"-tssfile", sim.TSSFile(tss, "key.tss")}); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := c.TPM(func(string) (io.ReadWriteCloser, error) {
+		return sim.Open()
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.SignatureAlgorithm != x509.UnknownSignatureAlgorithm {
+		t.Fatalf("signature algorithm %v is set without -sigAlg", conf.SignatureAlgorithm)
+	}
+	// ECC key signs with ECDSA without -sigAlg
+	k, err := sal.NewTPMCrypto(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Close()
+	if _, err = k.BuildTLSConfig(); err != nil {
+		t.Errorf("BuildTLSConfig() error = %v", err)
+	}
+}
@@ -0,0 +1,212 @@
+// Package logging provides structured logger shared by command line tools.
+// Records are written in slog compatible text or JSON format
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Level is logging level
+type Level int
+
+// Logging levels, values match log/slog levels
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "DEBUG",
+	LevelInfo:  "INFO",
+	LevelWarn:  "WARN",
+	LevelError: "ERROR",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel parses level name (debug, info, warn or error)
+func ParseLevel(s string) (Level, error) {
+	for level, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// Config is logger configuration set by command line flags
+type Config struct {
+	Level  string
+	Format string
+}
+
+// Flags registers -log-level and -log-format flags in fs
+func Flags(fs *flag.FlagSet) *Config {
+	c := &Config{}
+	fs.StringVar(&c.Level, "log-level", "info", "Log level (debug, info, warn, error)")
+	fs.StringVar(&c.Format, "log-format", "text", "Log format (text, json)")
+	return c
+}
+
+// New creates logger writing to w
+func (c *Config) New(w io.Writer) (*Logger, error) {
+	level, err := ParseLevel(c.Level)
+	if err != nil {
+		return nil, err
+	}
+	switch c.Format {
+	case "text", "":
+		return &Logger{w: w, level: level}, nil
+	case "json":
+		return &Logger{w: w, level: level, json: true}, nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", c.Format)
+	}
+}
+
+// Logger writes structured log records, args of its methods are alternating keys and values
+type Logger struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level Level
+	json  bool
+	// now returns record time, it is replaced in tests
+	now func() time.Time
+}
+
+// Debug logs record at debug level
+func (l *Logger) Debug(msg string, args ...any) {
+	l.log(LevelDebug, msg, args)
+}
+
+// Info logs record at info level
+func (l *Logger) Info(msg string, args ...any) {
+	l.log(LevelInfo, msg, args)
+}
+
+// Warn logs record at warning level
+func (l *Logger) Warn(msg string, args ...any) {
+	l.log(LevelWarn, msg, args)
+}
+
+// Error logs record at error level
+func (l *Logger) Error(msg string, args ...any) {
+	l.log(LevelError, msg, args)
+}
+
+func (l *Logger) log(level Level, msg string, args []any) {
+	if level < l.level {
+		return
+	}
+	now := time.Now()
+	if l.now != nil {
+		now = l.now()
+	}
+	attrs := []any{"time", now.Format(time.RFC3339Nano), "level", level.String(), "msg", msg}
+	for len(args) > 0 {
+		if len(args) == 1 {
+			attrs = append(attrs, "!BADKEY", args[0])
+			break
+		}
+		key, ok := args[0].(string)
+		if !ok {
+			attrs = append(attrs, "!BADKEY", args[0])
+			args = args[1:]
+			continue
+		}
+		attrs = append(attrs, key, args[1])
+		args = args[2:]
+	}
+
+	var buf bytes.Buffer
+	if l.json {
+		writeJSON(&buf, attrs)
+	} else {
+		writeText(&buf, attrs)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.w.Write(buf.Bytes())
+}
+
+func writeText(buf *bytes.Buffer, attrs []any) {
+	for i := 0; i < len(attrs); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(attrs[i].(string))
+		buf.WriteByte('=')
+		s := fmt.Sprint(textValue(attrs[i+1]))
+		if needsQuoting(s) {
+			s = strconv.Quote(s)
+		}
+		buf.WriteString(s)
+	}
+	buf.WriteByte('\n')
+}
+
+func writeJSON(buf *bytes.Buffer, attrs []any) {
+	buf.WriteByte('{')
+	for i := 0; i < len(attrs); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(attrs[i])
+		buf.Write(key)
+		buf.WriteByte(':')
+		value, err := json.Marshal(jsonValue(attrs[i+1]))
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(attrs[i+1]))
+		}
+		buf.Write(value)
+	}
+	buf.WriteString("}\n")
+}
+
+func textValue(v any) any {
+	if err, ok := v.(error); ok {
+		return err.Error()
+	}
+	return v
+}
+
+func jsonValue(v any) any {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return int64(v)
+	case fmt.Stringer:
+		return v.String()
+	case json.Marshaler:
+		return v
+	case []byte:
+		return fmt.Sprintf("%x", v)
+	}
+	return v
+}
+
+func needsQuoting(s string) bool {
+	if s == "" {
+		return true
+	}
+	for _, r := range s {
+		if unicode.IsSpace(r) || r == '"' || r == '=' || !unicode.IsPrint(r) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"testing"
+	"time"
+)
+
+func TestLogger(t *testing.T) {
+	ts := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name   string
+		args   []string
+		want   string
+		failed bool
+	}{
+		{
+			name: "text",
+			want: `time=2023-01-02T03:04:05Z level=INFO msg="key loaded" handle=0x80000000 error="bad auth" !BADKEY=odd` + "\n" +
+				`time=2023-01-02T03:04:05Z level=ERROR msg=failed` + "\n",
+		},
+		{
+			name: "json debug",
+			args: []string{"-log-format", "json", "-log-level", "debug"},
+			want: `{"time":"2023-01-02T03:04:05Z","level":"DEBUG","msg":"signed","duration":1500}` + "\n" +
+				`{"time":"2023-01-02T03:04:05Z","level":"INFO","msg":"key loaded","handle":"0x80000000","error":"bad auth","!BADKEY":"odd"}` + "\n" +
+				`{"time":"2023-01-02T03:04:05Z","level":"ERROR","msg":"failed"}` + "\n",
+		},
+		{name: "unknown level", args: []string{"-log-level", "trace"}, failed: true},
+		{name: "unknown format", args: []string{"-log-format", "xml"}, failed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			conf := Flags(fs)
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			l, err := conf.New(&buf)
+			if tt.failed {
+				if err == nil {
+					t.Error("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			l.now = func() time.Time { return ts }
+			l.Debug("signed", "duration", 1500*time.Nanosecond)
+			l.Info("key loaded", "handle", "0x80000000", "error", errors.New("bad auth"), "odd")
+			l.Error("failed")
+			if got := buf.String(); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", buf.String(), tt.want)
+			}
+		})
+	}
+}
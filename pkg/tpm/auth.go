@@ -0,0 +1,33 @@
+package tpm
+
+import (
+	"github.com/google/go-tpm/tpm2"
+)
+
+// AuthFunc returns authorization value (password or PIN) of TPM object.
+// It can prompt user, it is called once per key load
+type AuthFunc func() (string, error)
+
+// StaticAuth returns AuthFunc returning the same authorization value on every call
+func StaticAuth(auth string) AuthFunc {
+	return func() (string, error) {
+		return auth, nil
+	}
+}
+
+// resolve returns authorization value, nil AuthFunc means empty authorization
+func (f AuthFunc) resolve() (string, error) {
+	if f == nil {
+		return defaultPassword, nil
+	}
+	return f()
+}
+
+// passwordAuth builds password session authorization for TPM command
+func passwordAuth(auth string) tpm2.AuthCommand {
+	return tpm2.AuthCommand{
+		Session:    tpm2.HandlePasswordSession,
+		Attributes: tpm2.AttrContinueSession,
+		Auth:       []byte(auth),
+	}
+}
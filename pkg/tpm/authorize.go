@@ -0,0 +1,434 @@
+package tpm
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// Policy commands which are not provided by go-tpm
+const (
+	// CmdPolicyAuthorize is TPM2_PolicyAuthorize command code used in TSS policies
+	CmdPolicyAuthorize tpmutil.Command = 0x0000016A
+	cmdPolicyAuthValue tpmutil.Command = 0x0000016B
+	cmdVerifySignature tpmutil.Command = 0x00000177
+	cmdPolicyRestart   tpmutil.Command = 0x00000180
+)
+
+// authPolicyPEMType is PEM block type of signed policy files
+const authPolicyPEMType = "TSS2 AUTH POLICY"
+
+// policyAuthorize is decoded CommandPolicy of PolicyAuthorize TSS command: public area of
+// the authorizing key, policy reference and, in signed policies, TPMT_SIGNATURE of the policy
+type policyAuthorize struct {
+	public    []byte
+	policyRef []byte
+	signature []byte
+	keyPublic tpm2.Public
+	keyName   []byte
+}
+
+func decodePolicyAuthorize(b []byte) (policyAuthorize, error) {
+	var public, policyRef tpmutil.U16Bytes
+	buf := bytes.NewBuffer(b)
+	if err := tpmutil.UnpackBuf(buf, &public, &policyRef); err != nil {
+		return policyAuthorize{}, fmt.Errorf("decoding PolicyAuthorize: %w", err)
+	}
+	pub, err := tpm2.DecodePublic(public)
+	if err != nil {
+		return policyAuthorize{}, fmt.Errorf("decoding PolicyAuthorize key: %w", err)
+	}
+	name, err := pub.Name()
+	if err != nil {
+		return policyAuthorize{}, err
+	}
+	nameBlob, err := name.Encode()
+	if err != nil {
+		return policyAuthorize{}, err
+	}
+	// encoded name is size prefixed TPM2B_NAME
+	return policyAuthorize{
+		public:    public,
+		policyRef: policyRef,
+		signature: buf.Bytes(),
+		keyPublic: pub,
+		keyName:   nameBlob[2:],
+	}, nil
+}
+
+// sameKey reports whether policies are authorized by the same key and policy reference
+func (p policyAuthorize) sameKey(other policyAuthorize) bool {
+	return bytes.Equal(p.public, other.public) && bytes.Equal(p.policyRef, other.policyRef)
+}
+
+// authorizingPublic returns public area of the key signing policies, it is loaded by
+// TPM2_LoadExternal to verify policy signatures. RSA keys use RSASSA and ECC keys ECDSA with SHA-256
+func authorizingPublic(key crypto.PublicKey) (tpm2.Public, error) {
+	public := tpm2.Public{
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagSign | tpm2.FlagUserWithAuth,
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		public.Type = tpm2.AlgRSA
+		public.RSAParameters = &tpm2.RSAParams{
+			Sign:       &tpm2.SigScheme{Alg: tpm2.AlgRSASSA, Hash: tpm2.AlgSHA256},
+			KeyBits:    uint16(key.N.BitLen()),
+			ModulusRaw: key.N.Bytes(),
+		}
+		if key.E != 65537 {
+			public.RSAParameters.ExponentRaw = uint32(key.E)
+		}
+	case *ecdsa.PublicKey:
+		var curve tpm2.EllipticCurve
+		switch key.Curve {
+		case elliptic.P256():
+			curve = tpm2.CurveNISTP256
+		case elliptic.P384():
+			curve = tpm2.CurveNISTP384
+		default:
+			return tpm2.Public{}, fmt.Errorf("unsupported authorizing key curve %s", key.Curve.Params().Name)
+		}
+		public.Type = tpm2.AlgECC
+		public.ECCParameters = &tpm2.ECCParams{
+			Sign:    &tpm2.SigScheme{Alg: tpm2.AlgECDSA, Hash: tpm2.AlgSHA256},
+			CurveID: curve,
+			KDF:     &tpm2.KDFScheme{Alg: tpm2.AlgNull},
+			Point:   tpm2.ECPoint{XRaw: eccBytes(key.Curve, key.X), YRaw: eccBytes(key.Curve, key.Y)},
+		}
+	default:
+		return tpm2.Public{}, fmt.Errorf("%w %T", ErrUnsupportedKey, key)
+	}
+	return public, nil
+}
+
+// authorizePolicy returns PolicyAuthorize command of objects which accept policies signed by key
+func authorizePolicy(key crypto.PublicKey, policyRef []byte) (TSSPolicy, error) {
+	public, err := authorizingPublic(key)
+	if err != nil {
+		return TSSPolicy{}, err
+	}
+	publicBlob, err := public.Encode()
+	if err != nil {
+		return TSSPolicy{}, err
+	}
+	params, err := tpmutil.Pack(tpmutil.U16Bytes(publicBlob), tpmutil.U16Bytes(policyRef))
+	if err != nil {
+		return TSSPolicy{}, err
+	}
+	return TSSPolicy{CommandCode: CmdPolicyAuthorize, CommandPolicy: params}, nil
+}
+
+// PCRPolicy builds TSS policy approving given values of selected PCRs, it is used to sign
+// policies offline by SignPolicy. Values must contain all selected PCRs
+func PCRPolicy(sel tpm2.PCRSelection, values map[int][]byte) ([]TSSPolicy, error) {
+	if sel.Hash == 0 {
+		sel.Hash = tpm2.AlgSHA256
+	}
+	if len(sel.PCRs) == 0 {
+		return nil, fmt.Errorf("PCR selection is empty")
+	}
+	bankHash, err := sel.Hash.Hash()
+	if err != nil {
+		return nil, fmt.Errorf("unsupported PCR bank %v", sel.Hash)
+	}
+	for _, pcr := range sel.PCRs {
+		if v, ok := values[pcr]; !ok || len(v) != bankHash.Size() {
+			return nil, fmt.Errorf("PCR %d requires %d bytes %v value", pcr, bankHash.Size(), sel.Hash)
+		}
+	}
+	params, err := policyPCRParams(sel, values)
+	if err != nil {
+		return nil, err
+	}
+	return []TSSPolicy{{CommandCode: tpm2.CmdPolicyPCR, CommandPolicy: params}}, nil
+}
+
+// computePolicyDigest computes SHA-256 policy digest of TSS policy commands in software,
+// like policy session of TPM does
+func computePolicyDigest(policy []TSSPolicy) ([]byte, error) {
+	digest := make([]byte, sha256.Size)
+	extend := func(parts ...[]byte) {
+		h := sha256.New()
+		h.Write(digest)
+		for _, p := range parts {
+			h.Write(p)
+		}
+		digest = h.Sum(nil)
+	}
+	for _, p := range policy {
+		cc, err := tpmutil.Pack(p.CommandCode)
+		if err != nil {
+			return nil, err
+		}
+		switch p.CommandCode {
+		case tpm2.CmdPolicyPCR:
+			var pcrDigest tpmutil.U16Bytes
+			buf := bytes.NewBuffer(p.CommandPolicy)
+			if err = tpmutil.UnpackBuf(buf, &pcrDigest); err != nil {
+				return nil, fmt.Errorf("decoding PolicyPCR: %w", err)
+			}
+			extend(cc, buf.Bytes(), pcrDigest)
+		case tpm2.CmdPolicyPassword:
+			// PolicyPassword extends policy digest like PolicyAuthValue
+			authValue, err := tpmutil.Pack(cmdPolicyAuthValue)
+			if err != nil {
+				return nil, err
+			}
+			extend(authValue)
+		case tpm2.CmdPolicyCommandCode:
+			extend(cc, p.CommandPolicy)
+		case CmdPolicyAuthorize:
+			auth, err := decodePolicyAuthorize(p.CommandPolicy)
+			if err != nil {
+				return nil, err
+			}
+			digest = make([]byte, sha256.Size)
+			extend(cc, auth.keyName)
+			extend(auth.policyRef)
+		default:
+			return nil, fmt.Errorf("unsupported policy command 0x%x", uint32(p.CommandCode))
+		}
+	}
+	return digest, nil
+}
+
+// SignPolicy signs approved policy by authorizing key, objects created with the public key as
+// AuthorizeKey accept it in place of their own policy. Approved policy is usually built by
+// PCRPolicy, returned policy can be stored in TSS AuthPolicy or in policy file by EncodePEM
+func SignPolicy(signer crypto.Signer, name string, policy []TSSPolicy, policyRef []byte) (TSSAuthPolicy, error) {
+	if len(policy) == 0 {
+		return TSSAuthPolicy{}, fmt.Errorf("approved policy is empty")
+	}
+	for _, p := range policy {
+		if !policyCommands[p.CommandCode] {
+			return TSSAuthPolicy{}, fmt.Errorf("unsupported approved policy command 0x%x", uint32(p.CommandCode))
+		}
+	}
+	approved, err := computePolicyDigest(policy)
+	if err != nil {
+		return TSSAuthPolicy{}, err
+	}
+	authorize, err := authorizePolicy(signer.Public(), policyRef)
+	if err != nil {
+		return TSSAuthPolicy{}, err
+	}
+	aHash := sha256.Sum256(append(approved, policyRef...))
+	sig, err := signer.Sign(rand.Reader, aHash[:], crypto.SHA256)
+	if err != nil {
+		return TSSAuthPolicy{}, fmt.Errorf("sign policy error: %w", err)
+	}
+	var signature []byte
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		signature, err = tpmutil.Pack(tpm2.AlgRSASSA, tpm2.AlgSHA256, tpmutil.U16Bytes(sig))
+	case *ecdsa.PublicKey:
+		var ecdsaSig ecdsaSignature
+		if _, err = asn1.Unmarshal(sig, &ecdsaSig); err != nil {
+			return TSSAuthPolicy{}, fmt.Errorf("decoding ECDSA signature: %w", err)
+		}
+		signature, err = tpmutil.Pack(tpm2.AlgECDSA, tpm2.AlgSHA256,
+			tpmutil.U16Bytes(ecdsaSig.R.Bytes()), tpmutil.U16Bytes(ecdsaSig.S.Bytes()))
+	}
+	if err != nil {
+		return TSSAuthPolicy{}, err
+	}
+	authorize.CommandPolicy = append(authorize.CommandPolicy, signature...)
+	signed := append(append([]TSSPolicy(nil), policy...), authorize)
+	return TSSAuthPolicy{Name: name, Policy: signed}, nil
+}
+
+// EncodePEM encodes signed policy into TSS2 AUTH POLICY pem block, policy files
+// are concatenations of such blocks
+func (p TSSAuthPolicy) EncodePEM() ([]byte, error) {
+	b, err := asn1.Marshal(tpmAuthPolicy{Name: p.Name, Policy: toASN1Policy(p.Policy)})
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: authPolicyPEMType, Bytes: b}), nil
+}
+
+// ParseAuthPolicies parses signed policies from TSS2 AUTH POLICY pem blocks, other blocks are skipped
+func ParseAuthPolicies(b []byte) ([]TSSAuthPolicy, error) {
+	var policies []TSSAuthPolicy
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			return policies, nil
+		}
+		if block.Type != authPolicyPEMType {
+			continue
+		}
+		var p tpmAuthPolicy
+		rest, err := asn1.Unmarshal(block.Bytes, &p)
+		if err != nil {
+			return nil, fmt.Errorf("parse signed policy error: %w", err)
+		}
+		if len(rest) > 0 {
+			return nil, fmt.Errorf("unexpected signed policy block size")
+		}
+		policies = append(policies, TSSAuthPolicy{Name: p.Name, Policy: fromASN1Policy(p.Policy)})
+	}
+}
+
+// LoadAuthPolicies loads signed policies from policy file
+func LoadAuthPolicies(f string) ([]TSSAuthPolicy, error) {
+	b, err := os.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+	return ParseAuthPolicies(b)
+}
+
+// ParsePublicKeyPEM parses RSA or ECDSA public key from PUBLIC KEY, RSA PUBLIC KEY
+// or CERTIFICATE PEM block
+func ParsePublicKeyPEM(b []byte) (crypto.PublicKey, error) {
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			return nil, fmt.Errorf("no public key PEM block found")
+		}
+		var (
+			key interface{}
+			err error
+		)
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse %s error: %w", block.Type, err)
+		}
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			return key, nil
+		case *ecdsa.PublicKey:
+			return key, nil
+		}
+		return nil, fmt.Errorf("%w %T", ErrUnsupportedKey, key)
+	}
+}
+
+// authPolicies returns signed policies of TSS and its AuthPolicyFile
+func (msg *TSS) authPolicies() ([]TSSAuthPolicy, error) {
+	policies := msg.AuthPolicy
+	if msg.AuthPolicyFile != "" {
+		filePolicies, err := LoadAuthPolicies(msg.AuthPolicyFile)
+		if err != nil {
+			return nil, fmt.Errorf("signed policy file error: %w", err)
+		}
+		policies = append(append([]TSSAuthPolicy(nil), policies...), filePolicies...)
+	}
+	return policies, nil
+}
+
+// runAuthorizedPolicy satisfies PolicyAuthorize command of TSS policy in policy session.
+// Signed policies of the authorizing key are tried in order, the first one whose commands
+// succeed is verified by the TPM and authorized. ErrNoSignedPolicy is returned when TSS has
+// no signed policies, ErrInvalidPolicySignature when policies matching PCR values have invalid
+// signatures and ErrPCRMismatch when none of them matches
+func (msg *TSS) runAuthorizedPolicy(rw io.ReadWriter, session tpmutil.Handle, p TSSPolicy) error {
+	authorize, err := decodePolicyAuthorize(p.CommandPolicy)
+	if err != nil {
+		return err
+	}
+	policies, err := msg.authPolicies()
+	if err != nil {
+		return err
+	}
+	if len(policies) == 0 {
+		return fmt.Errorf("%w: sign policy of PCR values by SignPolicy or tpm-policy-sign and set AuthPolicy or AuthPolicyFile", ErrNoSignedPolicy)
+	}
+	var (
+		keyHandle tpmutil.Handle
+		keyName   []byte
+		tried     int
+		badSigs   int
+		sigErr    error
+	)
+	defer func() {
+		if keyHandle != 0 {
+			_ = tpm2.FlushContext(rw, keyHandle)
+		}
+	}()
+	for _, signed := range policies {
+		n := len(signed.Policy)
+		if n < 2 || signed.Policy[n-1].CommandCode != CmdPolicyAuthorize {
+			msg.log().Debug("skipping policy without PolicyAuthorize", "name", signed.Name)
+			continue
+		}
+		signedAuth, err := decodePolicyAuthorize(signed.Policy[n-1].CommandPolicy)
+		if err != nil || !signedAuth.sameKey(authorize) || len(signedAuth.signature) == 0 {
+			msg.log().Debug("skipping policy signed by other key", "name", signed.Name)
+			continue
+		}
+		if tried > 0 {
+			if _, err = runCommand(rw, cmdPolicyRestart, []tpmutil.Handle{session}, nil); err != nil {
+				return fmt.Errorf("policy restart error: %w", rcError(err))
+			}
+		}
+		tried++
+		if err = runPolicy(rw, session, signed.Policy[:n-1]); err != nil {
+			if errors.Is(err, ErrPCRMismatch) {
+				msg.log().Debug("signed policy doesn't match PCR values", "name", signed.Name)
+				continue
+			}
+			return fmt.Errorf("signed policy %q: %w", signed.Name, err)
+		}
+		approved, err := tpm2.PolicyGetDigest(rw, session)
+		if err != nil {
+			return fmt.Errorf("policy digest error: %w", rcError(err))
+		}
+		if keyHandle == 0 {
+			keyHandle, keyName, err = tpm2.LoadExternal(rw, authorize.keyPublic, tpm2.Private{}, tpm2.HandleOwner)
+			if err != nil {
+				return fmt.Errorf("load authorizing key error: %w", rcError(err))
+			}
+		}
+		aHash := sha256.Sum256(append(approved, authorize.policyRef...))
+		ticket, err := runCommand(rw, cmdVerifySignature, []tpmutil.Handle{keyHandle}, nil,
+			tpmutil.U16Bytes(aHash[:]), tpmutil.RawBytes(signedAuth.signature))
+		if err != nil {
+			badSigs++
+			sigErr = fmt.Errorf("signed policy %q: %w", signed.Name, rcError(err))
+			msg.log().Warn("signed policy has invalid signature", "name", signed.Name, "error", rcError(err))
+			continue
+		}
+		_, err = runCommand(rw, CmdPolicyAuthorize, []tpmutil.Handle{session}, nil, tpmutil.U16Bytes(approved),
+			tpmutil.U16Bytes(authorize.policyRef), tpmutil.U16Bytes(keyName), tpmutil.RawBytes(ticket))
+		if err != nil {
+			return fmt.Errorf("policy authorize error: %w", rcError(err))
+		}
+		msg.log().Debug("signed policy authorized", "name", signed.Name)
+		return nil
+	}
+	if badSigs > 0 {
+		return newError(ErrInvalidPolicySignature, fmt.Errorf("%d signed policies matching PCR values are rejected, last one: %w", badSigs, sigErr))
+	}
+	return newError(ErrPCRMismatch, fmt.Errorf("none of %d signed policies is satisfied", tried))
+}
@@ -0,0 +1,237 @@
+package tpm_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+
+	"github.com/shuvava/tpm/pkg/tpm"
+	"github.com/shuvava/tpm/pkg/tpm/tpmtest"
+)
+
+// signPCRPolicy signs policy approving current values of selected PCRs
+func signPCRPolicy(t *testing.T, sim *tpmtest.Simulator, signer crypto.Signer, pcrs, name string, policyRef []byte) tpm.TSSAuthPolicy {
+	t.Helper()
+	sel, err := tpm.ParsePCRSelection(pcrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := tpm2.ReadPCRs(sim.RW(), sel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := tpm.PCRPolicy(sel, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := tpm.SignPolicy(signer, name, policy, policyRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// writePolicies writes signed policies into policy file
+func writePolicies(t *testing.T, file string, policies ...tpm.TSSAuthPolicy) {
+	t.Helper()
+	var b []byte
+	for _, p := range policies {
+		block, err := p.EncodePEM()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b = append(b, block...)
+	}
+	if err := os.WriteFile(file, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignedPolicyKey(t *testing.T) {
+	sim := tpmtest.New(t)
+	sum := sha256.Sum256([]byte("data"))
+	otherKey := testECCKey(t, elliptic.P256())
+
+	tests := []struct {
+		name    string
+		signer  crypto.Signer
+		keyAuth string
+	}{
+		{"ECDSA authorizing key with auth", testECCKey(t, elliptic.P256()), "secret"},
+		{"RSA authorizing key", testRSAKey(t), ""},
+		{"P-384 authorizing key", testECCKey(t, elliptic.P384()), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tss, err := tpm.CreateKey(sim.RW(), tpm.KeyOptions{Algorithm: tpm2.AlgECC, ObjectOptions: tpm.ObjectOptions{AuthorizeKey: tt.signer.Public(), KeyAuth: tt.keyAuth}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			pub, err := tss.DecodePublic()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pub.Attributes&tpm2.FlagUserWithAuth != 0 || len(pub.AuthPolicy) != sha256.Size || tss.Policy[0].CommandCode != tpm.CmdPolicyAuthorize {
+				t.Errorf("key is not bound to authorized policy: %+v", pub)
+			}
+
+			// policy embedded in TSS is serialized with the key
+			tss.AuthPolicy = []tpm.TSSAuthPolicy{signPCRPolicy(t, sim, tt.signer, "sha256:0,16", "boot", nil)}
+			tss, err = tpm.LoadFromFile(sim.TSSFile(tss, "key.tss"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tss.AuthPolicy) != 1 || tss.AuthPolicy[0].Name != "boot" {
+				t.Fatalf("unexpected signed policies %+v", tss.AuthPolicy)
+			}
+			conf := &tpm.TPM{Tss: tss, Opener: sim.Open}
+			if tt.keyAuth != "" {
+				conf.KeyAuth = tpm.StaticAuth(tt.keyAuth)
+			}
+			k := newTPM(t, conf)
+			sig, err := k.Sign(rand.Reader, sum[:], crypto.SHA256)
+			if err != nil {
+				t.Fatal(err)
+			}
+			verify(t, k.Public(), sum[:], sig, crypto.SHA256)
+			if tt.keyAuth != "" {
+				wrong := newTPM(t, &tpm.TPM{Tss: tss, Opener: sim.Open, KeyAuth: tpm.StaticAuth("wrong")})
+				if _, err = wrong.Sign(rand.Reader, sum[:], crypto.SHA256); !errors.Is(err, tpm.ErrAuthFailed) {
+					t.Errorf("expected ErrAuthFailed, got %v", err)
+				}
+			}
+
+			// firmware update changes PCR values until new policy is signed
+			extendPCR(t, sim, 16)
+			if _, err = k.Sign(rand.Reader, sum[:], crypto.SHA256); !errors.Is(err, tpm.ErrPCRMismatch) {
+				t.Errorf("expected ErrPCRMismatch, got %v", err)
+			}
+			// policies signed by other key are skipped
+			tss.AuthPolicyFile = filepath.Join(t.TempDir(), "key.tss.policy")
+			writePolicies(t, tss.AuthPolicyFile,
+				signPCRPolicy(t, sim, otherKey, "sha256:0,16", "forged", nil),
+				signPCRPolicy(t, sim, tt.signer, "sha256:0,16", "update", nil))
+			if sig, err = k.Sign(rand.Reader, sum[:], crypto.SHA256); err != nil {
+				t.Fatal(err)
+			}
+			verify(t, k.Public(), sum[:], sig, crypto.SHA256)
+			if len(sim.Handles(tpm2.HandleTypeTransient)) != 0 || len(sim.Handles(tpm2.HandleTypePolicySession)) != 0 {
+				t.Error("Sign left handles")
+			}
+		})
+	}
+}
+
+func TestSignedPolicySeal(t *testing.T) {
+	sim := tpmtest.New(t)
+	signer := testRSAKey(t)
+	secret := []byte("secret")
+	policyRef := []byte("disk")
+	tss, err := tpm.Seal(sim.RW(), secret, tpm.SealOptions{ObjectOptions: tpm.ObjectOptions{AuthorizeKey: signer.Public(), PolicyRef: policyRef}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tpm.Unseal(sim.RW(), tss, nil); !errors.Is(err, tpm.ErrNoSignedPolicy) {
+		t.Errorf("expected ErrNoSignedPolicy without signed policies, got %v", err)
+	}
+
+	// signatures are bound to policy reference
+	tss.AuthPolicy = []tpm.TSSAuthPolicy{signPCRPolicy(t, sim, signer, "sha1:7", "other", []byte("other"))}
+	if _, err = tpm.Unseal(sim.RW(), tss, nil); !errors.Is(err, tpm.ErrPCRMismatch) {
+		t.Errorf("expected ErrPCRMismatch for other policy reference, got %v", err)
+	}
+	// tampered signature isn't reported as PCR mismatch
+	tampered := signPCRPolicy(t, sim, signer, "sha1:7", "tampered", policyRef)
+	authorize := &tampered.Policy[len(tampered.Policy)-1]
+	authorize.CommandPolicy = append([]byte(nil), authorize.CommandPolicy...)
+	authorize.CommandPolicy[len(authorize.CommandPolicy)-1] ^= 0xff
+	tss.AuthPolicy = []tpm.TSSAuthPolicy{tampered}
+	if _, err = tpm.Unseal(sim.RW(), tss, nil); !errors.Is(err, tpm.ErrInvalidPolicySignature) {
+		t.Errorf("expected ErrInvalidPolicySignature for tampered signature, got %v", err)
+	}
+	tss.AuthPolicy = append(tss.AuthPolicy, signPCRPolicy(t, sim, signer, "sha1:7", "boot", policyRef))
+	data, err := tpm.Unseal(sim.RW(), tss, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, secret) {
+		t.Errorf("unsealed %q, want %q", data, secret)
+	}
+
+	tss.AuthPolicyFile = filepath.Join(t.TempDir(), "missing.policy")
+	if _, err = tpm.Unseal(sim.RW(), tss, nil); err == nil {
+		t.Error("expected error for missing policy file")
+	}
+	if len(sim.Handles(tpm2.HandleTypeTransient)) != 0 || len(sim.Handles(tpm2.HandleTypePolicySession)) != 0 {
+		t.Error("Unseal left handles")
+	}
+
+	sel, err := tpm.ParsePCRSelection("7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tpm.Seal(sim.RW(), secret, tpm.SealOptions{ObjectOptions: tpm.ObjectOptions{AuthorizeKey: signer.Public(), PCRs: sel}}); err == nil {
+		t.Error("expected error for authorized policy combined with PCRs")
+	}
+	if _, err = tpm.SignPolicy(signer, "", []tpm.TSSPolicy{{CommandCode: tpm2.CmdPolicySecret}}, nil); err == nil {
+		t.Error("expected error for unsupported approved policy command")
+	}
+	if _, err = tpm.PCRPolicy(sel, map[int][]byte{7: {1}}); err == nil {
+		t.Error("expected error for invalid PCR value size")
+	}
+}
+
+func TestParseAuthPolicies(t *testing.T) {
+	signer := testECCKey(t, elliptic.P256())
+	policy, err := tpm.PCRPolicy(tpm2.PCRSelection{PCRs: []int{7}}, map[int][]byte{7: make([]byte, sha256.Size)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := tpm.SignPolicy(signer, "boot", policy, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signed.Policy) != 2 || signed.Policy[1].CommandCode != tpm.CmdPolicyAuthorize {
+		t.Fatalf("unexpected signed policy %+v", signed)
+	}
+	block, err := signed.EncodePEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte{1}})
+	policies, err := tpm.ParseAuthPolicies(append(append(other, block...), block...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 2 || policies[1].Name != "boot" || !bytes.Equal(policies[1].Policy[1].CommandPolicy, signed.Policy[1].CommandPolicy) {
+		t.Errorf("unexpected policies %+v", policies)
+	}
+	if _, err = tpm.ParseAuthPolicies(pem.EncodeToMemory(&pem.Block{Type: "TSS2 AUTH POLICY", Bytes: []byte{1}})); err == nil {
+		t.Error("expected error for invalid policy block")
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := tpm.ParsePublicKeyPEM(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !signer.PublicKey.Equal(pub) {
+		t.Error("parsed public key doesn't match")
+	}
+	if _, err = tpm.ParsePublicKeyPEM(other); err == nil {
+		t.Error("expected error for invalid certificate")
+	}
+}
@@ -0,0 +1,140 @@
+package tpm
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"time"
+)
+
+// TLSCertificate returns TLS certificate with TPM private key, errors are reported to Logger
+// and empty certificate is returned. Use Certificate to get the error
+func (t TPM) TLSCertificate() tls.Certificate {
+	cert, err := t.Certificate()
+	if err != nil {
+		t.log().Error("unable to load TLS certificate", "file", t.PublicCertFile, "error", err)
+		return tls.Certificate{}
+	}
+	return cert
+}
+
+// Certificate returns TLS certificate chain from PublicCertFile with TPM private key.
+// The file contains pem encoded leaf certificate followed by intermediate certificates,
+// public key of the leaf must match TPM key. Signature schemes of the certificate are limited
+// to ones allowed by the key public area
+func (t TPM) Certificate() (tls.Certificate, error) {
+	if t.PublicCertFile == "" {
+		return tls.Certificate{}, ErrNoCertificate
+	}
+
+	pubPEM, err := os.ReadFile(t.PublicCertFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("unable to read certificate: %w", err)
+	}
+	return t.parseCertificate(pubPEM)
+}
+
+// parseCertificate parses pem encoded certificate chain and verifies that leaf matches TPM key
+func (t TPM) parseCertificate(pubPEM []byte) (tls.Certificate, error) {
+	var chain [][]byte
+	for {
+		var block *pem.Block
+		block, pubPEM = pem.Decode(pubPEM)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			chain = append(chain, block.Bytes)
+		}
+	}
+	if len(chain) == 0 {
+		return tls.Certificate{}, fmt.Errorf("failed to parse PEM block containing the certificate")
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	for i, der := range chain[1:] {
+		if _, err = x509.ParseCertificate(der); err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to parse intermediate certificate %d: %w", i+1, err)
+		}
+	}
+
+	pub, keyPub, err := t.keyPublic()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if key, ok := leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !key.Equal(pub) {
+		return tls.Certificate{}, fmt.Errorf("%w: %s", ErrCertificateMismatch, leaf.Subject)
+	}
+
+	var privKey crypto.PrivateKey
+	privKey = t
+	return tls.Certificate{
+		PrivateKey:                   privKey,
+		Leaf:                         leaf,
+		Certificate:                  chain,
+		SupportedSignatureAlgorithms: signatureSchemes(keyPub, pub),
+	}, nil
+}
+
+// GetClientCertificate can be used as tls.Config.GetClientCertificate, see GetCertificate
+func (t TPM) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return t.reloadCertificate()
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate. PublicCertFile is read again
+// when its modification time or size changes, so renewed certificate is used without restart.
+// When renewed file can't be loaded the previous certificate is used and error is reported to Logger
+func (t TPM) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return t.reloadCertificate()
+}
+
+// fileStamp identifies version of a file
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// reloadCertificate returns cached certificate or loads it when PublicCertFile changed
+func (t TPM) reloadCertificate() (*tls.Certificate, error) {
+	s := t.session
+	if s == nil {
+		return nil, ErrNotInitialized
+	}
+	if t.PublicCertFile == "" {
+		return nil, ErrNoCertificate
+	}
+	s.certMu.Lock()
+	defer s.certMu.Unlock()
+
+	fi, err := os.Stat(t.PublicCertFile)
+	if err != nil {
+		if s.cert != nil {
+			t.log().Warn("unable to check TLS certificate, using loaded one", "file", t.PublicCertFile, "error", err)
+			return s.cert, nil
+		}
+		return nil, fmt.Errorf("unable to read certificate: %w", err)
+	}
+	stamp := fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+	if s.cert != nil && stamp == s.certStamp {
+		return s.cert, nil
+	}
+
+	cert, err := t.Certificate()
+	if err != nil {
+		if s.cert != nil {
+			t.log().Warn("unable to reload TLS certificate, using loaded one", "file", t.PublicCertFile, "error", err)
+			return s.cert, nil
+		}
+		t.log().Error("unable to load TLS certificate", "file", t.PublicCertFile, "error", err)
+		return nil, err
+	}
+	t.log().Info("TLS certificate loaded", "file", t.PublicCertFile, "subject", cert.Leaf.Subject.String(),
+		"notAfter", cert.Leaf.NotAfter, "chain", len(cert.Certificate))
+	s.cert, s.certStamp = &cert, stamp
+	return s.cert, nil
+}
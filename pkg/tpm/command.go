@@ -0,0 +1,62 @@
+package tpm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// runCommand executes TPM command which is not provided by go-tpm with authorization sessions,
+// response parameter area is returned. Error response codes are decoded into go-tpm errors
+func runCommand(rw io.ReadWriter, cmd tpmutil.Command, handles []tpmutil.Handle, auths []tpm2.AuthCommand, params ...interface{}) ([]byte, error) {
+	tag := tpmutil.Tag(tpm2.TagNoSessions)
+	in := make([]interface{}, 0, len(handles)+len(params)+1)
+	for _, h := range handles {
+		in = append(in, h)
+	}
+	if len(auths) > 0 {
+		tag = tpm2.TagSessions
+		area, err := authArea(auths)
+		if err != nil {
+			return nil, err
+		}
+		in = append(in, tpmutil.RawBytes(area))
+	}
+	in = append(in, params...)
+	resp, code, err := tpmutil.RunCommand(rw, tag, cmd, in...)
+	if err != nil {
+		return nil, err
+	}
+	if code != tpmutil.RCSuccess {
+		return nil, responseError(code)
+	}
+	if tag != tpm2.TagSessions {
+		return resp, nil
+	}
+	// response of command with sessions starts with parameter area size
+	buf := bytes.NewBuffer(resp)
+	var size uint32
+	if err = tpmutil.UnpackBuf(buf, &size); err != nil {
+		return nil, fmt.Errorf("decoding parameter size: %w", err)
+	}
+	if int(size) > buf.Len() {
+		return nil, fmt.Errorf("parameter size %d exceeds response size %d", size, buf.Len())
+	}
+	return buf.Next(int(size)), nil
+}
+
+// authArea encodes authorization area of command
+func authArea(auths []tpm2.AuthCommand) ([]byte, error) {
+	var area []byte
+	for _, auth := range auths {
+		b, err := tpmutil.Pack(auth.Session, tpmutil.U16Bytes(auth.Nonce), auth.Attributes, tpmutil.U16Bytes(auth.Auth))
+		if err != nil {
+			return nil, err
+		}
+		area = append(area, b...)
+	}
+	return tpmutil.Pack(uint32(len(area)), tpmutil.RawBytes(area))
+}
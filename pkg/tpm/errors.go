@@ -0,0 +1,187 @@
+package tpm
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// Sentinel errors of TPM operations, returned errors match them with errors.Is
+var (
+	// ErrNotInitialized is returned when TPM is used without NewTPMCrypto
+	ErrNotInitialized = errors.New("tpm: TPM is not initialized, use NewTPMCrypto")
+	// ErrNoKey is returned when none of Tss, TpmHandleFile or TpmHandle is specified
+	ErrNoKey = errors.New("tpm: key is not specified")
+	// ErrDeviceOpen is returned when TPM device can't be opened
+	ErrDeviceOpen = errors.New("tpm: unable to open TPM device")
+	// ErrKeyLoad is returned when key can't be loaded into TPM
+	ErrKeyLoad = errors.New("tpm: unable to load key")
+	// ErrAuthRequired is returned when key requires authorization value but KeyAuth is not specified
+	ErrAuthRequired = errors.New("tpm: key requires authorization value")
+	// ErrAuthFailed is returned when TPM rejects authorization value
+	ErrAuthFailed = errors.New("tpm: authorization failed")
+	// ErrLockout is returned when TPM is in dictionary attack lockout mode
+	ErrLockout = errors.New("tpm: TPM is in dictionary attack lockout mode")
+	// ErrUnsupportedKey is returned for keys other than RSA and ECC
+	ErrUnsupportedKey = errors.New("tpm: unsupported key type")
+	// ErrNoCertificate is returned when PublicCertFile is not specified
+	ErrNoCertificate = errors.New("tpm: certificate is not specified")
+	// ErrPCRMismatch is returned when PCR values don't match PCR policy of the key or sealed data
+	ErrPCRMismatch = errors.New("tpm: PCR values don't match policy")
+	// ErrNoSignedPolicy is returned when key or sealed data created with AuthorizeKey has no signed policies
+	ErrNoSignedPolicy = errors.New("tpm: no signed policies")
+	// ErrInvalidPolicySignature is returned when TPM rejects signatures of all signed policies matching PCR values
+	ErrInvalidPolicySignature = errors.New("tpm: invalid signature of signed policy")
+	// ErrCertificateMismatch is returned when certificate public key doesn't match TPM key
+	ErrCertificateMismatch = errors.New("tpm: certificate public key doesn't match TPM key")
+)
+
+// Error is error of TPM operation. It matches its Kind sentinel error with errors.Is
+// and wraps underlying error, TPM response codes are wrapped as *RCError
+type Error struct {
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v: %v", e.Kind, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return e.Kind == target
+}
+
+// newError wraps err as error of kind, TPM response code errors are decoded into *RCError
+func newError(kind error, err error) error {
+	return &Error{Kind: kind, Err: rcError(err)}
+}
+
+// RCError is TPM response code error decoded to its TPM 2.0 specification name.
+// Authorization and lockout codes match ErrAuthFailed and ErrLockout with errors.Is
+type RCError struct {
+	// Code is complete TPM response code
+	Code tpmutil.ResponseCode
+	// Name is TPM_RC_* name of response code without format and index bits
+	Name string
+	// Err is go-tpm error of the response code
+	Err error
+}
+
+func (e *RCError) Error() string {
+	return fmt.Sprintf("%s (0x%x): %v", e.Name, uint32(e.Code), e.Err)
+}
+
+func (e *RCError) Unwrap() error {
+	return e.Err
+}
+
+func (e *RCError) Is(target error) bool {
+	switch target {
+	case ErrAuthFailed:
+		return e.Name == "TPM_RC_AUTH_FAIL" || e.Name == "TPM_RC_BAD_AUTH"
+	case ErrLockout:
+		return e.Name == "TPM_RC_LOCKOUT"
+	}
+	return false
+}
+
+// rcError decodes go-tpm response code error found in err chain into *RCError,
+// other errors are returned as is
+func rcError(err error) error {
+	var rcErr *RCError
+	if err == nil || errors.As(err, &rcErr) {
+		return err
+	}
+	var (
+		fmt0Err    tpm2.Error
+		warnErr    tpm2.Warning
+		paramErr   tpm2.ParameterError
+		handleErr  tpm2.HandleError
+		sessionErr tpm2.SessionError
+		vendorErr  tpm2.VendorError
+	)
+	switch {
+	case errors.As(err, &fmt0Err):
+		return &RCError{Code: 0x100 | tpmutil.ResponseCode(fmt0Err.Code), Name: rcName(fmt0Names, uint32(fmt0Err.Code)), Err: err}
+	case errors.As(err, &warnErr):
+		return &RCError{Code: 0x900 | tpmutil.ResponseCode(warnErr.Code), Name: rcName(warnNames, uint32(warnErr.Code)), Err: err}
+	case errors.As(err, &paramErr):
+		code := 0xC0 | tpmutil.ResponseCode(paramErr.Code) | tpmutil.ResponseCode(paramErr.Parameter)<<8
+		return &RCError{Code: code, Name: rcName(fmt1Names, uint32(paramErr.Code)), Err: err}
+	case errors.As(err, &handleErr):
+		code := 0x80 | tpmutil.ResponseCode(handleErr.Code) | tpmutil.ResponseCode(handleErr.Handle)<<8
+		return &RCError{Code: code, Name: rcName(fmt1Names, uint32(handleErr.Code)), Err: err}
+	case errors.As(err, &sessionErr):
+		code := 0x880 | tpmutil.ResponseCode(sessionErr.Code) | tpmutil.ResponseCode(sessionErr.Session)<<8
+		return &RCError{Code: code, Name: rcName(fmt1Names, uint32(sessionErr.Code)), Err: err}
+	case errors.As(err, &vendorErr):
+		return &RCError{Code: tpmutil.ResponseCode(vendorErr.Code), Name: "TPM_RC_VENDOR", Err: err}
+	}
+	return err
+}
+
+// responseError decodes TPM response code of raw command into go-tpm error, like go-tpm does for its commands
+func responseError(code tpmutil.ResponseCode) error {
+	switch {
+	case code&0x180 == 0:
+		return fmt.Errorf("response status 0x%x", uint32(code))
+	case code&0x80 == 0 && code&0x400 != 0:
+		return tpm2.VendorError{Code: uint32(code)}
+	case code&0x80 == 0 && code&0x800 != 0:
+		return tpm2.Warning{Code: tpm2.RCWarn(code & 0x7f)}
+	case code&0x80 == 0:
+		return tpm2.Error{Code: tpm2.RCFmt0(code & 0x7f)}
+	case code&0x40 != 0:
+		return tpm2.ParameterError{Code: tpm2.RCFmt1(code & 0x3f), Parameter: tpm2.RCIndex((code & 0xf00) >> 8)}
+	case code&0x800 == 0:
+		return tpm2.HandleError{Code: tpm2.RCFmt1(code & 0x3f), Handle: tpm2.RCIndex((code & 0x700) >> 8)}
+	}
+	return tpm2.SessionError{Code: tpm2.RCFmt1(code & 0x3f), Session: tpm2.RCIndex((code & 0x700) >> 8)}
+}
+
+func rcName(names map[uint32]string, code uint32) string {
+	if name, ok := names[code]; ok {
+		return "TPM_RC_" + name
+	}
+	return fmt.Sprintf("TPM_RC_UNKNOWN_0x%x", code)
+}
+
+var (
+	// fmt0Names are names of format zero error codes (TPM_RC_VER1 offsets)
+	fmt0Names = map[uint32]string{
+		0x00: "INITIALIZE", 0x01: "FAILURE", 0x03: "SEQUENCE", 0x0B: "PRIVATE", 0x19: "HMAC",
+		0x20: "DISABLED", 0x21: "EXCLUSIVE", 0x24: "AUTH_TYPE", 0x25: "AUTH_MISSING", 0x26: "POLICY",
+		0x27: "PCR", 0x28: "PCR_CHANGED", 0x2D: "UPGRADE", 0x2E: "TOO_MANY_CONTEXTS",
+		0x2F: "AUTH_UNAVAILABLE", 0x30: "REBOOT", 0x31: "UNBALANCED", 0x42: "COMMAND_SIZE",
+		0x43: "COMMAND_CODE", 0x44: "AUTHSIZE", 0x45: "AUTH_CONTEXT", 0x46: "NV_RANGE", 0x47: "NV_SIZE",
+		0x48: "NV_LOCKED", 0x49: "NV_AUTHORIZATION", 0x4A: "NV_UNINITIALIZED", 0x4B: "NV_SPACE",
+		0x4C: "NV_DEFINED", 0x50: "BAD_CONTEXT", 0x51: "CPHASH", 0x52: "PARENT", 0x53: "NEEDS_TEST",
+		0x54: "NO_RESULT", 0x55: "SENSITIVE",
+	}
+	// fmt1Names are names of format one error codes (TPM_RC_FMT1 offsets)
+	fmt1Names = map[uint32]string{
+		0x01: "ASYMMETRIC", 0x02: "ATTRIBUTES", 0x03: "HASH", 0x04: "VALUE", 0x05: "HIERARCHY",
+		0x07: "KEY_SIZE", 0x08: "MGF", 0x09: "MODE", 0x0A: "TYPE", 0x0B: "HANDLE", 0x0C: "KDF",
+		0x0D: "RANGE", 0x0E: "AUTH_FAIL", 0x0F: "NONCE", 0x10: "PP", 0x12: "SCHEME", 0x15: "SIZE",
+		0x16: "SYMMETRIC", 0x17: "TAG", 0x18: "SELECTOR", 0x1A: "INSUFFICIENT", 0x1B: "SIGNATURE",
+		0x1C: "KEY", 0x1D: "POLICY_FAIL", 0x1F: "INTEGRITY", 0x20: "TICKET", 0x21: "RESERVED_BITS",
+		0x22: "BAD_AUTH", 0x23: "EXPIRED", 0x24: "POLICY_CC", 0x25: "BINDING", 0x26: "CURVE",
+		0x27: "ECC_POINT",
+	}
+	// warnNames are names of warning codes (TPM_RC_WARN offsets)
+	warnNames = map[uint32]string{
+		0x01: "CONTEXT_GAP", 0x02: "OBJECT_MEMORY", 0x03: "SESSION_MEMORY", 0x04: "MEMORY",
+		0x05: "SESSION_HANDLES", 0x06: "OBJECT_HANDLES", 0x07: "LOCALITY", 0x08: "YIELDED",
+		0x09: "CANCELED", 0x0A: "TESTING", 0x10: "REFERENCE_H0", 0x11: "REFERENCE_H1",
+		0x12: "REFERENCE_H2", 0x13: "REFERENCE_H3", 0x14: "REFERENCE_H4", 0x15: "REFERENCE_H5",
+		0x16: "REFERENCE_H6", 0x18: "REFERENCE_S0", 0x19: "REFERENCE_S1", 0x1A: "REFERENCE_S2",
+		0x1B: "REFERENCE_S3", 0x1C: "REFERENCE_S4", 0x1D: "REFERENCE_S5", 0x1E: "REFERENCE_S6",
+		0x20: "NV_RATE", 0x21: "LOCKOUT", 0x22: "RETRY", 0x23: "NV_UNAVAILABLE",
+	}
+)
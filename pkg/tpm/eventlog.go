@@ -0,0 +1,432 @@
+package tpm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// DefaultEventLogFile is binary event log of firmware measurements exported by Linux kernel
+const DefaultEventLogFile = "/sys/kernel/security/tpm0/binary_bios_measurements"
+
+// EventType is type of TCG PC Client event log event
+type EventType uint32
+
+// Event types of TCG PC Client Platform Firmware Profile
+const (
+	EvPrebootCert                EventType = 0x00000000
+	EvPostCode                   EventType = 0x00000001
+	EvNoAction                   EventType = 0x00000003
+	EvSeparator                  EventType = 0x00000004
+	EvAction                     EventType = 0x00000005
+	EvEventTag                   EventType = 0x00000006
+	EvSCRTMContents              EventType = 0x00000007
+	EvSCRTMVersion               EventType = 0x00000008
+	EvCPUMicrocode               EventType = 0x00000009
+	EvPlatformConfigFlags        EventType = 0x0000000A
+	EvTableOfDevices             EventType = 0x0000000B
+	EvCompactHash                EventType = 0x0000000C
+	EvIPL                        EventType = 0x0000000D
+	EvIPLPartitionData           EventType = 0x0000000E
+	EvNonhostCode                EventType = 0x0000000F
+	EvNonhostConfig              EventType = 0x00000010
+	EvNonhostInfo                EventType = 0x00000011
+	EvOmitBootDeviceEvents       EventType = 0x00000012
+	EvEFIVariableDriverConfig    EventType = 0x80000001
+	EvEFIVariableBoot            EventType = 0x80000002
+	EvEFIBootServicesApplication EventType = 0x80000003
+	EvEFIBootServicesDriver      EventType = 0x80000004
+	EvEFIRuntimeServicesDriver   EventType = 0x80000005
+	EvEFIGPTEvent                EventType = 0x80000006
+	EvEFIAction                  EventType = 0x80000007
+	EvEFIPlatformFirmwareBlob    EventType = 0x80000008
+	EvEFIHandoffTables           EventType = 0x80000009
+	EvEFIPlatformFirmwareBlob2   EventType = 0x8000000A
+	EvEFIHandoffTables2          EventType = 0x8000000B
+	EvEFIVariableBoot2           EventType = 0x8000000C
+	EvEFIVariableAuthority       EventType = 0x800000E0
+)
+
+var eventTypeNames = map[EventType]string{
+	EvPrebootCert:                "EV_PREBOOT_CERT",
+	EvPostCode:                   "EV_POST_CODE",
+	EvNoAction:                   "EV_NO_ACTION",
+	EvSeparator:                  "EV_SEPARATOR",
+	EvAction:                     "EV_ACTION",
+	EvEventTag:                   "EV_EVENT_TAG",
+	EvSCRTMContents:              "EV_S_CRTM_CONTENTS",
+	EvSCRTMVersion:               "EV_S_CRTM_VERSION",
+	EvCPUMicrocode:               "EV_CPU_MICROCODE",
+	EvPlatformConfigFlags:        "EV_PLATFORM_CONFIG_FLAGS",
+	EvTableOfDevices:             "EV_TABLE_OF_DEVICES",
+	EvCompactHash:                "EV_COMPACT_HASH",
+	EvIPL:                        "EV_IPL",
+	EvIPLPartitionData:           "EV_IPL_PARTITION_DATA",
+	EvNonhostCode:                "EV_NONHOST_CODE",
+	EvNonhostConfig:              "EV_NONHOST_CONFIG",
+	EvNonhostInfo:                "EV_NONHOST_INFO",
+	EvOmitBootDeviceEvents:       "EV_OMIT_BOOT_DEVICE_EVENTS",
+	EvEFIVariableDriverConfig:    "EV_EFI_VARIABLE_DRIVER_CONFIG",
+	EvEFIVariableBoot:            "EV_EFI_VARIABLE_BOOT",
+	EvEFIBootServicesApplication: "EV_EFI_BOOT_SERVICES_APPLICATION",
+	EvEFIBootServicesDriver:      "EV_EFI_BOOT_SERVICES_DRIVER",
+	EvEFIRuntimeServicesDriver:   "EV_EFI_RUNTIME_SERVICES_DRIVER",
+	EvEFIGPTEvent:                "EV_EFI_GPT_EVENT",
+	EvEFIAction:                  "EV_EFI_ACTION",
+	EvEFIPlatformFirmwareBlob:    "EV_EFI_PLATFORM_FIRMWARE_BLOB",
+	EvEFIHandoffTables:           "EV_EFI_HANDOFF_TABLES",
+	EvEFIPlatformFirmwareBlob2:   "EV_EFI_PLATFORM_FIRMWARE_BLOB2",
+	EvEFIHandoffTables2:          "EV_EFI_HANDOFF_TABLES2",
+	EvEFIVariableBoot2:           "EV_EFI_VARIABLE_BOOT2",
+	EvEFIVariableAuthority:       "EV_EFI_VARIABLE_AUTHORITY",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("EV_0x%08X", uint32(t))
+}
+
+// measuredDataEvents are event types whose digest is hash of the event data,
+// data of other events is description of measured object. Firmware differs in
+// what is measured for EFI variables, so they are not checked
+var measuredDataEvents = map[EventType]bool{
+	EvSeparator: true,
+	EvAction:    true,
+	EvEFIAction: true,
+}
+
+const (
+	// specIDEvent is signature of TCG_EfiSpecIDEvent starting crypto-agile event logs
+	specIDEvent = "Spec ID Event03\x00"
+	// startupLocalityEvent is signature of EV_NO_ACTION event with locality of TPM2_Startup,
+	// it sets initial value of PCR 0
+	startupLocalityEvent = "StartupLocality\x00"
+	// maxEventSize limits event data size of corrupted logs
+	maxEventSize = 1 << 24
+)
+
+// Event is measurement of event log
+type Event struct {
+	// Sequence is index of event in the log
+	Sequence int
+	PCR      int
+	Type     EventType
+	// Digests are measured digests of PCR banks
+	Digests map[tpm2.Algorithm][]byte
+	Data    []byte
+}
+
+// EventLog is parsed TCG PC Client binary event log
+type EventLog struct {
+	// CryptoAgile is set for TPM 2.0 logs with digests of several banks,
+	// legacy logs have only SHA-1 digests
+	CryptoAgile bool
+	// Banks are PCR banks measured by events in order of the log header
+	Banks  []tpm2.Algorithm
+	Events []Event
+}
+
+// Mismatch is event log event or PCR value which doesn't match
+type Mismatch struct {
+	Bank tpm2.Algorithm
+	PCR  int
+	// Event is event whose digest doesn't match its data, it is nil for PCR value mismatch
+	Event *Event
+	// Replayed is value of PCR computed from event log, Actual is PCR value of TPM
+	Replayed []byte
+	Actual   []byte
+}
+
+func (m Mismatch) String() string {
+	if m.Event != nil {
+		return fmt.Sprintf("event %d %v of PCR %d: %s digest doesn't match event data",
+			m.Event.Sequence, m.Event.Type, m.PCR, PCRBankName(m.Bank))
+	}
+	return fmt.Sprintf("%s PCR %d: replayed value %x doesn't match %x", PCRBankName(m.Bank), m.PCR, m.Replayed, m.Actual)
+}
+
+// LoadEventLog reads and parses binary event log file, DefaultEventLogFile is used when f is empty
+func LoadEventLog(f string) (*EventLog, error) {
+	if f == "" {
+		f = DefaultEventLogFile
+	}
+	b, err := os.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+	return ParseEventLog(b)
+}
+
+// ParseEventLog parses TCG PC Client binary event log in crypto-agile (TPM 2.0) or SHA-1 format.
+// Crypto-agile logs start with SHA-1 format EV_NO_ACTION event carrying Spec ID Event03 header
+// which lists digest algorithms of the following TCG_PCR_EVENT2 events
+func ParseEventLog(b []byte) (*EventLog, error) {
+	r := bytes.NewReader(b)
+	first, err := readSHA1Event(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	log := &EventLog{Banks: []tpm2.Algorithm{tpm2.AlgSHA1}, Events: []Event{first}}
+	if first.Type == EvNoAction && bytes.HasPrefix(first.Data, []byte(specIDEvent)) {
+		sizes, banks, err := parseSpecID(first.Data)
+		if err != nil {
+			return nil, err
+		}
+		log.CryptoAgile, log.Banks = true, banks
+		for i := 1; r.Len() > 0; i++ {
+			e, err := readAgileEvent(r, i, sizes)
+			if err != nil {
+				return nil, err
+			}
+			log.Events = append(log.Events, e)
+		}
+		return log, nil
+	}
+	for i := 1; r.Len() > 0; i++ {
+		e, err := readSHA1Event(r, i)
+		if err != nil {
+			return nil, err
+		}
+		log.Events = append(log.Events, e)
+	}
+	return log, nil
+}
+
+// parseSpecID parses digest sizes of TCG_EfiSpecIDEvent
+func parseSpecID(data []byte) (map[tpm2.Algorithm]int, []tpm2.Algorithm, error) {
+	r := bytes.NewReader(data[len(specIDEvent):])
+	var header struct {
+		PlatformClass uint32
+		VersionMinor  uint8
+		VersionMajor  uint8
+		Errata        uint8
+		UintnSize     uint8
+		NumAlgorithms uint32
+	}
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, nil, fmt.Errorf("decoding spec ID event: %w", err)
+	}
+	if header.NumAlgorithms == 0 || int(header.NumAlgorithms)*4 > r.Len() {
+		return nil, nil, fmt.Errorf("invalid number of spec ID event algorithms %d", header.NumAlgorithms)
+	}
+	sizes := map[tpm2.Algorithm]int{}
+	var banks []tpm2.Algorithm
+	for i := 0; i < int(header.NumAlgorithms); i++ {
+		var alg struct {
+			ID   uint16
+			Size uint16
+		}
+		if err := binary.Read(r, binary.LittleEndian, &alg); err != nil {
+			return nil, nil, fmt.Errorf("decoding spec ID event: %w", err)
+		}
+		bank := tpm2.Algorithm(alg.ID)
+		if h, err := bank.Hash(); err == nil && h.Size() != int(alg.Size) {
+			return nil, nil, fmt.Errorf("invalid %v digest size %d", bank, alg.Size)
+		}
+		sizes[bank] = int(alg.Size)
+		banks = append(banks, bank)
+	}
+	return sizes, banks, nil
+}
+
+// readSHA1Event reads TCG_PCR_EVENT of SHA-1 format log
+func readSHA1Event(r *bytes.Reader, seq int) (Event, error) {
+	var header struct {
+		PCR    uint32
+		Type   uint32
+		Digest [20]byte
+	}
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return Event{}, fmt.Errorf("decoding event %d: %w", seq, err)
+	}
+	data, err := readEventData(r, seq)
+	if err != nil {
+		return Event{}, err
+	}
+	return Event{
+		Sequence: seq,
+		PCR:      int(header.PCR),
+		Type:     EventType(header.Type),
+		Digests:  map[tpm2.Algorithm][]byte{tpm2.AlgSHA1: header.Digest[:]},
+		Data:     data,
+	}, nil
+}
+
+// readAgileEvent reads TCG_PCR_EVENT2 of crypto-agile log, digest sizes are taken from spec ID event
+func readAgileEvent(r *bytes.Reader, seq int, sizes map[tpm2.Algorithm]int) (Event, error) {
+	var header struct {
+		PCR   uint32
+		Type  uint32
+		Count uint32
+	}
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return Event{}, fmt.Errorf("decoding event %d: %w", seq, err)
+	}
+	if int(header.Count) > len(sizes) {
+		return Event{}, fmt.Errorf("event %d has %d digests, log header lists %d algorithms", seq, header.Count, len(sizes))
+	}
+	e := Event{Sequence: seq, PCR: int(header.PCR), Type: EventType(header.Type), Digests: map[tpm2.Algorithm][]byte{}}
+	for i := 0; i < int(header.Count); i++ {
+		var alg uint16
+		if err := binary.Read(r, binary.LittleEndian, &alg); err != nil {
+			return Event{}, fmt.Errorf("decoding event %d: %w", seq, err)
+		}
+		size, ok := sizes[tpm2.Algorithm(alg)]
+		if !ok {
+			return Event{}, fmt.Errorf("event %d digest algorithm 0x%x is not listed in log header", seq, alg)
+		}
+		digest := make([]byte, size)
+		if _, err := io.ReadFull(r, digest); err != nil {
+			return Event{}, fmt.Errorf("decoding event %d: %w", seq, err)
+		}
+		e.Digests[tpm2.Algorithm(alg)] = digest
+	}
+	data, err := readEventData(r, seq)
+	if err != nil {
+		return Event{}, err
+	}
+	e.Data = data
+	return e, nil
+}
+
+// readEventData reads size prefixed event data
+func readEventData(r *bytes.Reader, seq int) ([]byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return nil, fmt.Errorf("decoding event %d: %w", seq, err)
+	}
+	if size > maxEventSize || int(size) > r.Len() {
+		return nil, fmt.Errorf("event %d data size %d exceeds log size", seq, size)
+	}
+	data := make([]byte, size)
+	_, _ = r.Read(data)
+	return data, nil
+}
+
+// PCRs returns sorted indices of PCRs extended by events
+func (l *EventLog) PCRs() []int {
+	seen := map[int]bool{}
+	var pcrs []int
+	for _, e := range l.Events {
+		if e.Type != EvNoAction && !seen[e.PCR] {
+			seen[e.PCR] = true
+			pcrs = append(pcrs, e.PCR)
+		}
+	}
+	sort.Ints(pcrs)
+	return pcrs
+}
+
+// Replay computes PCR values of banks by extending events in log order. PCRs start as zeros,
+// except PCR 0 which is initialized with TPM2_Startup locality of StartupLocality event.
+// Banks with hash algorithms unknown to Go are skipped
+func (l *EventLog) Replay() PCRValues {
+	values := PCRValues{}
+	for _, bank := range l.Banks {
+		h, err := bank.Hash()
+		if err != nil {
+			continue
+		}
+		pcrs := map[int][]byte{}
+		for _, e := range l.Events {
+			if e.Type == EvNoAction {
+				if bytes.HasPrefix(e.Data, []byte(startupLocalityEvent)) && len(e.Data) > len(startupLocalityEvent) {
+					pcrs[0] = make([]byte, h.Size())
+					pcrs[0][h.Size()-1] = e.Data[len(startupLocalityEvent)]
+				}
+				continue
+			}
+			digest, ok := e.Digests[bank]
+			if !ok {
+				continue
+			}
+			v, ok := pcrs[e.PCR]
+			if !ok {
+				v = make([]byte, h.Size())
+			}
+			hash := h.New()
+			hash.Write(v)
+			hash.Write(digest)
+			pcrs[e.PCR] = hash.Sum(nil)
+		}
+		values[bank] = pcrs
+	}
+	return values
+}
+
+// Verify replays event log and compares replayed values with PCR values, like the ones returned
+// by TPM.ReadPCRs. Only banks and PCRs present in both are compared. Events of types measuring their
+// data as is (EV_SEPARATOR, EV_ACTION and EV_EFI_ACTION) whose digest doesn't match
+// the data are reported before PCR mismatches, empty result means the log matches PCR values
+func (l *EventLog) Verify(values PCRValues) []Mismatch {
+	var mismatches []Mismatch
+	for i := range l.Events {
+		e := &l.Events[i]
+		if !measuredDataEvents[e.Type] {
+			continue
+		}
+		for _, bank := range l.Banks {
+			digest, ok := e.Digests[bank]
+			h, err := bank.Hash()
+			if !ok || err != nil {
+				continue
+			}
+			hash := h.New()
+			hash.Write(e.Data)
+			if !bytes.Equal(hash.Sum(nil), digest) {
+				mismatches = append(mismatches, Mismatch{Bank: bank, PCR: e.PCR, Event: e})
+			}
+		}
+	}
+	replayed, pcrs := l.Replay(), l.PCRs()
+	for _, bank := range l.Banks {
+		for _, pcr := range pcrs {
+			v, ok := replayed[bank][pcr]
+			actual, found := values[bank][pcr]
+			if ok && found && !bytes.Equal(v, actual) {
+				mismatches = append(mismatches, Mismatch{Bank: bank, PCR: pcr, Replayed: v, Actual: actual})
+			}
+		}
+	}
+	return mismatches
+}
+
+// VerifyEventLog reads PCRs extended by event log from TPM and verifies the log against them,
+// see EventLog.Verify. Banks of the log which are not allocated in TPM are skipped
+func (t TPM) VerifyEventLog(log *EventLog) ([]Mismatch, error) {
+	var banks []tpm2.Algorithm
+	err := t.withDevice(func(rw io.ReadWriter) error {
+		allocated, err := allocatedBanks(rw)
+		if err != nil {
+			return err
+		}
+		for _, bank := range log.Banks {
+			for _, a := range allocated {
+				if a == bank {
+					banks = append(banks, bank)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(banks) == 0 {
+		return nil, fmt.Errorf("none of event log banks is allocated in TPM")
+	}
+	values, err := t.ReadPCRs(banks, log.PCRs())
+	if err != nil {
+		return nil, err
+	}
+	mismatches := log.Verify(values)
+	t.log().Debug("event log verified", "events", len(log.Events), "banks", len(banks), "mismatches", len(mismatches))
+	return mismatches, nil
+}
@@ -0,0 +1,231 @@
+package tpm_test
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+
+	"github.com/shuvava/tpm/pkg/tpm"
+	"github.com/shuvava/tpm/pkg/tpm/tpmtest"
+)
+
+// loadPCRValues reads PCR values in tpm-pcr JSON format
+func loadPCRValues(t *testing.T, f string) tpm.PCRValues {
+	t.Helper()
+	b, err := os.ReadFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var banks map[string][]struct {
+		PCR   int    `json:"pcr"`
+		Value string `json:"value"`
+	}
+	if err = json.Unmarshal(b, &banks); err != nil {
+		t.Fatal(err)
+	}
+	values := tpm.PCRValues{}
+	for name, pcrs := range banks {
+		bank, err := tpm.ParsePCRBank(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values[bank] = map[int][]byte{}
+		for _, p := range pcrs {
+			if values[bank][p.PCR], err = hex.DecodeString(p.Value); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return values
+}
+
+// agileEvent is event of crypto-agile log built by tests
+type agileEvent struct {
+	pcr  uint32
+	typ  tpm.EventType
+	data []byte
+}
+
+// buildEventLog encodes crypto-agile log of SHA-1 and SHA-256 digests of event data
+func buildEventLog(events ...agileEvent) []byte {
+	var spec, buf bytes.Buffer
+	_ = binary.Write(&spec, binary.LittleEndian, struct {
+		Signature     [16]byte
+		PlatformClass uint32
+		Version       [4]uint8
+		NumAlgorithms uint32
+		Algorithms    [2][2]uint16
+		VendorInfo    uint8
+	}{
+		Version:       [4]uint8{0, 2, 0, 2},
+		NumAlgorithms: 2,
+		Algorithms:    [2][2]uint16{{uint16(tpm2.AlgSHA1), sha1.Size}, {uint16(tpm2.AlgSHA256), sha256.Size}},
+	})
+	copy(spec.Bytes(), "Spec ID Event03\x00")
+	w := func(v interface{}) {
+		_ = binary.Write(&buf, binary.LittleEndian, v)
+	}
+	w(uint32(0))
+	w(uint32(tpm.EvNoAction))
+	w([20]byte{})
+	w(uint32(spec.Len()))
+	buf.Write(spec.Bytes())
+	for _, e := range events {
+		w(e.pcr)
+		w(uint32(e.typ))
+		w(uint32(2))
+		w(uint16(tpm2.AlgSHA1))
+		w(sha1.Sum(e.data))
+		w(uint16(tpm2.AlgSHA256))
+		w(sha256.Sum256(e.data))
+		w(uint32(len(e.data)))
+		buf.Write(e.data)
+	}
+	return buf.Bytes()
+}
+
+func TestParseEventLog(t *testing.T) {
+	tests := []struct {
+		name        string
+		cryptoAgile bool
+		banks       []tpm2.Algorithm
+	}{
+		{"sha1", false, []tpm2.Algorithm{tpm2.AlgSHA1}},
+		{"crypto_agile", true, []tpm2.Algorithm{tpm2.AlgSHA1, tpm2.AlgSHA256, tpm2.AlgSHA384}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log, err := tpm.LoadEventLog(filepath.Join("testdata", tt.name+"_eventlog.bin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if log.CryptoAgile != tt.cryptoAgile || len(log.Banks) != len(tt.banks) {
+				t.Fatalf("unexpected log format crypto-agile %v, banks %v", log.CryptoAgile, log.Banks)
+			}
+			for i, bank := range tt.banks {
+				if log.Banks[i] != bank {
+					t.Errorf("bank %d is %v, want %v", i, log.Banks[i], bank)
+				}
+			}
+			values := loadPCRValues(t, filepath.Join("testdata", tt.name+"_eventlog.json"))
+			if mismatches := log.Verify(values); len(mismatches) != 0 {
+				t.Fatalf("unexpected mismatches %v", mismatches)
+			}
+			replayed := log.Replay()
+			for _, pcr := range log.PCRs() {
+				if !bytes.Equal(replayed[tpm2.AlgSHA1][pcr], values[tpm2.AlgSHA1][pcr]) {
+					t.Errorf("PCR %d replayed to %x, want %x", pcr, replayed[tpm2.AlgSHA1][pcr], values[tpm2.AlgSHA1][pcr])
+				}
+			}
+
+			// tampered event data and digest are reported
+			var separator *tpm.Event
+			for i := range log.Events {
+				if log.Events[i].Type == tpm.EvSeparator {
+					separator = &log.Events[i]
+					break
+				}
+			}
+			if separator == nil {
+				t.Fatal("log has no separator event")
+			}
+			data := separator.Data
+			separator.Data = []byte{1, 0, 0, 0}
+			mismatches := log.Verify(values)
+			if len(mismatches) != len(log.Banks) {
+				t.Errorf("unexpected mismatches of tampered data %v", mismatches)
+			}
+			for _, m := range mismatches {
+				if m.Event != separator {
+					t.Errorf("unexpected mismatch of tampered data %v", m)
+				}
+			}
+			separator.Data = data
+			separator.Digests[tpm2.AlgSHA1] = make([]byte, sha1.Size)
+			mismatches = log.Verify(values)
+			if len(mismatches) != 2 || mismatches[0].Event != separator || mismatches[1].PCR != separator.PCR || mismatches[1].Event != nil {
+				t.Errorf("unexpected mismatches of tampered digest %v", mismatches)
+			}
+
+			b, err := os.ReadFile(filepath.Join("testdata", tt.name+"_eventlog.bin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = tpm.ParseEventLog(b[:len(b)-1]); err == nil {
+				t.Error("expected error for truncated log")
+			}
+		})
+	}
+
+	if _, err := tpm.ParseEventLog(nil); err == nil {
+		t.Error("expected error for empty log")
+	}
+}
+
+func TestReplayStartupLocality(t *testing.T) {
+	b := buildEventLog(
+		agileEvent{0, tpm.EvNoAction, []byte("StartupLocality\x00\x03")},
+		agileEvent{0, tpm.EvSCRTMVersion, []byte("firmware")},
+	)
+	log, err := tpm.ParseEventLog(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := make([]byte, sha256.Size)
+	start[sha256.Size-1] = 3
+	digest := sha256.Sum256([]byte("firmware"))
+	want := sha256.Sum256(append(start, digest[:]...))
+	if got := log.Replay()[tpm2.AlgSHA256][0]; !bytes.Equal(got, want[:]) {
+		t.Errorf("PCR 0 replayed to %x, want %x", got, want)
+	}
+}
+
+func TestVerifyEventLog(t *testing.T) {
+	sim := tpmtest.New(t)
+	// TPM reset clears PCRs 0-15 measured by the log
+	sim.Reset()
+	k := tpm.TPM{Opener: sim.Open}
+	events := []agileEvent{
+		{14, tpm.EvIPL, []byte("grub_cmd linux /vmlinuz")},
+		{14, tpm.EvSeparator, []byte{0, 0, 0, 0}},
+		{15, tpm.EvEFIAction, []byte("Exit Boot Services Invocation")},
+	}
+	for _, e := range events {
+		if err := k.ExtendPCR(int(e.pcr), e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log, err := tpm.ParseEventLog(buildEventLog(events...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pcrs := log.PCRs(); len(pcrs) != 2 || pcrs[0] != 14 || pcrs[1] != 15 {
+		t.Fatalf("unexpected log PCRs %v", pcrs)
+	}
+	mismatches, err := k.VerifyEventLog(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 0 {
+		t.Fatalf("unexpected mismatches %v", mismatches)
+	}
+
+	// measurement missing in the log is reported for both banks
+	if err = k.ExtendPCR(15, []byte("unlogged")); err != nil {
+		t.Fatal(err)
+	}
+	if mismatches, err = k.VerifyEventLog(log); err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 2 || mismatches[0].PCR != 15 || mismatches[1].PCR != 15 {
+		t.Errorf("unexpected mismatches %v", mismatches)
+	}
+}
@@ -0,0 +1,366 @@
+package tpm
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// DefaultImportAttributes are attributes of keys imported by ImportKey and DuplicateKey
+// when ImportOptions.Attributes is zero
+const DefaultImportAttributes = tpm2.FlagUserWithAuth
+
+// ImportOptions are options of ImportKey and DuplicateKey. Zero value imports signing key
+// with empty authorization under ECC storage primary key of owner hierarchy
+type ImportOptions struct {
+	// Scheme restricts signature scheme of the key, any scheme can be used when it is nil
+	Scheme *tpm2.SigScheme
+	// Attributes are object attributes of the key, DefaultImportAttributes are used when it is zero.
+	// FlagSign is always set, keys generated outside of TPM can't be fixed to TPM or parent and
+	// restricted keys are not supported
+	Attributes tpm2.KeyProp
+
+	ObjectOptions
+}
+
+// ParsePrivateKeyPEM parses unencrypted RSA or ECDSA private key in PKCS#1 (RSA PRIVATE KEY),
+// PKCS#8 (PRIVATE KEY) or SEC 1 (EC PRIVATE KEY) PEM format. Other blocks, like EC PARAMETERS
+// written by openssl ecparam, are skipped
+func ParsePrivateKeyPEM(b []byte) (crypto.Signer, error) {
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			return nil, fmt.Errorf("no private key PEM block found")
+		}
+		var (
+			key interface{}
+			err error
+		)
+		switch block.Type {
+		case "RSA PRIVATE KEY", "EC PRIVATE KEY", "PRIVATE KEY":
+			// legacy OpenSSL encryption is marked by DEK-Info header
+			if _, ok := block.Headers["DEK-Info"]; ok {
+				return nil, fmt.Errorf("encrypted private keys are not supported")
+			}
+		case "ENCRYPTED PRIVATE KEY":
+			return nil, fmt.Errorf("encrypted private keys are not supported")
+		default:
+			continue
+		}
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		default:
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse %s error: %w", block.Type, err)
+		}
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			return key, nil
+		case *ecdsa.PrivateKey:
+			return key, nil
+		}
+		return nil, fmt.Errorf("%w %T", ErrUnsupportedKey, key)
+	}
+}
+
+// ParentPublic returns public area of standard storage key template with public key pub.
+// Duplication depends only on parent key, name and symmetric algorithms, so it can be passed to
+// DuplicateKey for any SHA-256 and AES-128-CFB storage key, like the primary key of hierarchy
+func ParentPublic(pub crypto.PublicKey) (tpm2.Public, error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() != 2048 {
+			return tpm2.Public{}, fmt.Errorf("unsupported RSA storage key size %d", pub.N.BitLen())
+		}
+		public := defaultPrimaryRSATemplate
+		params := *public.RSAParameters
+		params.ModulusRaw = pub.N.Bytes()
+		if pub.E != 65537 {
+			params.ExponentRaw = uint32(pub.E)
+		}
+		public.RSAParameters = &params
+		return public, nil
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return tpm2.Public{}, fmt.Errorf("unsupported ECC storage key curve %s", pub.Curve.Params().Name)
+		}
+		public := defaultPrimaryECCTemplate
+		params := *public.ECCParameters
+		params.Point = tpm2.ECPoint{XRaw: eccBytes(pub.Curve, pub.X), YRaw: eccBytes(pub.Curve, pub.Y)}
+		public.ECCParameters = &params
+		return public, nil
+	}
+	return tpm2.Public{}, fmt.Errorf("%w %T", ErrUnsupportedKey, pub)
+}
+
+// objects builds public and sensitive areas of imported key
+func (opts ImportOptions) objects(key crypto.Signer) (tpm2.Public, tpm2.Private, error) {
+	attrs := opts.Attributes
+	if attrs == 0 {
+		attrs = DefaultImportAttributes
+	}
+	switch {
+	case attrs&tpm2.FlagRestricted != 0:
+		return tpm2.Public{}, tpm2.Private{}, fmt.Errorf("restricted keys can't sign external digests")
+	case attrs&(tpm2.FlagFixedTPM|tpm2.FlagFixedParent|tpm2.FlagSensitiveDataOrigin) != 0:
+		return tpm2.Public{}, tpm2.Private{}, fmt.Errorf("imported keys can't have fixedTPM, fixedParent or sensitiveDataOrigin attributes")
+	}
+	public := tpm2.Public{
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: attrs | tpm2.FlagSign,
+		AuthPolicy: opts.PolicyDigest,
+	}
+	private := tpm2.Private{AuthValue: []byte(opts.KeyAuth)}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		switch bits := key.N.BitLen(); bits {
+		case 2048, 3072, 4096:
+		default:
+			return tpm2.Public{}, tpm2.Private{}, fmt.Errorf("unsupported RSA key size %d, must be 2048, 3072 or 4096", bits)
+		}
+		if len(key.Primes) != 2 {
+			return tpm2.Public{}, tpm2.Private{}, fmt.Errorf("multi-prime RSA keys are not supported")
+		}
+		scheme, err := signScheme(tpm2.AlgRSA, opts.Scheme)
+		if err != nil {
+			return tpm2.Public{}, tpm2.Private{}, err
+		}
+		public.Type = tpm2.AlgRSA
+		public.RSAParameters = &tpm2.RSAParams{Sign: scheme, KeyBits: uint16(key.N.BitLen()), ModulusRaw: key.N.Bytes()}
+		// zero exponent is default exponent 65537
+		if key.E != 65537 {
+			public.RSAParameters.ExponentRaw = uint32(key.E)
+		}
+		private.Type, private.Sensitive = tpm2.AlgRSA, key.Primes[0].Bytes()
+	case *ecdsa.PrivateKey:
+		var curve tpm2.EllipticCurve
+		switch key.Curve {
+		case elliptic.P256():
+			curve = tpm2.CurveNISTP256
+		case elliptic.P384():
+			curve = tpm2.CurveNISTP384
+		default:
+			return tpm2.Public{}, tpm2.Private{}, fmt.Errorf("unsupported ECC curve %s, must be NIST P-256 or P-384", key.Curve.Params().Name)
+		}
+		scheme, err := signScheme(tpm2.AlgECC, opts.Scheme)
+		if err != nil {
+			return tpm2.Public{}, tpm2.Private{}, err
+		}
+		public.Type = tpm2.AlgECC
+		public.ECCParameters = &tpm2.ECCParams{
+			Sign:    scheme,
+			CurveID: curve,
+			Point:   tpm2.ECPoint{XRaw: eccBytes(key.Curve, key.X), YRaw: eccBytes(key.Curve, key.Y)},
+		}
+		private.Type, private.Sensitive = tpm2.AlgECC, eccBytes(key.Curve, key.D)
+	default:
+		return tpm2.Public{}, tpm2.Private{}, fmt.Errorf("%w %T", ErrUnsupportedKey, key)
+	}
+	return public, private, nil
+}
+
+// ImportKey wraps private key to parent storage key and imports it by TPM2_Import,
+// returned loadable TSS can be used without private key. Primary parent key of hierarchy
+// is created with standard storage key template, so the key can be loaded by TSS.LoadKey
+// and tpm2-tss-engine
+func ImportKey(rw io.ReadWriter, key crypto.Signer, opts ImportOptions) (*TSS, error) {
+	public, private, err := opts.objects(key)
+	if err != nil {
+		return nil, err
+	}
+	tss := opts.newTSS(OIDLoadableKey)
+	if tss.Policy, err = applyPolicy(rw, &public, opts.objectPolicy()); err != nil {
+		return nil, err
+	}
+	parent, parentPub, flush, err := tss.loadParent(rw, opts.ParentTemplate, opts.RSAParent)
+	if err != nil {
+		return nil, err
+	}
+	defer flush()
+
+	publicBlob, duplicate, seed, err := duplicateObject(parentPub, public, private)
+	if err != nil {
+		return nil, err
+	}
+	var privateBlob []byte
+	err = tss.withParentAuth(rw, parentPub.Attributes, func(auth tpm2.AuthCommand) error {
+		privateBlob, err = tpm2.Import(rw, parent, auth, publicBlob, duplicate, seed, nil, nil)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("import key error: %w", rcError(err))
+	}
+	if tss.Public, err = tpmutil.Pack(tpmutil.U16Bytes(publicBlob)); err != nil {
+		return nil, err
+	}
+	if tss.Private, err = tpmutil.Pack(tpmutil.U16Bytes(privateBlob)); err != nil {
+		return nil, err
+	}
+	tss.log().Info("key imported", "type", public.Type.String(), "parent", handleAttr(tss.Parent), "rsaParent", tss.RSAParent)
+	return tss, nil
+}
+
+// DuplicateKey wraps private key to storage key with public area parentPub without access to TPM.
+// Returned importable TSS is imported by TSS.LoadKey under opts.Parent, parentPub must be public area
+// of the persistent parent key or of hierarchy primary key created by standard or ParentTemplate
+// template (see ParentPublic). PCRs of opts are not supported, AuthorizeKey binds the key to signed PCR policies
+func DuplicateKey(parentPub tpm2.Public, key crypto.Signer, opts ImportOptions) (*TSS, error) {
+	public, private, err := opts.objects(key)
+	if err != nil {
+		return nil, err
+	}
+	// PCR policy is built from current PCR values of TPM
+	if len(opts.PCRs.PCRs) > 0 {
+		return nil, fmt.Errorf("PCRs can't be used without TPM access, use AuthorizeKey")
+	}
+	tss := opts.newTSS(OIDImportableKey)
+	if tss.Policy, err = applyPolicy(nil, &public, opts.objectPolicy()); err != nil {
+		return nil, err
+	}
+	tss.RSAParent = parentPub.Type == tpm2.AlgRSA
+	tss.ParentTemplate = opts.ParentTemplate
+
+	publicBlob, duplicate, seed, err := duplicateObject(parentPub, public, private)
+	if err != nil {
+		return nil, err
+	}
+	if tss.Public, err = tpmutil.Pack(tpmutil.U16Bytes(publicBlob)); err != nil {
+		return nil, err
+	}
+	if tss.Private, err = tpmutil.Pack(tpmutil.U16Bytes(duplicate)); err != nil {
+		return nil, err
+	}
+	if tss.Secret, err = tpmutil.Pack(tpmutil.U16Bytes(seed)); err != nil {
+		return nil, err
+	}
+	tss.log().Info("key duplicated", "type", public.Type.String(), "parent", handleAttr(tss.Parent), "rsaParent", tss.RSAParent)
+	return tss, nil
+}
+
+// duplicateObject creates TPM2_Import arguments of object protected by outer wrapper of parent storage key:
+// encoded public area, duplicate private area and encrypted seed (TPM 2.0 Part 1, 23.3.2 Outer Duplication Wrapper)
+func duplicateObject(parentPub tpm2.Public, public tpm2.Public, private tpm2.Private) (publicBlob, duplicate, encSeed []byte, err error) {
+	var sym *tpm2.SymScheme
+	switch parentPub.Type {
+	case tpm2.AlgRSA:
+		sym = parentPub.RSAParameters.Symmetric
+	case tpm2.AlgECC:
+		sym = parentPub.ECCParameters.Symmetric
+	}
+	if parentPub.Attributes&(tpm2.FlagRestricted|tpm2.FlagDecrypt) != tpm2.FlagRestricted|tpm2.FlagDecrypt ||
+		sym == nil || sym.Alg != tpm2.AlgAES || sym.Mode != tpm2.AlgCFB {
+		return nil, nil, nil, fmt.Errorf("parent is not AES-CFB storage key")
+	}
+	hash, err := parentPub.NameAlg.Hash()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("parent name algorithm: %w", err)
+	}
+
+	var seed []byte
+	switch parentPub.Type {
+	case tpm2.AlgRSA:
+		seed = make([]byte, hash.Size())
+		if _, err = io.ReadFull(rand.Reader, seed); err != nil {
+			return nil, nil, nil, err
+		}
+		parentKey, err := parentPub.Key()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		encSeed, err = rsa.EncryptOAEP(hash.New(), rand.Reader, parentKey.(*rsa.PublicKey), seed, []byte("DUPLICATE\x00"))
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("seed encryption error: %w", err)
+		}
+	case tpm2.AlgECC:
+		parentKey, err := parentPub.Key()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		point := parentKey.(*ecdsa.PublicKey)
+		priv, x, y, err := elliptic.GenerateKey(point.Curve, rand.Reader)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		z, _ := point.Curve.ScalarMult(point.X, point.Y, priv)
+		seed, err = tpm2.KDFe(parentPub.NameAlg, eccBytes(point.Curve, z), "DUPLICATE",
+			eccBytes(point.Curve, x), eccBytes(point.Curve, point.X), hash.Size()*8)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		encSeed, err = tpmutil.Pack(tpmutil.U16Bytes(eccBytes(point.Curve, x)), tpmutil.U16Bytes(eccBytes(point.Curve, y)))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	if publicBlob, err = public.Encode(); err != nil {
+		return nil, nil, nil, err
+	}
+	name, err := public.Name()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	nameBlob, err := name.Digest.Encode()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	sensitive, err := private.Encode()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	sensitive, err = tpmutil.Pack(tpmutil.U16Bytes(sensitive))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// sensitive area is encrypted by AES-CFB with zero IV and key derived from seed and object name
+	symKey, err := tpm2.KDFa(parentPub.NameAlg, seed, "STORAGE", nameBlob, nil, int(sym.KeyBits))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	block, err := aes.NewCipher(symKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	encSensitive := make([]byte, len(sensitive))
+	cipher.NewCFBEncrypter(block, make([]byte, block.BlockSize())).XORKeyStream(encSensitive, sensitive)
+
+	macKey, err := tpm2.KDFa(parentPub.NameAlg, seed, "INTEGRITY", nil, nil, hash.Size()*8)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	mac := hmac.New(hash.New, macKey)
+	mac.Write(encSensitive)
+	mac.Write(nameBlob)
+	duplicate, err = tpmutil.Pack(tpm2.IDObject{IntegrityHMAC: mac.Sum(nil), EncIdentity: encSensitive})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return publicBlob, duplicate, encSeed, nil
+}
+
+// eccBytes encodes ECC integer as big-endian bytes padded to curve size
+func eccBytes(curve elliptic.Curve, i *big.Int) []byte {
+	b := i.Bytes()
+	size := (curve.Params().BitSize + 7) / 8
+	return append(make([]byte, size-len(b)), b...)
+}
@@ -0,0 +1,292 @@
+package tpm_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+
+	"github.com/shuvava/tpm/pkg/tpm"
+	"github.com/shuvava/tpm/pkg/tpm/tpmtest"
+)
+
+var (
+	rsaKeyOnce sync.Once
+	rsaKey     *rsa.PrivateKey
+)
+
+// testRSAKey returns RSA 2048 key shared by tests, its generation is slow
+func testRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	rsaKeyOnce.Do(func() {
+		var err error
+		if rsaKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return rsaKey
+}
+
+func testECCKey(t *testing.T, curve elliptic.Curve) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// signWith loads TSS from file and verifies signature of the key against original public key
+func signWith(t *testing.T, sim *tpmtest.Simulator, tss *tpm.TSS, keyAuth string, want crypto.PublicKey) {
+	t.Helper()
+	tss, err := tpm.LoadFromFile(sim.TSSFile(tss, "key.tss"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &tpm.TPM{Tss: tss, Opener: sim.Open}
+	if keyAuth != "" {
+		conf.KeyAuth = tpm.StaticAuth(keyAuth)
+	}
+	k := newTPM(t, conf)
+	pub, err := k.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !want.(interface{ Equal(crypto.PublicKey) bool }).Equal(pub) {
+		t.Fatal("TPM public key doesn't match imported key")
+	}
+	sum := sha256.Sum256([]byte("data"))
+	sig, err := k.Sign(rand.Reader, sum[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify(t, want, sum[:], sig, crypto.SHA256)
+}
+
+func TestParsePrivateKeyPEM(t *testing.T) {
+	rsaKey := testRSAKey(t)
+	eccKey := testECCKey(t, elliptic.P256())
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8 := func(key interface{}) []byte {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	}
+	sec1, err := x509.MarshalECPrivateKey(eccKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecParams := pem.EncodeToMemory(&pem.Block{Type: "EC PARAMETERS", Bytes: []byte{0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}})
+
+	tests := []struct {
+		name    string
+		pem     []byte
+		want    crypto.PublicKey
+		wantErr error
+	}{
+		{"PKCS1", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}), &rsaKey.PublicKey, nil},
+		{"PKCS8 RSA", pkcs8(rsaKey), &rsaKey.PublicKey, nil},
+		{"PKCS8 ECDSA", pkcs8(eccKey), &eccKey.PublicKey, nil},
+		{"SEC1 with EC parameters", append(ecParams, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1})...), &eccKey.PublicKey, nil},
+		{"Ed25519", pkcs8(edKey), nil, tpm.ErrUnsupportedKey},
+		{"encrypted", pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: []byte{1}}), nil, nil},
+		{"legacy encrypted", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Headers: map[string]string{
+			"Proc-Type": "4,ENCRYPTED", "DEK-Info": "AES-128-CBC,00000000000000000000000000000000"}, Bytes: []byte{1}}), nil, nil},
+		{"public key", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte{1}}), nil, nil},
+		{"invalid key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: []byte{1}}), nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := tpm.ParsePrivateKeyPEM(tt.pem)
+			if tt.want == nil {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+					t.Errorf("expected %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.want.(interface{ Equal(crypto.PublicKey) bool }).Equal(key.Public()) {
+				t.Error("unexpected key")
+			}
+		})
+	}
+}
+
+func TestImportKey(t *testing.T) {
+	sim := tpmtest.New(t)
+	const parentHandle = 0x81000070
+	sim.PersistPrimary(tpmtest.RSAParentTemplate, parentHandle)
+	rsaKey := testRSAKey(t)
+
+	tests := []struct {
+		name    string
+		key     crypto.Signer
+		opts    tpm.ImportOptions
+		keyAuth string
+	}{
+		{"RSA", rsaKey, tpm.ImportOptions{}, ""},
+		{"RSA under RSA parent", rsaKey, tpm.ImportOptions{ObjectOptions: tpm.ObjectOptions{RSAParent: true}}, ""},
+		{"ECC P-256 with auth", testECCKey(t, elliptic.P256()), tpm.ImportOptions{ObjectOptions: tpm.ObjectOptions{KeyAuth: "secret"}}, "secret"},
+		{"ECC P-384 under persistent parent", testECCKey(t, elliptic.P384()), tpm.ImportOptions{ObjectOptions: tpm.ObjectOptions{Parent: parentHandle}}, ""},
+		{"restricted scheme", rsaKey, tpm.ImportOptions{Scheme: &tpm2.SigScheme{Alg: tpm2.AlgRSASSA, Hash: tpm2.AlgSHA256}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw, err := sim.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			tss, err := tpm.ImportKey(rw, tt.key, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sim.Handles(tpm2.HandleTypeTransient)) != 0 {
+				t.Error("ImportKey left transient handles")
+			}
+			if tss.Type != tpm.OIDLoadableKey || tss.EmptyAuth != (tt.keyAuth == "") {
+				t.Errorf("unexpected TSS type %s, EmptyAuth %v", tss.Type, tss.EmptyAuth)
+			}
+			signWith(t, sim, tss, tt.keyAuth, tt.key.Public())
+		})
+	}
+
+	rw, err := sim.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, opts := range map[string]tpm.ImportOptions{
+		"fixedTPM":       {Attributes: tpm.DefaultImportAttributes | tpm2.FlagFixedTPM},
+		"restricted key": {Attributes: tpm.DefaultImportAttributes | tpm2.FlagRestricted},
+		"ECDSA scheme":   {Scheme: &tpm2.SigScheme{Alg: tpm2.AlgECDSA, Hash: tpm2.AlgSHA256}},
+		"missing parent": {ObjectOptions: tpm.ObjectOptions{Parent: 0x81000099}},
+		"PCRs with policy digest": {ObjectOptions: tpm.ObjectOptions{
+			PCRs: tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: []int{16}}, PolicyDigest: make([]byte, 32)}},
+	} {
+		if _, err = tpm.ImportKey(rw, rsaKey, opts); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	if _, err = tpm.ImportKey(rw, testECCKey(t, elliptic.P521()), tpm.ImportOptions{}); err == nil {
+		t.Error("expected error for P-521 key")
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tpm.ImportKey(rw, edKey, tpm.ImportOptions{}); !errors.Is(err, tpm.ErrUnsupportedKey) {
+		t.Errorf("expected ErrUnsupportedKey, got %v", err)
+	}
+}
+
+func TestDuplicateKey(t *testing.T) {
+	sim := tpmtest.New(t)
+	const parentHandle = 0x81000071
+	sim.PersistPrimary(tpmtest.ECCParentTemplate, parentHandle)
+	rsaKey := testRSAKey(t)
+
+	// public areas of parents are read from TPM in advance, like on provisioning server
+	persistentPub, _, _, err := tpm2.ReadPublic(sim.RW(), parentHandle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	primaryPub := func(template tpm2.Public) tpm2.Public {
+		h := sim.CreatePrimary(tpm2.HandleOwner, template)
+		defer sim.Flush(h)
+		pub, _, _, err := tpm2.ReadPublic(sim.RW(), h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := pub.Key()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// only public key of standard template primary key is needed
+		pub, err = tpm.ParentPublic(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pub
+	}
+
+	tests := []struct {
+		name      string
+		parentPub tpm2.Public
+		key       crypto.Signer
+		opts      tpm.ImportOptions
+		keyAuth   string
+	}{
+		{"RSA under persistent parent", persistentPub, rsaKey, tpm.ImportOptions{ObjectOptions: tpm.ObjectOptions{Parent: parentHandle}}, ""},
+		{"ECC under ECC primary", primaryPub(tpmtest.ECCParentTemplate), testECCKey(t, elliptic.P256()), tpm.ImportOptions{ObjectOptions: tpm.ObjectOptions{KeyAuth: "secret"}}, "secret"},
+		{"RSA under RSA primary", primaryPub(tpmtest.RSAParentTemplate), rsaKey, tpm.ImportOptions{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tss, err := tpm.DuplicateKey(tt.parentPub, tt.key, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tss.Type != tpm.OIDImportableKey || tss.RSAParent != (tt.parentPub.Type == tpm2.AlgRSA) || len(tss.Secret) == 0 {
+				t.Errorf("unexpected TSS %+v", tss)
+			}
+			b, err := tss.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var decoded tpm.TSS
+			if _, err = decoded.Unmarshal(b); err != nil {
+				t.Fatal(err)
+			}
+			var imported *tpm.TSS
+			decoded.OnImport = func(tss *tpm.TSS) error {
+				imported = tss
+				return nil
+			}
+			h, err := decoded.LoadKey(sim.RW())
+			if err != nil {
+				t.Fatal(err)
+			}
+			sim.Flush(h)
+			if imported == nil || imported.Type != tpm.OIDLoadableKey || imported.Secret != nil {
+				t.Fatalf("unexpected imported key %+v", imported)
+			}
+			signWith(t, sim, imported, tt.keyAuth, tt.key.Public())
+		})
+	}
+
+	storageKey := testECCKey(t, elliptic.P256())
+	signingPub, err := tpm.ParentPublic(&storageKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingPub.Attributes = tpm2.FlagSign | tpm2.FlagUserWithAuth
+	if _, err = tpm.DuplicateKey(signingPub, rsaKey, tpm.ImportOptions{}); err == nil {
+		t.Error("expected error for non-storage parent")
+	}
+	pcrOpts := tpm.ImportOptions{ObjectOptions: tpm.ObjectOptions{PCRs: tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: []int{16}}}}
+	if _, err = tpm.DuplicateKey(persistentPub, rsaKey, pcrOpts); err == nil {
+		t.Error("expected error for PCR policy without TPM")
+	}
+	if _, err = tpm.ParentPublic(&testECCKey(t, elliptic.P384()).PublicKey); err == nil {
+		t.Error("expected error for P-384 storage key")
+	}
+}
@@ -0,0 +1,184 @@
+package tpm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// DefaultKeyAttributes are attributes of keys created by CreateKey when KeyOptions.Attributes is zero
+const DefaultKeyAttributes = tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin | tpm2.FlagUserWithAuth
+
+// KeyOptions are options of CreateKey. Zero value creates RSA 2048 signing key with empty
+// authorization under ECC storage primary key of owner hierarchy
+type KeyOptions struct {
+	// Algorithm is key type, tpm2.AlgRSA (default) or tpm2.AlgECC
+	Algorithm tpm2.Algorithm
+	// RSABits is RSA key size, 2048 (default), 3072 or 4096
+	RSABits int
+	// Curve is ECC key curve, tpm2.CurveNISTP256 (default) or tpm2.CurveNISTP384
+	Curve tpm2.EllipticCurve
+	// Scheme restricts signature scheme of the key, any scheme can be used when it is nil
+	Scheme *tpm2.SigScheme
+	// Attributes are object attributes of the key, DefaultKeyAttributes are used when it is zero.
+	// FlagSign is always set, restricted keys are not supported
+	Attributes tpm2.KeyProp
+
+	ObjectOptions
+}
+
+// template builds public area of the key
+func (opts KeyOptions) template() (tpm2.Public, error) {
+	attrs := opts.Attributes
+	if attrs == 0 {
+		attrs = DefaultKeyAttributes
+	}
+	if attrs&tpm2.FlagRestricted != 0 {
+		return tpm2.Public{}, fmt.Errorf("restricted keys can't sign external digests")
+	}
+	public := tpm2.Public{
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: attrs | tpm2.FlagSign,
+		AuthPolicy: opts.PolicyDigest,
+	}
+	switch opts.Algorithm {
+	case 0, tpm2.AlgRSA:
+		bits := opts.RSABits
+		switch bits {
+		case 0:
+			bits = 2048
+		case 2048, 3072, 4096:
+		default:
+			return tpm2.Public{}, fmt.Errorf("unsupported RSA key size %d, must be 2048, 3072 or 4096", bits)
+		}
+		scheme, err := signScheme(tpm2.AlgRSA, opts.Scheme)
+		if err != nil {
+			return tpm2.Public{}, err
+		}
+		public.Type = tpm2.AlgRSA
+		public.RSAParameters = &tpm2.RSAParams{Sign: scheme, KeyBits: uint16(bits)}
+	case tpm2.AlgECC:
+		curve := opts.Curve
+		switch curve {
+		case 0:
+			curve = tpm2.CurveNISTP256
+		case tpm2.CurveNISTP256, tpm2.CurveNISTP384:
+		default:
+			return tpm2.Public{}, fmt.Errorf("unsupported ECC curve %v, must be NIST P-256 or P-384", curve)
+		}
+		scheme, err := signScheme(tpm2.AlgECC, opts.Scheme)
+		if err != nil {
+			return tpm2.Public{}, err
+		}
+		public.Type = tpm2.AlgECC
+		public.ECCParameters = &tpm2.ECCParams{Sign: scheme, CurveID: curve}
+	default:
+		return tpm2.Public{}, fmt.Errorf("%w %v", ErrUnsupportedKey, opts.Algorithm)
+	}
+	return public, nil
+}
+
+// signScheme validates signature scheme of key type and returns its copy,
+// nil scheme is converted into null scheme allowing any scheme
+func signScheme(keyType tpm2.Algorithm, scheme *tpm2.SigScheme) (*tpm2.SigScheme, error) {
+	if scheme == nil {
+		return &tpm2.SigScheme{Alg: tpm2.AlgNull}, nil
+	}
+	var ok bool
+	switch scheme.Alg {
+	case tpm2.AlgNull:
+		ok = true
+	case tpm2.AlgRSASSA, tpm2.AlgRSAPSS:
+		ok = keyType == tpm2.AlgRSA
+	case tpm2.AlgECDSA:
+		ok = keyType == tpm2.AlgECC
+	}
+	if !ok {
+		return nil, fmt.Errorf("signature scheme %v can't be used with %v key", scheme.Alg, keyType)
+	}
+	s := *scheme
+	return &s, nil
+}
+
+// CreateKey creates signing key under parent and returns TSS describing it,
+// the key is not left loaded in TPM. Primary parent key of hierarchy is created with
+// standard storage key template, so the key can be loaded by TSS.LoadKey and tpm2-tss-engine
+func CreateKey(rw io.ReadWriter, opts KeyOptions) (*TSS, error) {
+	template, err := opts.template()
+	if err != nil {
+		return nil, err
+	}
+	tss := opts.newTSS(OIDLoadableKey)
+	if tss.Policy, err = applyPolicy(rw, &template, opts.objectPolicy()); err != nil {
+		return nil, err
+	}
+
+	parent, parentPub, flush, err := tss.loadParent(rw, opts.ParentTemplate, opts.RSAParent)
+	if err != nil {
+		return nil, err
+	}
+	defer flush()
+
+	var private, public []byte
+	err = tss.withParentAuth(rw, parentPub.Attributes, func(auth tpm2.AuthCommand) error {
+		private, public, _, _, _, err = tpm2.CreateKeyUsingAuth(rw, parent, pcrSelection, auth, opts.KeyAuth, template)
+		return err
+	})
+	if err != nil {
+		err = rcError(err)
+		var rcErr *RCError
+		if errors.As(err, &rcErr) && (rcErr.Name == "TPM_RC_VALUE" || rcErr.Name == "TPM_RC_KEY_SIZE") &&
+			template.Type == tpm2.AlgRSA && template.RSAParameters.KeyBits > 2048 {
+			return nil, fmt.Errorf("create key error: TPM doesn't support %d bit RSA keys: %w", template.RSAParameters.KeyBits, err)
+		}
+		return nil, fmt.Errorf("create key error: %w", err)
+	}
+	if tss.Public, err = tpmutil.Pack(tpmutil.U16Bytes(public)); err != nil {
+		return nil, err
+	}
+	if tss.Private, err = tpmutil.Pack(tpmutil.U16Bytes(private)); err != nil {
+		return nil, err
+	}
+	tss.log().Info("key created", "type", template.Type.String(), "parent", handleAttr(tss.Parent), "rsaParent", tss.RSAParent)
+	return tss, nil
+}
+
+// loadParent loads parent of new key described by msg and sets its RSAParent and ParentTemplate.
+// Primary key of hierarchy is created from template, ECC or RSA storage key template is used
+// when it is nil. Returned function flushes created primary key
+func (msg *TSS) loadParent(rw io.ReadWriter, template *tpm2.Public, rsaParent bool) (tpmutil.Handle, tpm2.Public, func(), error) {
+	if msg.hasPersistentParent() {
+		parentPub, _, _, err := tpm2.ReadPublic(rw, msg.Parent)
+		if err != nil {
+			return 0, tpm2.Public{}, nil, fmt.Errorf("parent key 0x%x is not available: %w", msg.Parent, rcError(err))
+		}
+		msg.RSAParent = parentPub.Type == tpm2.AlgRSA
+		return msg.Parent, parentPub, func() {}, nil
+	}
+	parentTemplate := defaultPrimaryECCTemplate
+	switch {
+	case template != nil:
+		parentTemplate = *template
+	case rsaParent:
+		parentTemplate = defaultPrimaryRSATemplate
+	}
+	parent, err := msg.loadPrimary(rw, parentTemplate)
+	if err != nil {
+		return 0, tpm2.Public{}, nil, rcError(err)
+	}
+	flush := func() {
+		_ = tpm2.FlushContext(rw, parent)
+	}
+	// public area of primary key contains its unique value required for duplication to it
+	parentPub, _, _, err := tpm2.ReadPublic(rw, parent)
+	if err != nil {
+		flush()
+		return 0, tpm2.Public{}, nil, fmt.Errorf("read parent public area error: %w", rcError(err))
+	}
+	msg.RSAParent = parentTemplate.Type == tpm2.AlgRSA
+	msg.ParentTemplate = &parentTemplate
+	return parent, parentPub, flush, nil
+}
@@ -0,0 +1,162 @@
+package tpm_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+
+	"github.com/shuvava/tpm/pkg/tpm"
+	"github.com/shuvava/tpm/pkg/tpm/tpmtest"
+)
+
+func TestCreateKey(t *testing.T) {
+	sim := tpmtest.New(t)
+	const parentHandle = 0x81000050
+	sim.PersistPrimary(tpmtest.RSAParentTemplate, parentHandle)
+	sum := sha256.Sum256([]byte("data"))
+
+	tests := []struct {
+		name    string
+		opts    tpm.KeyOptions
+		alg     x509.SignatureAlgorithm
+		keyAuth string
+		check   func(crypto.PublicKey) bool
+	}{
+		{"RSA default", tpm.KeyOptions{}, x509.SHA256WithRSA, "", func(k crypto.PublicKey) bool {
+			return k.(*rsa.PublicKey).N.BitLen() == 2048
+		}},
+		{"RSA parent", tpm.KeyOptions{ObjectOptions: tpm.ObjectOptions{RSAParent: true}}, x509.SHA256WithRSAPSS, "", nil},
+		{"ECC P-256", tpm.KeyOptions{Algorithm: tpm2.AlgECC}, x509.ECDSAWithSHA256, "", func(k crypto.PublicKey) bool {
+			return k.(*ecdsa.PublicKey).Curve == elliptic.P256()
+		}},
+		{"ECC P-384 with auth", tpm.KeyOptions{Algorithm: tpm2.AlgECC, Curve: tpm2.CurveNISTP384, ObjectOptions: tpm.ObjectOptions{KeyAuth: "secret"}}, x509.ECDSAWithSHA384, "secret",
+			func(k crypto.PublicKey) bool {
+				return k.(*ecdsa.PublicKey).Curve == elliptic.P384()
+			}},
+		{"persistent parent", tpm.KeyOptions{Algorithm: tpm2.AlgECC, ObjectOptions: tpm.ObjectOptions{Parent: parentHandle}}, x509.ECDSAWithSHA256, "", nil},
+		{"endorsement hierarchy", tpm.KeyOptions{Algorithm: tpm2.AlgECC, ObjectOptions: tpm.ObjectOptions{Parent: tpm2.HandleEndorsement}}, x509.ECDSAWithSHA256, "", nil},
+		{"restricted scheme", tpm.KeyOptions{Scheme: &tpm2.SigScheme{Alg: tpm2.AlgRSAPSS, Hash: tpm2.AlgSHA256}}, x509.SHA256WithRSAPSS, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw, err := sim.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			tss, err := tpm.CreateKey(rw, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sim.Handles(tpm2.HandleTypeTransient)) != 0 {
+				t.Error("CreateKey left transient handles")
+			}
+			if tss.EmptyAuth != (tt.keyAuth == "") {
+				t.Errorf("unexpected EmptyAuth %v", tss.EmptyAuth)
+			}
+
+			// key is loaded from serialized TSS file by standard parent template search
+			tss, err = tpm.LoadFromFile(sim.TSSFile(tss, "key.tss"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			conf := &tpm.TPM{Tss: tss, Opener: sim.Open, SignatureAlgorithm: tt.alg}
+			if tt.keyAuth != "" {
+				conf.KeyAuth = tpm.StaticAuth(tt.keyAuth)
+			}
+			k := newTPM(t, conf)
+			pub, err := k.PublicKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.check != nil && !tt.check(pub) {
+				t.Errorf("unexpected public key %v", pub)
+			}
+			digest := sum[:]
+			var opts crypto.SignerOpts = crypto.SHA256
+			if tt.alg == x509.ECDSAWithSHA384 {
+				sum384 := crypto.SHA384.New()
+				sum384.Write([]byte("data"))
+				digest, opts = sum384.Sum(nil), crypto.SHA384
+			}
+			if tt.alg == x509.SHA256WithRSAPSS {
+				opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+			}
+			sig, err := k.Sign(rand.Reader, digest, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			verify(t, pub, digest, sig, opts)
+		})
+	}
+}
+
+func TestCreateKeyOptions(t *testing.T) {
+	sim := tpmtest.New(t)
+	rw, err := sim.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := bytes.Repeat([]byte{0xAB}, sha256.Size)
+	tss, err := tpm.CreateKey(rw, tpm.KeyOptions{
+		Algorithm:  tpm2.AlgECC,
+		Attributes: tpm.DefaultKeyAttributes | tpm2.FlagNoDA,
+		ObjectOptions: tpm.ObjectOptions{
+			PolicyDigest: policy,
+			Policy:       []tpm.TSSPolicy{{CommandCode: tpm2.CmdPolicyPCR, CommandPolicy: []byte{1}}},
+			Description:  "test key",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := tss.DecodePublic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub.Attributes&tpm2.FlagNoDA == 0 || pub.Attributes&tpm2.FlagSign == 0 || !bytes.Equal(pub.AuthPolicy, policy) {
+		t.Errorf("unexpected key public area %+v", pub)
+	}
+	b, err := tss.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded tpm.TSS
+	if _, err = decoded.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Description != "test key" || len(decoded.Policy) != 1 || decoded.Type != tpm.OIDLoadableKey {
+		t.Errorf("unexpected TSS %+v", decoded)
+	}
+
+	for name, opts := range map[string]tpm.KeyOptions{
+		"RSA size":           {RSABits: 1024},
+		"ECC curve":          {Algorithm: tpm2.AlgECC, Curve: tpm2.CurveNISTP521},
+		"key type":           {Algorithm: tpm2.AlgSymCipher},
+		"ECDSA with RSA key": {Scheme: &tpm2.SigScheme{Alg: tpm2.AlgECDSA, Hash: tpm2.AlgSHA256}},
+		"restricted key":     {Attributes: tpm.DefaultKeyAttributes | tpm2.FlagRestricted},
+		"missing parent":     {ObjectOptions: tpm.ObjectOptions{Parent: tpmutil.Handle(0x81000099)}},
+	} {
+		if _, err = tpm.CreateKey(rw, opts); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	if _, err = tpm.CreateKey(rw, tpm.KeyOptions{Algorithm: tpm2.AlgSymCipher}); !errors.Is(err, tpm.ErrUnsupportedKey) {
+		t.Errorf("expected ErrUnsupportedKey, got %v", err)
+	}
+	// simulator supports RSA keys up to 2048 bits
+	_, err = tpm.CreateKey(rw, tpm.KeyOptions{RSABits: 4096})
+	if err == nil || !strings.Contains(err.Error(), "TPM doesn't support 4096 bit RSA keys") {
+		t.Errorf("unexpected error for 4096 bit RSA key: %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package tpm
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// Logger is structured logger with methods of *slog.Logger, args are alternating keys and values
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// nopLogger discards all log records, it is used when Logger is not specified
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
+
+// log returns configured Logger or logger discarding records
+func (t TPM) log() Logger {
+	if t.Logger == nil {
+		return nopLogger{}
+	}
+	return t.Logger
+}
+
+// log returns configured Logger or logger discarding records
+func (msg *TSS) log() Logger {
+	if msg.Logger == nil {
+		return nopLogger{}
+	}
+	return msg.Logger
+}
+
+// logError logs failed operation, TPM response code is logged as separate attributes
+func logError(l Logger, msg string, err error, args ...any) {
+	var rcErr *RCError
+	if errors.As(err, &rcErr) {
+		args = append(args, "rc", rcErr.Name, "code", fmt.Sprintf("0x%x", uint32(rcErr.Code)))
+	}
+	l.Error(msg, append(args, "error", err)...)
+}
+
+// handleAttr formats TPM handle as log attribute value
+func handleAttr(h tpmutil.Handle) string {
+	return fmt.Sprintf("0x%x", uint32(h))
+}
+
+// deviceAttr describes TPM device as log attribute value
+func (t TPM) deviceAttr() string {
+	switch {
+	case t.Device != nil:
+		return "shared"
+	case t.Opener != nil:
+		return "custom"
+	case t.TpmDevice == "":
+		return "default"
+	default:
+		return t.TpmDevice
+	}
+}
@@ -0,0 +1,77 @@
+package tpm
+
+import (
+	"crypto"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// ObjectOptions are authorization, parent and TSS options of objects created by CreateKey,
+// ImportKey, DuplicateKey and Seal. Zero value creates object with empty authorization
+// under ECC storage primary key of owner hierarchy
+type ObjectOptions struct {
+	// KeyAuth is authorization value of the object, EmptyAuth of TSS is set when it is empty
+	KeyAuth string
+	// PolicyDigest is authorization policy digest of the object
+	PolicyDigest []byte
+	// Policy is list of policy commands stored in TSS to satisfy PolicyDigest
+	Policy []TSSPolicy
+	// PCRs binds the object to current values of selected PCRs: PolicyPCR is stored in TSS and
+	// its digest is set as authorization policy, password authorization is disabled.
+	// KeyAuth is required by PolicyPassword when it is set. It can't be combined with PolicyDigest
+	PCRs tpm2.PCRSelection
+	// AuthorizeKey is public key signing policies of the object by SignPolicy: PolicyAuthorize is stored
+	// in TSS and its digest is set as authorization policy, so PCR values approved by signed policies
+	// can change without recreating the object. KeyAuth is required by PolicyPassword when it is set.
+	// It can't be combined with PCRs and PolicyDigest
+	AuthorizeKey crypto.PublicKey
+	// PolicyRef is policy reference of AuthorizeKey signatures, it limits signed policies to objects with the same value
+	PolicyRef []byte
+
+	// Parent is hierarchy (default owner) or persistent parent key handle
+	Parent tpmutil.Handle
+	// RSAParent selects RSA storage primary key of hierarchy, ECC primary key is used by default
+	RSAParent bool
+	// ParentTemplate is template of hierarchy primary key used instead of standard storage key template
+	ParentTemplate *tpm2.Public
+	// ParentAuth provides authorization value of persistent parent key
+	ParentAuth AuthFunc
+	// HierarchyAuth provides authorization value of the parent hierarchy
+	HierarchyAuth AuthFunc
+
+	// Description is stored in TSS
+	Description string
+	// Logger receives object creation events, it is set as Logger of returned TSS
+	Logger Logger
+}
+
+// objectPolicy returns authorization policy options
+func (opts ObjectOptions) objectPolicy() objectPolicy {
+	return objectPolicy{
+		pcrs:         opts.PCRs,
+		authorizeKey: opts.AuthorizeKey,
+		policyRef:    opts.PolicyRef,
+		password:     opts.KeyAuth != "",
+		digest:       opts.PolicyDigest,
+		policy:       opts.Policy,
+	}
+}
+
+// newTSS returns TSS of object type oid without object blobs, parent defaults to owner hierarchy
+func (opts ObjectOptions) newTSS(oid string) *TSS {
+	tss := &TSS{
+		Type:          oid,
+		EmptyAuth:     opts.KeyAuth == "",
+		Policy:        opts.Policy,
+		Description:   opts.Description,
+		Parent:        opts.Parent,
+		ParentAuth:    opts.ParentAuth,
+		HierarchyAuth: opts.HierarchyAuth,
+		Logger:        opts.Logger,
+	}
+	if tss.Parent == 0 {
+		tss.Parent = tpm2.HandleOwner
+	}
+	return tss
+}
@@ -0,0 +1,224 @@
+package tpm
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// maxPCRs is number of PCRs of PC Client platform TPM
+const maxPCRs = 24
+
+// pcrBanks are names of PCR bank hash algorithms
+var pcrBanks = map[string]tpm2.Algorithm{
+	"sha1":   tpm2.AlgSHA1,
+	"sha256": tpm2.AlgSHA256,
+	"sha384": tpm2.AlgSHA384,
+	"sha512": tpm2.AlgSHA512,
+}
+
+// PCRValues are PCR values of banks, indexed by bank hash algorithm and PCR index
+type PCRValues map[tpm2.Algorithm]map[int][]byte
+
+// ParsePCRBank parses PCR bank name (sha1, sha256, sha384 or sha512)
+func ParsePCRBank(name string) (tpm2.Algorithm, error) {
+	hash, ok := pcrBanks[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return 0, fmt.Errorf("unsupported PCR bank %q", name)
+	}
+	return hash, nil
+}
+
+// PCRBankName returns name of PCR bank accepted by ParsePCRBank
+func PCRBankName(bank tpm2.Algorithm) string {
+	for name, hash := range pcrBanks {
+		if hash == bank {
+			return name
+		}
+	}
+	return strings.ToLower(bank.String())
+}
+
+// ParsePCRSelection parses PCR selection in tpm2-tools format "sha256:0,1,7",
+// SHA-256 bank is used when bank is omitted ("0,1,7")
+func ParsePCRSelection(s string) (tpm2.PCRSelection, error) {
+	sel := tpm2.PCRSelection{Hash: tpm2.AlgSHA256}
+	list := s
+	if bank, rest, ok := strings.Cut(s, ":"); ok {
+		hash, err := ParsePCRBank(bank)
+		if err != nil {
+			return tpm2.PCRSelection{}, err
+		}
+		sel.Hash, list = hash, rest
+	}
+	seen := map[int]bool{}
+	for _, p := range strings.Split(list, ",") {
+		pcr, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil || pcr < 0 || pcr >= maxPCRs {
+			return tpm2.PCRSelection{}, fmt.Errorf("invalid PCR index %q", p)
+		}
+		if !seen[pcr] {
+			seen[pcr] = true
+			sel.PCRs = append(sel.PCRs, pcr)
+		}
+	}
+	sort.Ints(sel.PCRs)
+	return sel, nil
+}
+
+// readPCRs reads values of selected PCRs. TPM2_PCR_Read returns at most 8 PCRs and TPM may
+// return fewer, so missing PCRs are read again until TPM returns none of them
+func readPCRs(rw io.ReadWriter, sel tpm2.PCRSelection) (map[int][]byte, error) {
+	values := make(map[int][]byte, len(sel.PCRs))
+	missing := sel.PCRs
+	for len(missing) > 0 {
+		end := len(missing)
+		if end > 8 {
+			end = 8
+		}
+		chunk, err := tpm2.ReadPCRs(rw, tpm2.PCRSelection{Hash: sel.Hash, PCRs: missing[:end]})
+		if err != nil {
+			return nil, fmt.Errorf("read PCRs error: %w", rcError(err))
+		}
+		for pcr, v := range chunk {
+			values[pcr] = v
+		}
+		var rest []int
+		for _, pcr := range missing {
+			if _, ok := values[pcr]; !ok {
+				rest = append(rest, pcr)
+			}
+		}
+		// remaining PCRs are not allocated when TPM returns none of them
+		if len(rest) == len(missing) {
+			return nil, fmt.Errorf("PCR %d of %v bank is not allocated", rest[0], sel.Hash)
+		}
+		missing = rest
+	}
+	return values, nil
+}
+
+// encodePCRSelection encodes TPML_PCR_SELECTION with single bank
+func encodePCRSelection(sel tpm2.PCRSelection) ([]byte, error) {
+	bitmap := make([]byte, 3)
+	for _, pcr := range sel.PCRs {
+		if pcr < 0 || pcr >= 8*256 {
+			return nil, fmt.Errorf("invalid PCR index %d", pcr)
+		}
+		for pcr/8 >= len(bitmap) {
+			bitmap = append(bitmap, 0)
+		}
+		bitmap[pcr/8] |= 1 << (pcr % 8)
+	}
+	return tpmutil.Pack(uint32(1), sel.Hash, uint8(len(bitmap)), tpmutil.RawBytes(bitmap))
+}
+
+// allocatedBanks returns PCR banks with at least one allocated PCR
+func allocatedBanks(rw io.ReadWriter) ([]tpm2.Algorithm, error) {
+	caps, _, err := tpm2.GetCapability(rw, tpm2.CapabilityPCRs, 1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("get PCR banks error: %w", rcError(err))
+	}
+	var banks []tpm2.Algorithm
+	for _, c := range caps {
+		if sel, ok := c.(tpm2.PCRSelection); ok && len(sel.PCRs) > 0 {
+			banks = append(banks, sel.Hash)
+		}
+	}
+	return banks, nil
+}
+
+// withDevice runs fn with TPM device, it reuses device kept open by KeepOpen mode.
+// Otherwise device is opened by open and closed when fn returns, so key and NewTPMCrypto are not required
+func (t TPM) withDevice(fn func(rw io.ReadWriter) error) error {
+	if s := t.session; s != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.rwc != nil {
+			return fn(s.rwc)
+		}
+	}
+	rwc, err := t.open()
+	if err != nil {
+		err = newError(ErrDeviceOpen, err)
+		logError(t.log(), "unable to open TPM device", err, "device", t.deviceAttr())
+		return err
+	}
+	defer rwc.Close()
+	return fn(rwc)
+}
+
+// ReadPCRs reads values of PCR indices of banks, all allocated banks are read when banks is empty
+// and all PCRs of PC Client platform (0-23) when indices is empty. It needs only TPM device, so it can
+// be called on TPM configured without key and NewTPMCrypto
+func (t TPM) ReadPCRs(banks []tpm2.Algorithm, indices []int) (PCRValues, error) {
+	if len(indices) == 0 {
+		for pcr := 0; pcr < maxPCRs; pcr++ {
+			indices = append(indices, pcr)
+		}
+	}
+	values := PCRValues{}
+	err := t.withDevice(func(rw io.ReadWriter) error {
+		var err error
+		if len(banks) == 0 {
+			if banks, err = allocatedBanks(rw); err != nil {
+				return err
+			}
+		}
+		for _, bank := range banks {
+			if values[bank], err = readPCRs(rw, tpm2.PCRSelection{Hash: bank, PCRs: indices}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// ExtendPCR extends PCR index of all allocated banks with digest of data computed by hash algorithm
+// of each bank, like tpm2_pcrevent does. It needs only TPM device, so it can be called on TPM configured
+// without key and NewTPMCrypto
+func (t TPM) ExtendPCR(index int, data []byte) error {
+	if index < 0 || index >= maxPCRs {
+		return fmt.Errorf("invalid PCR index %d", index)
+	}
+	return t.withDevice(func(rw io.ReadWriter) error {
+		banks, err := allocatedBanks(rw)
+		if err != nil {
+			return err
+		}
+		// TPML_DIGEST_VALUES extends all banks by single command
+		digests, err := tpmutil.Pack(uint32(len(banks)))
+		if err != nil {
+			return err
+		}
+		for _, bank := range banks {
+			h, err := bank.Hash()
+			if err != nil {
+				return fmt.Errorf("unsupported PCR bank %v", bank)
+			}
+			hash := h.New()
+			hash.Write(data)
+			digest, err := tpmutil.Pack(bank, tpmutil.RawBytes(hash.Sum(nil)))
+			if err != nil {
+				return err
+			}
+			digests = append(digests, digest...)
+		}
+		_, err = runCommand(rw, tpm2.CmdPCRExtend, []tpmutil.Handle{tpmutil.Handle(index)},
+			[]tpm2.AuthCommand{passwordAuth(defaultPassword)}, tpmutil.RawBytes(digests))
+		if err != nil {
+			return fmt.Errorf("extend PCR %d error: %w", index, rcError(err))
+		}
+		t.log().Info("PCR extended", "pcr", index, "banks", len(banks))
+		return nil
+	})
+}
@@ -0,0 +1,173 @@
+package tpm_test
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+
+	"github.com/shuvava/tpm/pkg/tpm"
+	"github.com/shuvava/tpm/pkg/tpm/tpmtest"
+)
+
+func TestReadPCRs(t *testing.T) {
+	sim := tpmtest.New(t)
+	extendPCR(t, sim, 16)
+	// PCRs are read without key and NewTPMCrypto
+	k := tpm.TPM{Opener: sim.Open}
+
+	all, err := k.ReadPCRs(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bank := range []tpm2.Algorithm{tpm2.AlgSHA1, tpm2.AlgSHA256} {
+		h, err := bank.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all[bank]) != 24 {
+			t.Fatalf("%v bank has %d PCRs, want 24", bank, len(all[bank]))
+		}
+		for pcr, v := range all[bank] {
+			if len(v) != h.Size() {
+				t.Errorf("%v PCR %d has %d bytes value", bank, pcr, len(v))
+			}
+		}
+	}
+
+	values, err := k.ReadPCRs([]tpm2.Algorithm{tpm2.AlgSHA256}, []int{0, 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := tpm2.ReadPCR(sim.RW(), 16, tpm2.AlgSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 || len(values[tpm2.AlgSHA256]) != 2 || !bytes.Equal(values[tpm2.AlgSHA256][16], want) {
+		t.Errorf("unexpected PCR values %x", values)
+	}
+	if _, err = k.ReadPCRs(nil, []int{30}); err == nil {
+		t.Error("expected error for invalid PCR index")
+	}
+
+	bank, err := tpm.ParsePCRBank("SHA384")
+	if err != nil || bank != tpm2.AlgSHA384 || tpm.PCRBankName(bank) != "sha384" {
+		t.Errorf("ParsePCRBank(SHA384) = %v, %v", bank, err)
+	}
+	if _, err = tpm.ParsePCRBank("md5"); err == nil {
+		t.Error("expected error for unsupported bank")
+	}
+}
+
+// partialPCRRead is TPM device returning at most limit PCRs in TPM2_PCR_Read response,
+// skipped PCR is never returned like PCR which is not allocated
+type partialPCRRead struct {
+	io.ReadWriteCloser
+	limit   int
+	skipped int
+	pcrRead bool
+}
+
+func (d *partialPCRRead) Write(b []byte) (int, error) {
+	d.pcrRead = len(b) >= 10 && tpmutil.Command(binary.BigEndian.Uint32(b[6:10])) == tpm2.CmdPCRRead
+	return d.ReadWriteCloser.Write(b)
+}
+
+func (d *partialPCRRead) Read(b []byte) (int, error) {
+	n, err := d.ReadWriteCloser.Read(b)
+	if err != nil || !d.pcrRead || n < 21 || binary.BigEndian.Uint32(b[6:10]) != 0 {
+		return n, err
+	}
+	// header, update counter and selection of single bank are followed by digests
+	selectEnd := 21 + int(b[20])
+	out := append([]byte(nil), b[:selectEnd]...)
+	digests := b[selectEnd+4 : n]
+	var kept []byte
+	count := 0
+	for pcr := 0; pcr < 8*int(b[20]); pcr++ {
+		if out[21+pcr/8]&(1<<(pcr%8)) == 0 {
+			continue
+		}
+		size := 2 + int(binary.BigEndian.Uint16(digests))
+		if pcr == d.skipped || count == d.limit {
+			out[21+pcr/8] &^= 1 << (pcr % 8)
+		} else {
+			kept = append(kept, digests[:size]...)
+			count++
+		}
+		digests = digests[size:]
+	}
+	out = append(out, make([]byte, 4)...)
+	binary.BigEndian.PutUint32(out[selectEnd:], uint32(count))
+	out = append(out, kept...)
+	binary.BigEndian.PutUint32(out[2:6], uint32(len(out)))
+	return copy(b, out), nil
+}
+
+func TestReadPCRsPartialResponse(t *testing.T) {
+	sim := tpmtest.New(t)
+	extendPCR(t, sim, 16)
+	banks := []tpm2.Algorithm{tpm2.AlgSHA256}
+	want, err := (tpm.TPM{Device: sim.RW()}).ReadPCRs(banks, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := &partialPCRRead{limit: 3, skipped: -1}
+	k := tpm.TPM{Opener: func() (io.ReadWriteCloser, error) {
+		rw, err := sim.Open()
+		dev.ReadWriteCloser = rw
+		return dev, err
+	}}
+	got, err := k.ReadPCRs(banks, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got[tpm2.AlgSHA256]) != 24 {
+		t.Fatalf("read %d PCRs, want 24", len(got[tpm2.AlgSHA256]))
+	}
+	for pcr, v := range want[tpm2.AlgSHA256] {
+		if !bytes.Equal(got[tpm2.AlgSHA256][pcr], v) {
+			t.Errorf("PCR %d is %x, want %x", pcr, got[tpm2.AlgSHA256][pcr], v)
+		}
+	}
+
+	dev.skipped = 16
+	if _, err = k.ReadPCRs(banks, []int{0, 16, 17}); err == nil || !strings.Contains(err.Error(), "PCR 16 ") {
+		t.Errorf("expected error for PCR 16 which is not allocated, got %v", err)
+	}
+}
+
+func TestExtendPCR(t *testing.T) {
+	sim := tpmtest.New(t)
+	data := []byte("kernel command line")
+	sha1Sum, sha256Sum := sha1.Sum(data), sha256.Sum256(data)
+
+	// KeepOpen TPM reuses its device
+	k := newTPM(t, &tpm.TPM{TpmHandle: 0x81000000, Opener: sim.Open, KeepOpen: true})
+	before, err := k.ReadPCRs([]tpm2.Algorithm{tpm2.AlgSHA1, tpm2.AlgSHA256}, []int{23})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = k.ExtendPCR(23, data); err != nil {
+		t.Fatal(err)
+	}
+	after, err := k.ReadPCRs([]tpm2.Algorithm{tpm2.AlgSHA1, tpm2.AlgSHA256}, []int{23})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantSHA1 := sha1.Sum(append(before[tpm2.AlgSHA1][23], sha1Sum[:]...))
+	wantSHA256 := sha256.Sum256(append(before[tpm2.AlgSHA256][23], sha256Sum[:]...))
+	if !bytes.Equal(after[tpm2.AlgSHA1][23], wantSHA1[:]) || !bytes.Equal(after[tpm2.AlgSHA256][23], wantSHA256[:]) {
+		t.Errorf("unexpected extended values %x", after)
+	}
+
+	if err = (tpm.TPM{Device: sim.RW()}).ExtendPCR(24, data); err == nil {
+		t.Error("expected error for invalid PCR index")
+	}
+}
@@ -0,0 +1,225 @@
+package tpm
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// policyCommands are TSS policy commands executed by policy sessions,
+// they have policy session as the only handle and CommandPolicy holds their parameters
+var policyCommands = map[tpmutil.Command]bool{
+	tpm2.CmdPolicyPCR:         true,
+	tpm2.CmdPolicyPassword:    true,
+	tpm2.CmdPolicyCommandCode: true,
+}
+
+// pcrPolicy builds TSS policy binding object to current values of selected PCRs,
+// PolicyPassword is added when object has authorization value. Policy digest of the
+// object is computed by trial session
+func pcrPolicy(rw io.ReadWriter, sel tpm2.PCRSelection, password bool) ([]TSSPolicy, []byte, error) {
+	if sel.Hash == 0 {
+		sel.Hash = tpm2.AlgSHA256
+	}
+	values, err := readPCRs(rw, sel)
+	if err != nil {
+		return nil, nil, err
+	}
+	params, err := policyPCRParams(sel, values)
+	if err != nil {
+		return nil, nil, err
+	}
+	policy := []TSSPolicy{{CommandCode: tpm2.CmdPolicyPCR, CommandPolicy: params}}
+	if password {
+		policy = append(policy, TSSPolicy{CommandCode: tpm2.CmdPolicyPassword})
+	}
+	digest, err := policyDigest(rw, policy)
+	if err != nil {
+		return nil, nil, err
+	}
+	return policy, digest, nil
+}
+
+// policyPCRParams encodes PolicyPCR parameters, PCR digest is computed by policy session hash
+// over values in PCR index order
+func policyPCRParams(sel tpm2.PCRSelection, values map[int][]byte) ([]byte, error) {
+	encodedSel, err := encodePCRSelection(sel)
+	if err != nil {
+		return nil, err
+	}
+	pcrs := append([]int(nil), sel.PCRs...)
+	sort.Ints(pcrs)
+	pcrHash := sha256.New()
+	for i, pcr := range pcrs {
+		if i == 0 || pcr != pcrs[i-1] {
+			pcrHash.Write(values[pcr])
+		}
+	}
+	return tpmutil.Pack(tpmutil.U16Bytes(pcrHash.Sum(nil)), tpmutil.RawBytes(encodedSel))
+}
+
+// policyDigest computes SHA-256 policy digest of TSS policy commands by trial session
+func policyDigest(rw io.ReadWriter, policy []TSSPolicy) ([]byte, error) {
+	session, _, err := tpm2.StartAuthSession(rw, tpm2.HandleNull, tpm2.HandleNull,
+		make([]byte, 16), nil, tpm2.SessionTrial, tpm2.AlgNull, tpm2.AlgSHA256)
+	if err != nil {
+		return nil, fmt.Errorf("start trial session error: %w", rcError(err))
+	}
+	defer func() {
+		_ = tpm2.FlushContext(rw, session)
+	}()
+	if err = runPolicy(rw, session, policy); err != nil {
+		return nil, err
+	}
+	digest, err := tpm2.PolicyGetDigest(rw, session)
+	if err != nil {
+		return nil, fmt.Errorf("policy digest error: %w", rcError(err))
+	}
+	return digest, nil
+}
+
+// runPolicy executes TSS policy commands in policy or trial session.
+// Failed PolicyPCR command returns ErrPCRMismatch
+func runPolicy(rw io.ReadWriter, session tpmutil.Handle, policy []TSSPolicy) error {
+	for _, p := range policy {
+		if !policyCommands[p.CommandCode] {
+			return fmt.Errorf("unsupported policy command 0x%x", uint32(p.CommandCode))
+		}
+		_, err := runCommand(rw, p.CommandCode, []tpmutil.Handle{session}, nil, tpmutil.RawBytes(p.CommandPolicy))
+		if err == nil {
+			continue
+		}
+		err = rcError(err)
+		var rcErr *RCError
+		if p.CommandCode == tpm2.CmdPolicyPCR && errors.As(err, &rcErr) && rcErr.Name == "TPM_RC_VALUE" {
+			return newError(ErrPCRMismatch, err)
+		}
+		return fmt.Errorf("policy command 0x%x error: %w", uint32(p.CommandCode), err)
+	}
+	return nil
+}
+
+// hasPolicyCommand reports whether policy contains command
+func hasPolicyCommand(policy []TSSPolicy, cmd tpmutil.Command) bool {
+	for _, p := range policy {
+		if p.CommandCode == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// PolicySession starts policy session satisfying Policy of TSS, it authorizes use of the key
+// loaded by LoadKey. Caller should execute tpm2.FlushContext for returned session handle.
+// PolicyAuthorize, allowed only as the first command, is satisfied by a matching signed policy
+// of AuthPolicy or AuthPolicyFile, ErrNoSignedPolicy is returned when there are none.
+// ErrPCRMismatch is returned when PCR values don't match PolicyPCR of the key or of any signed policy
+func (msg *TSS) PolicySession(rw io.ReadWriter) (tpmutil.Handle, error) {
+	if len(msg.Policy) == 0 {
+		return 0, fmt.Errorf("TSS has no policy")
+	}
+	session, _, err := tpm2.StartAuthSession(rw, tpm2.HandleNull, tpm2.HandleNull,
+		make([]byte, 16), nil, tpm2.SessionPolicy, tpm2.AlgNull, tpm2.AlgSHA256)
+	if err != nil {
+		return 0, fmt.Errorf("start policy session error: %w", rcError(err))
+	}
+	policy := msg.Policy
+	if policy[0].CommandCode == CmdPolicyAuthorize {
+		err = msg.runAuthorizedPolicy(rw, session, policy[0])
+		policy = policy[1:]
+	}
+	if err == nil {
+		err = runPolicy(rw, session, policy)
+	}
+	if err != nil {
+		_ = tpm2.FlushContext(rw, session)
+		return 0, err
+	}
+	return session, nil
+}
+
+// withObjectAuth runs command fn authorized by password session or, when TSS has policy,
+// by policy session satisfying the policy. Password is passed to policy session only when
+// policy contains PolicyPassword. PCR changes between policy session start and command
+// return ErrPCRMismatch
+func withObjectAuth(rw io.ReadWriter, tss *TSS, password string, fn func(session tpmutil.Handle, password string) error) error {
+	if tss == nil || len(tss.Policy) == 0 {
+		return fn(tpm2.HandlePasswordSession, password)
+	}
+	session, err := tss.PolicySession(rw)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tpm2.FlushContext(rw, session)
+	}()
+	if !hasPolicyCommand(tss.Policy, tpm2.CmdPolicyPassword) {
+		password = ""
+	}
+	err = fn(session, password)
+	var rcErr *RCError
+	pcrBound := hasPolicyCommand(tss.Policy, tpm2.CmdPolicyPCR) || hasPolicyCommand(tss.Policy, CmdPolicyAuthorize)
+	if err != nil && pcrBound && errors.As(rcError(err), &rcErr) &&
+		(rcErr.Name == "TPM_RC_PCR_CHANGED" || rcErr.Name == "TPM_RC_POLICY_FAIL") {
+		return newError(ErrPCRMismatch, err)
+	}
+	return err
+}
+
+// objectPolicy are authorization policy options of created objects
+type objectPolicy struct {
+	// pcrs binds object to current PCR values
+	pcrs tpm2.PCRSelection
+	// authorizeKey makes object accept policies signed by the key
+	authorizeKey crypto.PublicKey
+	policyRef    []byte
+	// password adds PolicyPassword to PCR or authorized policy
+	password bool
+	digest   []byte
+	policy   []TSSPolicy
+}
+
+// applyPolicy sets authorization policy of object template and returns TSS policy satisfying it.
+// PCR or authorized policies disable user role authorization by password, so only policy
+// session can authorize the object
+func applyPolicy(rw io.ReadWriter, template *tpm2.Public, opts objectPolicy) ([]TSSPolicy, error) {
+	if len(opts.pcrs.PCRs) == 0 && opts.authorizeKey == nil {
+		return opts.policy, nil
+	}
+	if len(opts.digest) > 0 || len(opts.policy) > 0 {
+		return nil, fmt.Errorf("PCR and authorized policies can't be combined with PolicyDigest and Policy")
+	}
+	var (
+		policy []TSSPolicy
+		digest []byte
+		err    error
+	)
+	if opts.authorizeKey != nil {
+		if len(opts.pcrs.PCRs) > 0 {
+			return nil, fmt.Errorf("PCRs can't be combined with AuthorizeKey, they are approved by signed policies")
+		}
+		var authorize TSSPolicy
+		if authorize, err = authorizePolicy(opts.authorizeKey, opts.policyRef); err != nil {
+			return nil, err
+		}
+		policy = []TSSPolicy{authorize}
+		if opts.password {
+			policy = append(policy, TSSPolicy{CommandCode: tpm2.CmdPolicyPassword})
+		}
+		digest, err = computePolicyDigest(policy)
+	} else {
+		policy, digest, err = pcrPolicy(rw, opts.pcrs, opts.password)
+	}
+	if err != nil {
+		return nil, err
+	}
+	template.AuthPolicy = digest
+	template.Attributes &^= tpm2.FlagUserWithAuth
+	return policy, nil
+}
@@ -0,0 +1,163 @@
+package tpm_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+
+	"github.com/shuvava/tpm/pkg/tpm"
+	"github.com/shuvava/tpm/pkg/tpm/tpmtest"
+)
+
+func TestParsePCRSelection(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    tpm2.PCRSelection
+		wantErr bool
+	}{
+		{"0,1,7", tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: []int{0, 1, 7}}, false},
+		{"sha1:7, 0,7", tpm2.PCRSelection{Hash: tpm2.AlgSHA1, PCRs: []int{0, 7}}, false},
+		{"SHA384:23", tpm2.PCRSelection{Hash: tpm2.AlgSHA384, PCRs: []int{23}}, false},
+		{"md5:0", tpm2.PCRSelection{}, true},
+		{"sha256:24", tpm2.PCRSelection{}, true},
+		{"sha256:", tpm2.PCRSelection{}, true},
+		{"a", tpm2.PCRSelection{}, true},
+	}
+	for _, tt := range tests {
+		got, err := tpm.ParsePCRSelection(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParsePCRSelection(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (got.Hash != tt.want.Hash || len(got.PCRs) != len(tt.want.PCRs)) {
+			t.Errorf("ParsePCRSelection(%q) = %v, want %v", tt.in, got, tt.want)
+			continue
+		}
+		for i := range got.PCRs {
+			if got.PCRs[i] != tt.want.PCRs[i] {
+				t.Errorf("ParsePCRSelection(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		}
+	}
+}
+
+// extendPCR changes PCR value of SHA-256 and SHA-1 banks
+func extendPCR(t *testing.T, sim *tpmtest.Simulator, pcr int) {
+	t.Helper()
+	sum := sha256.Sum256([]byte("measurement"))
+	if err := tpm2.PCRExtend(sim.RW(), tpmutil.Handle(pcr), tpm2.AlgSHA256, sum[:], ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := tpm2.PCRExtend(sim.RW(), tpmutil.Handle(pcr), tpm2.AlgSHA1, sum[:20], ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPCRPolicyKey(t *testing.T) {
+	sim := tpmtest.New(t)
+	sum := sha256.Sum256([]byte("data"))
+
+	tests := []struct {
+		name    string
+		pcrs    string
+		keyAuth string
+	}{
+		{"SHA-256 bank", "sha256:0,16", ""},
+		{"SHA-1 bank with auth", "sha1:16", "secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sel, err := tpm.ParsePCRSelection(tt.pcrs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tss, err := tpm.CreateKey(sim.RW(), tpm.KeyOptions{Algorithm: tpm2.AlgECC, ObjectOptions: tpm.ObjectOptions{PCRs: sel, KeyAuth: tt.keyAuth}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			pub, err := tss.DecodePublic()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pub.Attributes&tpm2.FlagUserWithAuth != 0 || len(pub.AuthPolicy) != sha256.Size || len(tss.Policy) == 0 {
+				t.Errorf("key is not bound to policy: %+v", pub)
+			}
+
+			tss, err = tpm.LoadFromFile(sim.TSSFile(tss, "key.tss"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			conf := &tpm.TPM{Tss: tss, Opener: sim.Open}
+			if tt.keyAuth != "" {
+				conf.KeyAuth = tpm.StaticAuth(tt.keyAuth)
+			}
+			k := newTPM(t, conf)
+			sig, err := k.Sign(rand.Reader, sum[:], crypto.SHA256)
+			if err != nil {
+				t.Fatal(err)
+			}
+			verify(t, k.Public(), sum[:], sig, crypto.SHA256)
+
+			if tt.keyAuth != "" {
+				wrong := newTPM(t, &tpm.TPM{Tss: tss, Opener: sim.Open, KeyAuth: tpm.StaticAuth("wrong")})
+				if _, err = wrong.Sign(rand.Reader, sum[:], crypto.SHA256); !errors.Is(err, tpm.ErrAuthFailed) {
+					t.Errorf("expected ErrAuthFailed, got %v", err)
+				}
+			}
+
+			extendPCR(t, sim, 16)
+			if _, err = k.Sign(rand.Reader, sum[:], crypto.SHA256); !errors.Is(err, tpm.ErrPCRMismatch) {
+				t.Errorf("expected ErrPCRMismatch, got %v", err)
+			}
+		})
+	}
+}
+
+func TestPCRPolicySeal(t *testing.T) {
+	sim := tpmtest.New(t)
+	// more than 8 PCRs are read in chunks
+	sel, err := tpm.ParsePCRSelection("0,1,2,3,4,5,6,7,8,9,23")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("secret")
+	tss, err := tpm.Seal(sim.RW(), secret, tpm.SealOptions{ObjectOptions: tpm.ObjectOptions{PCRs: sel}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := tpm.Unseal(sim.RW(), tss, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, secret) {
+		t.Errorf("unsealed %q, want %q", data, secret)
+	}
+	// policy session is usable for other commands of the loaded object
+	session, err := tss.PolicySession(sim.RW())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim.Flush(session)
+
+	extendPCR(t, sim, 23)
+	if _, err = tpm.Unseal(sim.RW(), tss, nil); !errors.Is(err, tpm.ErrPCRMismatch) {
+		t.Errorf("expected ErrPCRMismatch, got %v", err)
+	}
+	if len(sim.Handles(tpm2.HandleTypeTransient)) != 0 || len(sim.Handles(tpm2.HandleTypePolicySession)) != 0 {
+		t.Error("Unseal left handles")
+	}
+
+	if _, err = tpm.Seal(sim.RW(), secret, tpm.SealOptions{ObjectOptions: tpm.ObjectOptions{PCRs: sel, PolicyDigest: make([]byte, sha256.Size)}}); err == nil {
+		t.Error("expected error for PCR policy combined with policy digest")
+	}
+	tss.Policy = []tpm.TSSPolicy{{CommandCode: tpm2.CmdPolicySecret}}
+	if _, err = tpm.Unseal(sim.RW(), tss, nil); err == nil {
+		t.Error("expected error for unsupported policy command")
+	}
+}
@@ -0,0 +1,139 @@
+package tpm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// DefaultSealAttributes are attributes of sealed objects created by Seal when SealOptions.Attributes is zero
+const DefaultSealAttributes = tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagUserWithAuth
+
+// MaxSealSize is maximal size of sealed data guaranteed by TPM 2.0 specification (MAX_SYM_DATA)
+const MaxSealSize = 128
+
+// SealOptions are options of Seal. Zero value seals data with empty authorization
+// under ECC storage primary key of owner hierarchy
+type SealOptions struct {
+	// Attributes are object attributes of sealed object, DefaultSealAttributes are used when it is zero.
+	// Sign, decrypt and sensitiveDataOrigin attributes can't be used with sealed data
+	Attributes tpm2.KeyProp
+
+	ObjectOptions
+}
+
+// template builds public area of sealed object
+func (opts SealOptions) template() (tpm2.Public, error) {
+	attrs := opts.Attributes
+	if attrs == 0 {
+		attrs = DefaultSealAttributes
+	}
+	if attrs&(tpm2.FlagSign|tpm2.FlagDecrypt|tpm2.FlagSensitiveDataOrigin) != 0 {
+		return tpm2.Public{}, fmt.Errorf("sealed data can't have sign, decrypt or sensitiveDataOrigin attributes")
+	}
+	return tpm2.Public{
+		Type:                tpm2.AlgKeyedHash,
+		NameAlg:             tpm2.AlgSHA256,
+		Attributes:          attrs,
+		AuthPolicy:          opts.PolicyDigest,
+		KeyedHashParameters: &tpm2.KeyedHashParams{Alg: tpm2.AlgNull},
+	}, nil
+}
+
+// Seal creates keyed-hash object sealing data under parent and returns TSS describing it,
+// the object is not left loaded in TPM. Parents are handled like by CreateKey, so sealed
+// data is loaded by TSS.LoadKey and unsealed by Unseal
+func Seal(rw io.ReadWriter, data []byte, opts SealOptions) (*TSS, error) {
+	if len(data) == 0 || len(data) > MaxSealSize {
+		return nil, fmt.Errorf("sealed data size %d must be between 1 and %d bytes", len(data), MaxSealSize)
+	}
+	template, err := opts.template()
+	if err != nil {
+		return nil, err
+	}
+	tss := opts.newTSS(OIDSealedData)
+	if tss.Policy, err = applyPolicy(rw, &template, opts.objectPolicy()); err != nil {
+		return nil, err
+	}
+	parent, parentPub, flush, err := tss.loadParent(rw, opts.ParentTemplate, opts.RSAParent)
+	if err != nil {
+		return nil, err
+	}
+	defer flush()
+
+	var private, public []byte
+	err = tss.withParentAuth(rw, parentPub.Attributes, func(auth tpm2.AuthCommand) error {
+		private, public, err = createSealed(rw, parent, auth, opts.KeyAuth, data, template)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("seal error: %w", rcError(err))
+	}
+	if tss.Public, err = tpmutil.Pack(tpmutil.U16Bytes(public)); err != nil {
+		return nil, err
+	}
+	if tss.Private, err = tpmutil.Pack(tpmutil.U16Bytes(private)); err != nil {
+		return nil, err
+	}
+	tss.log().Info("data sealed", "size", len(data), "parent", handleAttr(tss.Parent), "rsaParent", tss.RSAParent)
+	return tss, nil
+}
+
+// createSealed executes TPM2_Create of sealed object with parent authorization session,
+// go-tpm supports sensitive data only with parent password
+func createSealed(rw io.ReadWriter, parent tpmutil.Handle, auth tpm2.AuthCommand, objectAuth string, data []byte, template tpm2.Public) (private, public []byte, err error) {
+	sensitive, err := tpmutil.Pack(tpmutil.U16Bytes(objectAuth), tpmutil.U16Bytes(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	publicBlob, err := template.Encode()
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := runCommand(rw, tpm2.CmdCreate, []tpmutil.Handle{parent}, []tpm2.AuthCommand{auth},
+		tpmutil.U16Bytes(sensitive), tpmutil.U16Bytes(publicBlob), tpmutil.U16Bytes(nil), uint32(0))
+	if err != nil {
+		return nil, nil, err
+	}
+	var outPrivate, outPublic tpmutil.U16Bytes
+	if err = tpmutil.UnpackBuf(bytes.NewBuffer(resp), &outPrivate, &outPublic); err != nil {
+		return nil, nil, fmt.Errorf("decoding create response: %w", err)
+	}
+	return outPrivate, outPublic, nil
+}
+
+// Unseal loads sealed data TSS and returns unsealed data, auth provides authorization value
+// of sealed object and is required when EmptyAuth of TSS is not set. Policy of TSS is satisfied
+// by policy session, ErrPCRMismatch is returned when PCR values don't match its PolicyPCR
+func Unseal(rw io.ReadWriter, tss *TSS, auth AuthFunc) ([]byte, error) {
+	if tss.Type != OIDSealedData {
+		return nil, fmt.Errorf("TSS type %s is not sealed data", tss.Type)
+	}
+	if !tss.EmptyAuth && auth == nil {
+		return nil, fmt.Errorf("%w: sealed data has no empty authorization", ErrAuthRequired)
+	}
+	password, err := auth.resolve()
+	if err != nil {
+		return nil, fmt.Errorf("sealed data authorization error: %w", err)
+	}
+	h, err := tss.LoadKey(rw)
+	if err != nil {
+		return nil, newError(ErrKeyLoad, err)
+	}
+	defer func() {
+		_ = tpm2.FlushContext(rw, h)
+	}()
+	var data []byte
+	err = withObjectAuth(rw, tss, password, func(session tpmutil.Handle, password string) error {
+		data, err = tpm2.UnsealWithSession(rw, session, h, password)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unseal error: %w", rcError(err))
+	}
+	tss.log().Debug("data unsealed", "size", len(data), "handle", handleAttr(h))
+	return data, nil
+}
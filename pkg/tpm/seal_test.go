@@ -0,0 +1,122 @@
+package tpm_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/google/go-tpm-tools/client"
+	"github.com/google/go-tpm/tpm2"
+
+	"github.com/shuvava/tpm/pkg/tpm"
+	"github.com/shuvava/tpm/pkg/tpm/tpmtest"
+)
+
+func TestSeal(t *testing.T) {
+	sim := tpmtest.New(t)
+	const parentHandle = 0x81000080
+	sim.PersistPrimary(tpmtest.RSAParentTemplate, parentHandle)
+	ekTemplate := client.DefaultEKTemplateECC()
+	secret := []byte("disk encryption key")
+
+	tests := []struct {
+		name    string
+		opts    tpm.SealOptions
+		keyAuth string
+	}{
+		{"default", tpm.SealOptions{}, ""},
+		{"RSA parent with auth", tpm.SealOptions{ObjectOptions: tpm.ObjectOptions{RSAParent: true, KeyAuth: "secret"}}, "secret"},
+		{"persistent parent", tpm.SealOptions{ObjectOptions: tpm.ObjectOptions{Parent: parentHandle, Description: "token"}}, ""},
+		{"endorsement key parent", tpm.SealOptions{ObjectOptions: tpm.ObjectOptions{Parent: tpm2.HandleEndorsement, ParentTemplate: &ekTemplate}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw, err := sim.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			tss, err := tpm.Seal(rw, secret, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sim.Handles(tpm2.HandleTypeTransient)) != 0 {
+				t.Error("Seal left transient handles")
+			}
+
+			// sealed data is read back from TSS file by standard parent template search
+			tss, err = tpm.LoadFromFile(sim.TSSFile(tss, "sealed.tss"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tss.Type != tpm.OIDSealedData || tss.EmptyAuth != (tt.keyAuth == "") || tss.Description != tt.opts.Description {
+				t.Errorf("unexpected TSS %+v", tss)
+			}
+			var auth tpm.AuthFunc
+			if tt.keyAuth != "" {
+				if _, err = tpm.Unseal(rw, tss, nil); !errors.Is(err, tpm.ErrAuthRequired) {
+					t.Errorf("expected ErrAuthRequired, got %v", err)
+				}
+				if _, err = tpm.Unseal(rw, tss, tpm.StaticAuth("wrong")); !errors.Is(err, tpm.ErrAuthFailed) {
+					t.Errorf("expected ErrAuthFailed, got %v", err)
+				}
+				auth = tpm.StaticAuth(tt.keyAuth)
+			}
+			data, err := tpm.Unseal(rw, tss, auth)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, secret) {
+				t.Errorf("unsealed %q, want %q", data, secret)
+			}
+			if len(sim.Handles(tpm2.HandleTypeTransient)) != 0 {
+				t.Error("Unseal left transient handles")
+			}
+		})
+	}
+}
+
+func TestSealOptions(t *testing.T) {
+	sim := tpmtest.New(t)
+	rw, err := sim.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := bytes.Repeat([]byte{0xAB}, 32)
+	tss, err := tpm.Seal(rw, []byte{1}, tpm.SealOptions{
+		Attributes: tpm.DefaultSealAttributes | tpm2.FlagNoDA,
+		ObjectOptions: tpm.ObjectOptions{
+			PolicyDigest: policy,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := tss.DecodePublic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub.Type != tpm2.AlgKeyedHash || pub.Attributes&tpm2.FlagNoDA == 0 || !bytes.Equal(pub.AuthPolicy, policy) {
+		t.Errorf("unexpected sealed object public area %+v", pub)
+	}
+
+	for name, tt := range map[string]struct {
+		data []byte
+		opts tpm.SealOptions
+	}{
+		"empty data":     {nil, tpm.SealOptions{}},
+		"too large data": {make([]byte, tpm.MaxSealSize+1), tpm.SealOptions{}},
+		"sign attribute": {[]byte{1}, tpm.SealOptions{Attributes: tpm.DefaultSealAttributes | tpm2.FlagSign}},
+		"missing parent": {[]byte{1}, tpm.SealOptions{ObjectOptions: tpm.ObjectOptions{Parent: 0x81000099}}},
+	} {
+		if _, err = tpm.Seal(rw, tt.data, tt.opts); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	key, err := tpm.CreateKey(rw, tpm.KeyOptions{Algorithm: tpm2.AlgECC})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tpm.Unseal(rw, key, nil); err == nil {
+		t.Error("expected error for signing key")
+	}
+}
@@ -0,0 +1,220 @@
+package tpm
+
+import (
+	"crypto"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// session holds TPM device and loaded key handle shared by all copies of TPM value
+type session struct {
+	mu     sync.Mutex
+	rwc    io.ReadWriteCloser
+	handle tpmutil.Handle
+	pub    *tpm2.Public
+	// owned are transient handles created by session, only they are flushed on release
+	owned []tpmutil.Handle
+	// publicKey and keyPub are cached public key and public area of the TPM key
+	publicKey crypto.PublicKey
+	keyPub    *tpm2.Public
+	// auth is cached authorization value of loaded key
+	auth *string
+
+	// certMu guards certificate reloaded by GetCertificate and GetClientCertificate,
+	// it is separate from mu because certificate load reads TPM public key
+	certMu sync.Mutex
+	cert   *tls.Certificate
+	// certStamp is modification time and size of PublicCertFile when cert was loaded
+	certStamp fileStamp
+}
+
+// withKey runs fn with opened TPM device, loaded key handle and key public area.
+// In KeepOpen mode the device and key handle are reused between calls and the key
+// is reloaded once when TPM reports that handle is not loaded anymore (TPM reset, eviction).
+// Otherwise key is flushed and device is closed when fn returns
+func (t TPM) withKey(fn func(rw io.ReadWriter, kh tpmutil.Handle, pub tpm2.Public) error) error {
+	s := t.session
+	if s == nil {
+		return ErrNotInitialized
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !t.KeepOpen {
+		defer t.release(s)
+	}
+
+	if err := t.acquire(s); err != nil {
+		return err
+	}
+	err := fn(s.rwc, s.handle, *s.pub)
+	if err != nil && t.KeepOpen && isHandleError(err) {
+		t.log().Warn("key handle is not loaded anymore, reloading key", "handle", handleAttr(s.handle), "error", err)
+		t.flushKey(s)
+		if err = t.acquire(s); err != nil {
+			return err
+		}
+		err = fn(s.rwc, s.handle, *s.pub)
+	}
+	return err
+}
+
+// acquire opens TPM device and loads key if they are not opened/loaded yet
+func (t TPM) acquire(s *session) error {
+	if s.rwc == nil {
+		rwc, err := t.open()
+		if err != nil {
+			err = newError(ErrDeviceOpen, err)
+			logError(t.log(), "unable to open TPM device", err, "device", t.deviceAttr())
+			return err
+		}
+		t.log().Debug("TPM device opened", "device", t.deviceAttr())
+		s.rwc = rwc
+	}
+	if s.pub != nil {
+		return nil
+	}
+	kh, flush, err := t.loadKey(s.rwc)
+	if err != nil {
+		err = newError(ErrKeyLoad, err)
+		logError(t.log(), "unable to load key", err)
+		return err
+	}
+	if flush {
+		s.owned = append(s.owned, kh)
+	}
+	pub, name, _, err := tpm2.ReadPublic(s.rwc, kh)
+	if err != nil {
+		t.flushKey(s)
+		err = newError(ErrKeyLoad, fmt.Errorf("unable to read public data from TPM: %w", err))
+		logError(t.log(), "unable to load key", err, "handle", handleAttr(kh))
+		return err
+	}
+	t.log().Debug("key loaded", "handle", handleAttr(kh), "name", fmt.Sprintf("%x", name), "type", pub.Type.String())
+	s.handle, s.pub = kh, &pub
+	return nil
+}
+
+// open returns shared Device or opens TPM device with Opener or by TpmDevice string
+func (t TPM) open() (io.ReadWriteCloser, error) {
+	switch {
+	case t.Device != nil:
+		return sharedDevice{t.Device}, nil
+	case t.Opener != nil:
+		return t.Opener()
+	default:
+		return OpenDevice(t.TpmDevice)
+	}
+}
+
+// loadKey loads key configured in TPM into the device.
+// flush is true when returned handle is transient and must be flushed by caller
+func (t TPM) loadKey(rw io.ReadWriter) (kh tpmutil.Handle, flush bool, err error) {
+	switch {
+	case t.Tss != nil:
+		kh, err = t.Tss.LoadKey(rw)
+		if err != nil {
+			return 0, false, fmt.Errorf("TSS key load error: %w", err)
+		}
+		return kh, true, nil
+	case t.TpmHandleFile != "":
+		khBytes, err := os.ReadFile(t.TpmHandleFile)
+		if err != nil {
+			return 0, false, fmt.Errorf("ContextLoad read file for kh: %w", err)
+		}
+		kh, err = tpm2.ContextLoad(rw, khBytes)
+		if err != nil {
+			return 0, false, fmt.Errorf("ContextLoad for kh: %w", err)
+		}
+		return kh, true, nil
+	case t.TpmHandle != 0:
+		return tpmutil.Handle(t.TpmHandle), false, nil
+	default:
+		return 0, false, ErrNoKey
+	}
+}
+
+// flushKey flushes transient handles owned by session
+func (t TPM) flushKey(s *session) {
+	if s.rwc != nil {
+		for _, h := range s.owned {
+			if err := tpm2.FlushContext(s.rwc, h); err != nil {
+				t.log().Debug("unable to flush handle", "handle", handleAttr(h), "error", err)
+				continue
+			}
+			t.log().Debug("handle flushed", "handle", handleAttr(h))
+		}
+	}
+	s.handle, s.pub, s.owned, s.auth = 0, nil, nil, nil
+}
+
+// keyAuth returns authorization value of the loaded key, KeyAuth is called once per key load.
+// It must be called from withKey callback
+func (t TPM) keyAuth() (string, error) {
+	s := t.session
+	if s.auth == nil {
+		auth, err := t.KeyAuth.resolve()
+		if err != nil {
+			return "", fmt.Errorf("key authorization error: %w", err)
+		}
+		s.auth = &auth
+	}
+	return *s.auth, nil
+}
+
+// release flushes loaded key handle and closes TPM device
+func (t TPM) release(s *session) error {
+	t.flushKey(s)
+	if s.rwc == nil {
+		return nil
+	}
+	err := s.rwc.Close()
+	s.rwc = nil
+	return err
+}
+
+// Close flushes cached key handle and closes TPM device opened in KeepOpen mode
+func (t TPM) Close() error {
+	s := t.session
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return t.release(s)
+}
+
+// Invalidate drops cached public key, TLS certificate and loaded key handle of the TPM instance,
+// the key is reloaded from TPM on next use
+func (t TPM) Invalidate() {
+	s := t.session
+	if s == nil {
+		return
+	}
+	s.certMu.Lock()
+	s.cert = nil
+	s.certMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t.flushKey(s)
+	s.publicKey, s.keyPub = nil, nil
+}
+
+// isHandleError reports whether err means that key handle is not loaded in TPM anymore
+func isHandleError(err error) bool {
+	var hErr tpm2.HandleError
+	if errors.As(err, &hErr) {
+		return hErr.Code == tpm2.RCHandle
+	}
+	var wErr tpm2.Warning
+	if errors.As(err, &wErr) {
+		return wErr.Code == tpm2.RCReferenceH0
+	}
+	return false
+}
@@ -0,0 +1,227 @@
+package tpm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// tlsSignatureSchemes maps TLS signature schemes to TPM signature schemes used to produce them
+var tlsSignatureSchemes = map[tls.SignatureScheme]tpm2.SigScheme{
+	tls.PSSWithSHA256:          {Alg: tpm2.AlgRSAPSS, Hash: tpm2.AlgSHA256},
+	tls.PSSWithSHA384:          {Alg: tpm2.AlgRSAPSS, Hash: tpm2.AlgSHA384},
+	tls.PSSWithSHA512:          {Alg: tpm2.AlgRSAPSS, Hash: tpm2.AlgSHA512},
+	tls.PKCS1WithSHA256:        {Alg: tpm2.AlgRSASSA, Hash: tpm2.AlgSHA256},
+	tls.PKCS1WithSHA384:        {Alg: tpm2.AlgRSASSA, Hash: tpm2.AlgSHA384},
+	tls.PKCS1WithSHA512:        {Alg: tpm2.AlgRSASSA, Hash: tpm2.AlgSHA512},
+	tls.PKCS1WithSHA1:          {Alg: tpm2.AlgRSASSA, Hash: tpm2.AlgSHA1},
+	tls.ECDSAWithP256AndSHA256: {Alg: tpm2.AlgECDSA, Hash: tpm2.AlgSHA256},
+	tls.ECDSAWithP384AndSHA384: {Alg: tpm2.AlgECDSA, Hash: tpm2.AlgSHA384},
+	tls.ECDSAWithP521AndSHA512: {Alg: tpm2.AlgECDSA, Hash: tpm2.AlgSHA512},
+	tls.ECDSAWithSHA1:          {Alg: tpm2.AlgECDSA, Hash: tpm2.AlgSHA1},
+}
+
+// tlsSignatureSchemeOrder is preference order of TLS signature schemes
+var tlsSignatureSchemeOrder = []tls.SignatureScheme{
+	tls.ECDSAWithP256AndSHA256, tls.ECDSAWithP384AndSHA384, tls.ECDSAWithP521AndSHA512,
+	tls.PSSWithSHA256, tls.PSSWithSHA384, tls.PSSWithSHA512,
+	tls.PKCS1WithSHA256, tls.PKCS1WithSHA384, tls.PKCS1WithSHA512,
+	tls.PKCS1WithSHA1, tls.ECDSAWithSHA1,
+}
+
+// TLSConfig returns clone of ExtTLSConfig with TPM certificate provided by GetClientCertificate
+// and GetCertificate callbacks, nil ExtTLSConfig is treated as empty config.
+// Validation errors are reported to Logger, use BuildTLSConfig to get them
+func (t TPM) TLSConfig() *tls.Config {
+	cfg, err := t.BuildTLSConfig()
+	if err != nil {
+		t.log().Error("TLS config is not compatible with TPM key", "error", err)
+		return t.tlsConfig()
+	}
+	return cfg
+}
+
+// BuildTLSConfig returns the same config as TLSConfig after verification that SignatureAlgorithm
+// and ExtTLSConfig TLS versions can be used with the TPM key. Cipher suites aren't verified,
+// in TLS 1.2 they describe server certificate and client key signs only CertificateVerify
+func (t TPM) BuildTLSConfig() (*tls.Config, error) {
+	if err := t.validateTLS(false); err != nil {
+		return nil, err
+	}
+	return t.tlsConfig(), nil
+}
+
+// ServerTLSConfig returns clone of ExtTLSConfig for TLS server presenting TPM certificate with
+// GetCertificate, PublicCertFile is required. Client certificates are required and verified
+// against ExtTLSConfig.ClientCAs when it is set and ClientAuth is not specified.
+// ExtTLSConfig cipher suites must include TLS 1.2 suite authenticated by the TPM key type
+func (t TPM) ServerTLSConfig() (*tls.Config, error) {
+	if t.PublicCertFile == "" {
+		return nil, ErrNoCertificate
+	}
+	if err := t.validateTLS(true); err != nil {
+		return nil, err
+	}
+	if _, err := t.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+	cfg := t.tlsConfig()
+	cfg.GetClientCertificate = nil
+	if cfg.ClientCAs != nil && cfg.ClientAuth == tls.NoClientCert {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// tlsConfig clones ExtTLSConfig and injects certificate callbacks when PublicCertFile is specified
+func (t TPM) tlsConfig() *tls.Config {
+	cfg := &tls.Config{}
+	if t.ExtTLSConfig != nil {
+		cfg = t.ExtTLSConfig.Clone()
+	}
+	if t.PublicCertFile != "" {
+		cfg.GetClientCertificate = t.GetClientCertificate
+		cfg.GetCertificate = t.GetCertificate
+	}
+	return cfg
+}
+
+// validateTLS verifies that TLS handshake can be signed by the TPM key with configured parameters,
+// cipher suites are verified only for server which is authenticated by them
+func (t TPM) validateTLS(server bool) error {
+	key, pub, err := t.keyPublic()
+	if err != nil {
+		return err
+	}
+	sigAlg := t.signatureAlgorithm(pub)
+	def, ok := signatureAlgorithms[sigAlg]
+	if !ok {
+		return fmt.Errorf("tls: unsupported signature algorithm %v", sigAlg)
+	}
+	if _, err = t.validateScheme(pub, &def); err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	schemes := signatureSchemes(pub, key)
+	if len(schemes) == 0 {
+		return fmt.Errorf("tls: key signing scheme can't be used in TLS handshake")
+	}
+
+	ext := t.ExtTLSConfig
+	if ext == nil {
+		ext = &tls.Config{}
+	}
+	if (ext.MaxVersion == 0 || ext.MaxVersion >= tls.VersionTLS13) && !tls13Compatible(key, schemes) {
+		return fmt.Errorf("tls: key signing scheme can't be used with TLS 1.3, set ExtTLSConfig.MaxVersion to TLS 1.2")
+	}
+	if !server || ext.MinVersion >= tls.VersionTLS13 || len(ext.CipherSuites) == 0 {
+		// cipher suites aren't configurable in TLS 1.3
+		return nil
+	}
+	compatible := false
+	for _, id := range ext.CipherSuites {
+		alg, err := cipherSuiteKey(id)
+		if err != nil {
+			return err
+		}
+		compatible = compatible || alg == pub.Type
+	}
+	if !compatible {
+		return fmt.Errorf("tls: none of ExtTLSConfig cipher suites can be used with %v key", pub.Type)
+	}
+	return nil
+}
+
+// signatureSchemes returns TLS signature schemes supported by the key, it is used as
+// tls.Certificate.SupportedSignatureAlgorithms to prevent negotiation of schemes rejected by TPM
+func signatureSchemes(pub tpm2.Public, key crypto.PublicKey) []tls.SignatureScheme {
+	var allowed *tpm2.SigScheme
+	switch key.(type) {
+	case *rsa.PublicKey:
+		if pub.RSAParameters != nil {
+			allowed = pub.RSAParameters.Sign
+		}
+	case *ecdsa.PublicKey:
+		if pub.ECCParameters != nil {
+			allowed = pub.ECCParameters.Sign
+		}
+	default:
+		return nil
+	}
+	var schemes []tls.SignatureScheme
+	for _, scheme := range tlsSignatureSchemeOrder {
+		sigScheme := tlsSignatureSchemes[scheme]
+		if schemeKeyType(sigScheme.Alg) != pub.Type {
+			continue
+		}
+		if allowed != nil && allowed.Alg != tpm2.AlgNull && (allowed.Alg != sigScheme.Alg || allowed.Hash != sigScheme.Hash) {
+			continue
+		}
+		schemes = append(schemes, scheme)
+	}
+	return schemes
+}
+
+// schemeKeyType returns key type of signature algorithm
+func schemeKeyType(alg tpm2.Algorithm) tpm2.Algorithm {
+	if alg == tpm2.AlgECDSA {
+		return tpm2.AlgECC
+	}
+	return tpm2.AlgRSA
+}
+
+// tls13Compatible reports whether schemes contain scheme allowed for the key in TLS 1.3,
+// it requires RSA-PSS for RSA keys and ECDSA with hash matching curve for ECC keys
+func tls13Compatible(key crypto.PublicKey, schemes []tls.SignatureScheme) bool {
+	var want []tls.SignatureScheme
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		want = []tls.SignatureScheme{tls.PSSWithSHA256, tls.PSSWithSHA384, tls.PSSWithSHA512}
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			want = []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256}
+		case elliptic.P384():
+			want = []tls.SignatureScheme{tls.ECDSAWithP384AndSHA384}
+		case elliptic.P521():
+			want = []tls.SignatureScheme{tls.ECDSAWithP521AndSHA512}
+		}
+	}
+	for _, w := range want {
+		for _, s := range schemes {
+			if s == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cipherSuiteKey returns key type required by TLS 1.2 cipher suite, AlgNull is returned
+// for TLS 1.3 suites which don't depend on key type. RSA key exchange suites (TLS_RSA_*)
+// are rejected, they decrypt premaster secret with the key and TPM only signs
+func cipherSuiteKey(id uint16) (tpm2.Algorithm, error) {
+	for _, suites := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+		for _, suite := range suites {
+			if suite.ID != id {
+				continue
+			}
+			switch {
+			case strings.HasPrefix(suite.Name, "TLS_ECDHE_ECDSA_"):
+				return tpm2.AlgECC, nil
+			case strings.HasPrefix(suite.Name, "TLS_ECDHE_RSA_"):
+				return tpm2.AlgRSA, nil
+			case strings.HasPrefix(suite.Name, "TLS_RSA_"):
+				return tpm2.AlgNull, fmt.Errorf("tls: cipher suite %s uses RSA key exchange which requires decryption, TPM key can only sign", suite.Name)
+			default:
+				return tpm2.AlgNull, nil
+			}
+		}
+	}
+	return tpm2.AlgNull, fmt.Errorf("tls: unknown cipher suite 0x%04x", id)
+}
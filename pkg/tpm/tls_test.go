@@ -0,0 +1,238 @@
+package tpm_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+
+	"github.com/shuvava/tpm/pkg/tpm"
+	"github.com/shuvava/tpm/pkg/tpm/tpmtest"
+)
+
+// withScheme returns copy of signing template restricted to signature scheme
+func withScheme(tmpl tpm2.Public, scheme tpm2.SigScheme) tpm2.Public {
+	switch tmpl.Type {
+	case tpm2.AlgRSA:
+		params := *tmpl.RSAParameters
+		params.Sign = &scheme
+		tmpl.RSAParameters = &params
+	case tpm2.AlgECC:
+		params := *tmpl.ECCParameters
+		params.Sign = &scheme
+		tmpl.ECCParameters = &params
+	}
+	return tmpl
+}
+
+func TestTLSConfig(t *testing.T) {
+	sim := tpmtest.New(t)
+	tss := sim.TSSKey(tpm2.HandleOwner, tpmtest.ECCParentTemplate, "", tpmtest.ECCSigningTemplate)
+
+	k := newTPM(t, &tpm.TPM{Tss: tss, Opener: sim.Open, SignatureAlgorithm: x509.ECDSAWithSHA256})
+	cfg, err := k.BuildTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.GetClientCertificate != nil || cfg.GetCertificate != nil {
+		t.Error("certificate callbacks are set without PublicCertFile")
+	}
+
+	ext := &tls.Config{
+		ServerName:         "server.local",
+		NextProtos:         []string{"h2"},
+		InsecureSkipVerify: true,
+		CurvePreferences:   []tls.CurveID{tls.CurveP256},
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+		VerifyPeerCertificate: func([][]byte, [][]*x509.Certificate) error {
+			return nil
+		},
+	}
+	k = newTPM(t, &tpm.TPM{Tss: tss, Opener: sim.Open, SignatureAlgorithm: x509.ECDSAWithSHA256, ExtTLSConfig: ext})
+	k.PublicCertFile = sim.Issue(sim.NewCA(), k.Public(), "client.local", "client.crt")
+	cfg = k.TLSConfig()
+	if cfg == ext {
+		t.Fatal("ExtTLSConfig is not cloned")
+	}
+	if cfg.ServerName != ext.ServerName || len(cfg.NextProtos) != 1 || !cfg.InsecureSkipVerify ||
+		len(cfg.CurvePreferences) != 1 || cfg.ClientSessionCache == nil || cfg.VerifyPeerCertificate == nil {
+		t.Errorf("ExtTLSConfig fields are not preserved: %+v", cfg)
+	}
+	if ext.GetClientCertificate != nil {
+		t.Error("ExtTLSConfig is modified")
+	}
+	cert, err := cfg.GetClientCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.SupportedSignatureAlgorithms) == 0 {
+		t.Error("signature schemes are not limited to TPM key")
+	}
+	for _, scheme := range cert.SupportedSignatureAlgorithms {
+		if scheme != tls.ECDSAWithP256AndSHA256 && scheme != tls.ECDSAWithP384AndSHA384 &&
+			scheme != tls.ECDSAWithP521AndSHA512 && scheme != tls.ECDSAWithSHA1 {
+			t.Errorf("unexpected signature scheme %v for ECC key", scheme)
+		}
+	}
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	sim := tpmtest.New(t)
+	ca := sim.NewCA()
+	k := newTPM(t, &tpm.TPM{
+		Tss:                sim.TSSKey(tpm2.HandleOwner, tpmtest.ECCParentTemplate, "", tpmtest.ECCSigningTemplate),
+		Opener:             sim.Open,
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+		ExtTLSConfig:       &tls.Config{ClientCAs: ca.Pool},
+	})
+	if _, err := k.ServerTLSConfig(); !errors.Is(err, tpm.ErrNoCertificate) {
+		t.Errorf("expected ErrNoCertificate, got %v", err)
+	}
+
+	k.PublicCertFile = sim.Issue(ca, k.Public(), "server.local", "server.crt")
+	cfg, err := k.ServerTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.GetCertificate == nil || cfg.GetClientCertificate != nil {
+		t.Error("server config must provide certificate only with GetCertificate")
+	}
+	if cfg.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("expected client certificate verification, got %v", cfg.ClientAuth)
+	}
+
+	k.ExtTLSConfig = &tls.Config{ClientCAs: ca.Pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	if cfg, err = k.ServerTLSConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Errorf("ClientAuth of ExtTLSConfig is overridden: %v", cfg.ClientAuth)
+	}
+}
+
+func TestTLSConfigValidation(t *testing.T) {
+	sim := tpmtest.New(t)
+	rsaTSS := sim.TSSKey(tpm2.HandleOwner, tpmtest.ECCParentTemplate, "", tpmtest.RSASigningTemplate)
+	eccTSS := sim.TSSKey(tpm2.HandleOwner, tpmtest.ECCParentTemplate, "", tpmtest.ECCSigningTemplate)
+	pkcs1TSS := sim.TSSKey(tpm2.HandleOwner, tpmtest.ECCParentTemplate, "",
+		withScheme(tpmtest.RSASigningTemplate, tpm2.SigScheme{Alg: tpm2.AlgRSASSA, Hash: tpm2.AlgSHA256}))
+
+	// cipher suites describe server certificate, so they are verified only for server
+	tests := []struct {
+		name      string
+		tss       *tpm.TSS
+		alg       x509.SignatureAlgorithm
+		ext       *tls.Config
+		clientErr bool
+		serverErr bool
+	}{
+		{"ECC key", eccTSS, x509.ECDSAWithSHA256, nil, false, false},
+		{"RSA key", rsaTSS, x509.SHA256WithRSAPSS, nil, false, false},
+		{"RSA algorithm with ECC key", eccTSS, x509.SHA256WithRSA, nil, true, true},
+		{"ECDSA algorithm with RSA key", rsaTSS, x509.ECDSAWithSHA256, nil, true, true},
+		{"ECDSA cipher suite", eccTSS, x509.ECDSAWithSHA256,
+			&tls.Config{CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}}, false, false},
+		{"ECDHE RSA cipher suites with ECC key", eccTSS, x509.ECDSAWithSHA256,
+			&tls.Config{CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}}, false, true},
+		{"ECDSA cipher suites with RSA key", rsaTSS, x509.SHA256WithRSA,
+			&tls.Config{CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}}, false, true},
+		{"ECDHE RSA cipher suite", rsaTSS, x509.SHA256WithRSA,
+			&tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}}, false, false},
+		{"RSA key exchange cipher suite", rsaTSS, x509.SHA256WithRSA,
+			&tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_RSA_WITH_AES_128_GCM_SHA256}}, false, true},
+		{"cipher suites ignored by TLS 1.3", eccTSS, x509.ECDSAWithSHA256,
+			&tls.Config{MinVersion: tls.VersionTLS13, CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}}, false, false},
+		{"unknown cipher suite", eccTSS, x509.ECDSAWithSHA256, &tls.Config{CipherSuites: []uint16{0xffff}}, false, true},
+		{"PKCS1 key with TLS 1.3", pkcs1TSS, x509.SHA256WithRSA, nil, true, true},
+		{"PKCS1 key with TLS 1.2", pkcs1TSS, x509.SHA256WithRSA, &tls.Config{MaxVersion: tls.VersionTLS12}, false, false},
+		{"PKCS1 key with PSS algorithm", pkcs1TSS, x509.SHA256WithRSAPSS, &tls.Config{MaxVersion: tls.VersionTLS12}, true, true},
+	}
+	ca := sim.NewCA()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := newTPM(t, &tpm.TPM{Tss: tt.tss, Opener: sim.Open, SignatureAlgorithm: tt.alg, ExtTLSConfig: tt.ext})
+			_, err := k.BuildTLSConfig()
+			if (err != nil) != tt.clientErr {
+				t.Errorf("BuildTLSConfig() error = %v, wantErr %v", err, tt.clientErr)
+			}
+			k.PublicCertFile = sim.Issue(ca, k.Public(), "server.local", "server.crt")
+			_, err = k.ServerTLSConfig()
+			if (err != nil) != tt.serverErr {
+				t.Errorf("ServerTLSConfig() error = %v, wantErr %v", err, tt.serverErr)
+			}
+		})
+	}
+}
+
+func TestTLSHandshake(t *testing.T) {
+	sim := tpmtest.New(t)
+	ca := sim.NewCA()
+	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := tls.LoadX509KeyPair(sim.Issue(ca, serverKey.Public(), "server.local", "server.crt"), sim.KeyFile(serverKey, "server.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		tmpl    tpm2.Public
+		alg     x509.SignatureAlgorithm
+		version uint16
+	}{
+		{"ECC TLS 1.3", tpmtest.ECCSigningTemplate, x509.ECDSAWithSHA256, tls.VersionTLS13},
+		{"ECC TLS 1.2", tpmtest.ECCSigningTemplate, x509.ECDSAWithSHA256, tls.VersionTLS12},
+		{"RSA TLS 1.3", tpmtest.RSASigningTemplate, x509.SHA256WithRSAPSS, tls.VersionTLS13},
+		{"RSA PKCS1 TLS 1.2", withScheme(tpmtest.RSASigningTemplate, tpm2.SigScheme{Alg: tpm2.AlgRSASSA, Hash: tpm2.AlgSHA256}),
+			x509.SHA256WithRSA, tls.VersionTLS12},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := newTPM(t, &tpm.TPM{
+				Tss:                sim.TSSKey(tpm2.HandleOwner, tpmtest.ECCParentTemplate, "", tt.tmpl),
+				Opener:             sim.Open,
+				SignatureAlgorithm: tt.alg,
+				ExtTLSConfig:       &tls.Config{RootCAs: ca.Pool, ServerName: "server.local", MaxVersion: tt.version},
+			})
+			k.PublicCertFile = sim.Issue(ca, k.Public(), "client.local", "client.crt")
+			cfg, err := k.BuildTLSConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			clientConn, serverConn := net.Pipe()
+			server := tls.Server(serverConn, &tls.Config{
+				Certificates: []tls.Certificate{serverCert},
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				ClientCAs:    ca.Pool,
+			})
+			errc := make(chan error, 1)
+			go func() {
+				defer server.Close()
+				_, err := server.Write([]byte("hello"))
+				errc <- err
+			}()
+			client := tls.Client(clientConn, cfg)
+			defer client.Close()
+			if msg, err := io.ReadAll(client); err != nil || string(msg) != "hello" {
+				t.Fatalf("unexpected message %q, error %v", msg, err)
+			}
+			if err = <-errc; err != nil {
+				t.Fatal(err)
+			}
+			state := server.ConnectionState()
+			if state.Version != tt.version || state.PeerCertificates[0].Subject.CommonName != "client.local" {
+				t.Errorf("unexpected connection state: version 0x%x, peer %v", state.Version, state.PeerCertificates[0].Subject)
+			}
+		})
+	}
+}
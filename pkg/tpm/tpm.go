@@ -2,32 +2,51 @@ package tpm
 
 import (
 	"crypto"
+	"crypto/ecdsa"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/pem"
+	"encoding/asn1"
 	"fmt"
 	"github.com/google/go-tpm-tools/client"
 	"io"
-	"os"
-	"sync"
+	"math/big"
+	"time"
 
 	"github.com/google/go-tpm/tpm2"
 	"github.com/google/go-tpm/tpmutil"
 )
 
 var (
-	x509Certificate x509.Certificate
-	publicKey       crypto.PublicKey
-
 	handleNames = map[string][]tpm2.HandleType{
 		"all":       {tpm2.HandleTypeLoadedSession, tpm2.HandleTypeSavedSession, tpm2.HandleTypeTransient},
 		"loaded":    {tpm2.HandleTypeLoadedSession},
 		"saved":     {tpm2.HandleTypeSavedSession},
 		"transient": {tpm2.HandleTypeTransient},
 	}
+
+	// signatureAlgorithms maps supported x509 signature algorithms to TPM signature schemes
+	signatureAlgorithms = map[x509.SignatureAlgorithm]tpm2.SigScheme{
+		x509.SHA256WithRSA:    {Alg: tpm2.AlgRSASSA, Hash: tpm2.AlgSHA256},
+		x509.SHA256WithRSAPSS: {Alg: tpm2.AlgRSAPSS, Hash: tpm2.AlgSHA256},
+		x509.ECDSAWithSHA256:  {Alg: tpm2.AlgECDSA, Hash: tpm2.AlgSHA256},
+		x509.ECDSAWithSHA384:  {Alg: tpm2.AlgECDSA, Hash: tpm2.AlgSHA384},
+	}
+
+	// hashAlgorithms maps crypto.Hash values passed in crypto.SignerOpts to TPM hash algorithms
+	hashAlgorithms = map[crypto.Hash]tpm2.Algorithm{
+		crypto.SHA1:   tpm2.AlgSHA1,
+		crypto.SHA256: tpm2.AlgSHA256,
+		crypto.SHA384: tpm2.AlgSHA384,
+		crypto.SHA512: tpm2.AlgSHA512,
+	}
 )
 
+// ecdsaSignature is ASN.1 DER structure of ECDSA signature expected by crypto/tls and crypto/x509
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
 // TPM is mediator for interaction of http.Client code with TPM module
 type TPM struct {
 	crypto.Signer
@@ -36,219 +55,301 @@ type TPM struct {
 	TpmHandleFile string
 	TpmHandle     uint32
 
-	TpmDevice          string
+	// TpmDevice is path or URI-style string of TPM device, see OpenDevice
+	TpmDevice string
+	// Opener opens TPM device, TpmDevice is opened with OpenDevice when it is nil
+	Opener func() (io.ReadWriteCloser, error)
+	// Device is TPM connection shared with other code, it takes precedence over Opener and TpmDevice.
+	// It is never closed by TPM and callers must serialize its use by other code
+	Device io.ReadWriter
+	// SignatureAlgorithm is signature scheme used by Sign with nil opts and validated by BuildTLSConfig,
+	// it defaults to SHA256WithRSA (SHA256WithRSAPSS for keys restricted to RSA-PSS) for RSA keys
+	// and ECDSA with curve size hash for ECC keys
 	SignatureAlgorithm x509.SignatureAlgorithm
-	refreshMutex       sync.Mutex
 	PublicCertFile     string
 	ExtTLSConfig       *tls.Config
+	// KeepOpen keeps TPM device open and key loaded between Public and Sign calls,
+	// Close must be called to release them
+	KeepOpen bool
+	// KeyAuth provides authorization value of the key used by Sign, nil means empty authorization.
+	// It is required for TSS keys with EmptyAuth set to false
+	KeyAuth AuthFunc
+	// FlushHandles is opt-in cleanup policy of NewTPMCrypto, it flushes handles of given type
+	// ("all", "loaded", "saved" or "transient") created by any TPM user.
+	// By default only handles created by the TPM instance itself are flushed
+	FlushHandles string
+	// Logger receives structured events (device open, key load, sign, flush) and errors of Public
+	// and TLSCertificate which can't return them. Records are discarded when it is nil.
+	// TSS key without own Logger uses this one
+	Logger Logger
+
+	session *session
 }
 
-// NewTPMCrypto creates new tpm.TPM
+// NewTPMCrypto creates new tpm.TPM. When SignatureAlgorithm is not set it is derived from
+// the key public area on use, see signatureAlgorithm
 func NewTPMCrypto(conf *TPM) (TPM, error) {
 
-	if conf.SignatureAlgorithm == x509.UnknownSignatureAlgorithm {
-		conf.SignatureAlgorithm = x509.SHA256WithRSA
+	_, ok := signatureAlgorithms[conf.SignatureAlgorithm]
+	if !ok && conf.SignatureAlgorithm != x509.UnknownSignatureAlgorithm {
+		return TPM{}, fmt.Errorf("signatureAlgorithm must be one of x509.SHA256WithRSA, x509.SHA256WithRSAPSS, x509.ECDSAWithSHA256 or x509.ECDSAWithSHA384")
 	}
-	if (conf.SignatureAlgorithm != x509.SHA256WithRSA) && (conf.SignatureAlgorithm != x509.SHA256WithRSAPSS) {
-		return TPM{}, fmt.Errorf("signatureALgorithm must be either x509.SHA256WithRSA or x509.SHA256WithRSAPSS")
+	if _, ok := handleNames[conf.FlushHandles]; conf.FlushHandles != "" && !ok {
+		return TPM{}, fmt.Errorf("flushHandles must be one of all, loaded, saved or transient")
 	}
 
 	var err error
-	rwc, err := tpm2.OpenTPM(conf.TpmDevice)
+	rwc, err := conf.open()
 	if err != nil {
-		return TPM{}, fmt.Errorf("google: Public: Unable to Open TPM: %v", err)
+		return TPM{}, newError(ErrDeviceOpen, err)
+	}
+	conf.log().Debug("TPM device opened", "device", conf.deviceAttr())
+	conf.session = &session{}
+	if conf.Tss != nil && conf.Tss.Logger == nil {
+		conf.Tss.Logger = conf.Logger
+	}
+	if conf.KeepOpen {
+		conf.session.rwc = rwc
+	} else {
+		defer rwc.Close()
 	}
-	defer rwc.Close()
 
 	// cleanup transient data from TPM
-	for _, handleType := range handleNames["all"] {
+	for _, handleType := range handleNames[conf.FlushHandles] {
 		handles, err := client.Handles(rwc, handleType)
 		if err != nil {
-			return TPM{}, fmt.Errorf("error getting handles")
+			_ = conf.Close()
+			return TPM{}, fmt.Errorf("error getting handles: %w", rcError(err))
 		}
 		for _, handle := range handles {
 			if err = tpm2.FlushContext(rwc, handle); err != nil {
-				return TPM{}, fmt.Errorf("error flushing 0x%x: %v", handle, err)
+				_ = conf.Close()
+				return TPM{}, fmt.Errorf("error flushing 0x%x: %w", handle, rcError(err))
 			}
+			conf.log().Info("handle flushed", "handle", handleAttr(handle), "policy", conf.FlushHandles)
 		}
 	}
 
 	if conf.TpmHandleFile == "" && conf.TpmHandle == 0 && conf.Tss == nil {
-		return TPM{}, fmt.Errorf("at most one of key handler must be specified")
+		_ = conf.Close()
+		return TPM{}, ErrNoKey
+	}
+	if conf.Tss != nil && !conf.Tss.EmptyAuth && conf.KeyAuth == nil {
+		_ = conf.Close()
+		return TPM{}, fmt.Errorf("%w: TSS key has no empty authorization and KeyAuth is not specified", ErrAuthRequired)
 	}
 	if conf.ExtTLSConfig != nil {
 		if len(conf.ExtTLSConfig.Certificates) > 0 {
+			_ = conf.Close()
 			return TPM{}, fmt.Errorf("certificates value in ExtTLSConfig Ignored")
 		}
 
-		if len(conf.ExtTLSConfig.CipherSuites) > 0 {
-			return TPM{}, fmt.Errorf("cipherSuites value in ExtTLSConfig Ignored")
+		if conf.ExtTLSConfig.GetCertificate != nil || conf.ExtTLSConfig.GetClientCertificate != nil {
+			_ = conf.Close()
+			return TPM{}, fmt.Errorf("getCertificate and getClientCertificate values in ExtTLSConfig Ignored")
 		}
 	}
 	return *conf, nil
 }
 
-// Public extract public key from TPM
-func (t TPM) Public() crypto.PublicKey {
-	if publicKey == nil {
-		t.refreshMutex.Lock()
-		defer t.refreshMutex.Unlock()
-
-		var err error
-		var kh tpmutil.Handle
-		rwc, err := tpm2.OpenTPM(t.TpmDevice)
-		if err != nil {
-			fmt.Printf(": Public: Unable to Open TPM: %v\n", err)
-			return nil
-		}
-		defer rwc.Close()
-
-		if t.Tss != nil {
-			kh, err = t.Tss.LoadKey(rwc)
-			if err != nil {
-				fmt.Printf("public: TSS key load error: %v\n", err)
-				return nil
-			}
-		} else if t.TpmHandleFile != "" {
-			khBytes, err := os.ReadFile(t.TpmHandleFile)
-			if err != nil {
-				fmt.Printf("public1: ContextLoad read file for kh: %v\n", err)
-				return nil
-			}
-			kh, err = tpm2.ContextLoad(rwc, khBytes)
-			if err != nil {
-				fmt.Printf("public2: ContextLoad read file for kh: %v\n", err)
-				return nil
-			}
-		} else if t.TpmHandle != 0 {
-			kh = tpmutil.Handle(t.TpmHandle)
-		} else {
-			fmt.Println("public: both tpmHandlefile and tpmhandle are null")
-			return nil
-		}
-		defer tpm2.FlushContext(rwc, kh)
-
-		pub, _, _, err := tpm2.ReadPublic(rwc, kh)
-		if err != nil {
-			fmt.Printf("google: Unable to Read Public data from TPM: %v", err)
-			return nil
+// signatureAlgorithm returns SignatureAlgorithm or the default matching key type and curve of
+// the public area: ECDSAWithSHA384 for P-384 keys, ECDSAWithSHA256 for other ECC keys,
+// SHA256WithRSAPSS for RSA keys restricted to RSA-PSS and SHA256WithRSA for other RSA keys
+func (t TPM) signatureAlgorithm(pub tpm2.Public) x509.SignatureAlgorithm {
+	if t.SignatureAlgorithm != x509.UnknownSignatureAlgorithm {
+		return t.SignatureAlgorithm
+	}
+	if pub.Type != tpm2.AlgECC {
+		if pub.RSAParameters != nil && pub.RSAParameters.Sign != nil && pub.RSAParameters.Sign.Alg == tpm2.AlgRSAPSS {
+			return x509.SHA256WithRSAPSS
 		}
-		tpm2.FlushContext(rwc, kh)
+		return x509.SHA256WithRSA
+	}
+	if pub.ECCParameters != nil && pub.ECCParameters.CurveID == tpm2.CurveNISTP384 {
+		return x509.ECDSAWithSHA384
+	}
+	return x509.ECDSAWithSHA256
+}
 
-		pubKey, err := pub.Key()
-		if err != nil {
-			fmt.Printf("google: Unable to Read Public data from TPM: %v", err)
-			return nil
-		}
-		publicKey = pubKey.(*rsa.PublicKey)
+// Public extract public key from TPM, errors are reported to Logger and nil is returned.
+// Use PublicKey to get the error
+func (t TPM) Public() crypto.PublicKey {
+	pub, err := t.PublicKey()
+	if err != nil {
+		t.log().Error("unable to read public key from TPM", "error", err)
+		return nil
 	}
-	return publicKey
+	return pub
 }
 
-// Sign sings digest with using private key from TPM
-func (t TPM) Sign(rr io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
-	t.refreshMutex.Lock()
-	defer t.refreshMutex.Unlock()
+// PublicKey extract public key from TPM, the key is cached per TPM instance
+func (t TPM) PublicKey() (crypto.PublicKey, error) {
+	pubKey, _, err := t.keyPublic()
+	return pubKey, err
+}
 
-	var err error
-	var kh tpmutil.Handle
-	rwc, err := tpm2.OpenTPM(t.TpmDevice)
+// keyPublic returns public key and public area of the TPM key, they are cached per TPM instance
+func (t TPM) keyPublic() (crypto.PublicKey, tpm2.Public, error) {
+	s := t.session
+	if s == nil {
+		return nil, tpm2.Public{}, ErrNotInitialized
+	}
+	s.mu.Lock()
+	cached, cachedPub := s.publicKey, s.keyPub
+	s.mu.Unlock()
+	if cached != nil {
+		return cached, *cachedPub, nil
+	}
+
+	var (
+		pubKey crypto.PublicKey
+		keyPub tpm2.Public
+	)
+	err := t.withKey(func(_ io.ReadWriter, _ tpmutil.Handle, pub tpm2.Public) error {
+		var err error
+		pubKey, err = pub.Key()
+		keyPub = pub
+		return err
+	})
 	if err != nil {
-		return []byte(""), fmt.Errorf("google: Public: Unable to Open TPM: %v", err)
+		return nil, tpm2.Public{}, err
+	}
+	switch pubKey.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, tpm2.Public{}, fmt.Errorf("%w %T", ErrUnsupportedKey, pubKey)
 	}
-	defer rwc.Close()
+	s.mu.Lock()
+	s.publicKey, s.keyPub = pubKey, &keyPub
+	s.mu.Unlock()
+	return pubKey, keyPub, nil
+}
 
-	if t.Tss != nil {
-		kh, err = t.Tss.LoadKey(rwc)
-		if err != nil {
-			fmt.Printf("public: TSS key load error: %v\n", err)
-			return []byte(""), fmt.Errorf("sign: TSS key load error: %v\n", err)
-		}
-	} else if t.TpmHandleFile != "" {
-		khBytes, err := os.ReadFile(t.TpmHandleFile)
+// Sign sings digest with using private key from TPM.
+// Policy of TSS key is satisfied by policy session, ErrPCRMismatch is returned when PCR values
+// don't match its PolicyPCR
+func (t TPM) Sign(rr io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var signed *tpm2.Signature
+	start := time.Now()
+	err := t.withKey(func(rw io.ReadWriter, kh tpmutil.Handle, pub tpm2.Public) error {
+		scheme, err := t.sigScheme(pub, digest, opts)
 		if err != nil {
-			fmt.Printf("sign: ContextLoad read file for kh: %v\n", err)
-			return []byte(""), fmt.Errorf(" sign: ContextLoad read file for kh: %v", err)
+			return err
 		}
-		kh, err = tpm2.ContextLoad(rwc, khBytes)
+		auth, err := t.keyAuth()
 		if err != nil {
-			fmt.Printf("sign: ContextLoad read file for kh: %v\n", err)
-			return []byte(""), fmt.Errorf("sign: ContextLoad read file for kh:: %v", err)
+			return err
 		}
-	} else if t.TpmHandle != 0 {
-		kh = tpmutil.Handle(t.TpmHandle)
-	} else {
-		fmt.Println("sign: both tpmHandlefile and tpmhandle are null")
-		return []byte(""), fmt.Errorf("sign: both tpmHandlefile and tpmhandle are null")
-	}
-	defer tpm2.FlushContext(rwc, kh)
-	var signed *tpm2.Signature
-
-	if t.SignatureAlgorithm == x509.SHA256WithRSA {
-		signed, err = tpm2.Sign(rwc, kh, "", digest[:], nil, &tpm2.SigScheme{
-			Alg:  tpm2.AlgRSASSA,
-			Hash: tpm2.AlgSHA256,
+		err = withObjectAuth(rw, t.Tss, auth, func(session tpmutil.Handle, password string) error {
+			signed, err = tpm2.SignWithSession(rw, session, kh, password, digest[:], nil, scheme)
+			return err
 		})
-	} else {
-		signed, err = tpm2.Sign(rwc, kh, "", digest[:], nil, &tpm2.SigScheme{
-			Alg:  tpm2.AlgRSAPSS,
-			Hash: tpm2.AlgSHA256,
-		})
-	}
-	tpm2.FlushContext(rwc, kh)
+		if err == nil {
+			t.log().Debug("digest signed", "handle", handleAttr(kh), "scheme", scheme.Alg.String(),
+				"hash", scheme.Hash.String(), "duration", time.Since(start))
+		}
+		return err
+	})
 	if err != nil {
-		fmt.Printf("Failed to sign: %v", err)
-		return []byte(""), fmt.Errorf("sign:  Failed to sign %v", err)
+		err = fmt.Errorf("sign: failed to sign: %w", rcError(err))
+		logError(t.log(), "unable to sign digest", err)
+		return nil, err
 	}
 
-	return signed.RSA.Signature, nil
+	return encodeSignature(signed)
 
 }
 
-func (t TPM) TLSCertificate() tls.Certificate {
-
-	if t.PublicCertFile == "" {
-		fmt.Printf("Public X509 certificate not specified")
-		return tls.Certificate{}
+// sigScheme builds TPM signature scheme for a single Sign call.
+// Hash algorithm is taken from opts (SignatureAlgorithm is used when opts is nil),
+// RSAPSS is used for RSA keys when opts is *rsa.PSSOptions and RSASSA otherwise.
+// The result is verified against key type and signing scheme from the key public area
+func (t TPM) sigScheme(pub tpm2.Public, digest []byte, opts crypto.SignerOpts) (*tpm2.SigScheme, error) {
+	sigAlg := t.signatureAlgorithm(pub)
+	def, ok := signatureAlgorithms[sigAlg]
+	if !ok {
+		return nil, fmt.Errorf("sign: unsupported signature algorithm %v", sigAlg)
+	}
+	if opts == nil {
+		hash, err := def.Hash.Hash()
+		if err != nil {
+			return nil, fmt.Errorf("sign: %w", err)
+		}
+		if len(digest) != hash.Size() {
+			return nil, fmt.Errorf("sign: digest length %d doesn't match %v signature algorithm", len(digest), sigAlg)
+		}
+		return t.validateScheme(pub, &def)
 	}
 
-	pubPEM, err := os.ReadFile(t.PublicCertFile)
-	if err != nil {
-		fmt.Printf("Unable to read keys %v", err)
-		return tls.Certificate{}
+	hash := opts.HashFunc()
+	hashAlg, ok := hashAlgorithms[hash]
+	if !ok {
+		return nil, fmt.Errorf("sign: unsupported hash function %v", hash)
 	}
-	block, _ := pem.Decode([]byte(pubPEM))
-	if block == nil {
-		fmt.Printf("failed to parse PEM block containing the public key")
-		return tls.Certificate{}
+	if len(digest) != hash.Size() {
+		return nil, fmt.Errorf("sign: digest length %d doesn't match hash function %v", len(digest), hash)
 	}
-	pub, err := x509.ParseCertificate(block.Bytes)
-	if err != nil {
-		fmt.Printf("failed to parse public key: " + err.Error())
-		return tls.Certificate{}
+	scheme := &tpm2.SigScheme{Hash: hashAlg}
+	switch pub.Type {
+	case tpm2.AlgRSA:
+		scheme.Alg = tpm2.AlgRSASSA
+		if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
+			// TPM always uses salt length equal to digest size
+			switch pssOpts.SaltLength {
+			case rsa.PSSSaltLengthAuto, rsa.PSSSaltLengthEqualsHash, hash.Size():
+			default:
+				return nil, fmt.Errorf("sign: unsupported PSS salt length %d, TPM uses salt length equal to hash size", pssOpts.SaltLength)
+			}
+			scheme.Alg = tpm2.AlgRSAPSS
+		}
+	case tpm2.AlgECC:
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			return nil, fmt.Errorf("sign: PSS options can't be used with ECC key")
+		}
+		scheme.Alg = tpm2.AlgECDSA
 	}
+	return t.validateScheme(pub, scheme)
+}
 
-	x509Certificate = *pub
-	var privKey crypto.PrivateKey
-	privKey = t
-	return tls.Certificate{
-		PrivateKey:  privKey,
-		Leaf:        &x509Certificate,
-		Certificate: [][]byte{x509Certificate.Raw},
+// validateScheme verifies signature scheme against key type and scheme allowed by the key public area
+func (t TPM) validateScheme(pub tpm2.Public, scheme *tpm2.SigScheme) (*tpm2.SigScheme, error) {
+	var allowed *tpm2.SigScheme
+	switch pub.Type {
+	case tpm2.AlgRSA:
+		if scheme.Alg == tpm2.AlgECDSA {
+			return nil, fmt.Errorf("sign: signature algorithm %v can't be used with RSA key", t.signatureAlgorithm(pub))
+		}
+		if pub.RSAParameters != nil {
+			allowed = pub.RSAParameters.Sign
+		}
+	case tpm2.AlgECC:
+		if scheme.Alg != tpm2.AlgECDSA {
+			return nil, fmt.Errorf("sign: signature algorithm %v can't be used with ECC key", t.signatureAlgorithm(pub))
+		}
+		if pub.ECCParameters != nil {
+			allowed = pub.ECCParameters.Sign
+		}
+	default:
+		return nil, fmt.Errorf("sign: unsupported key type %v", pub.Type)
 	}
+	if allowed == nil || allowed.Alg == tpm2.AlgNull {
+		return scheme, nil
+	}
+	if allowed.Alg != scheme.Alg || allowed.Hash != scheme.Hash {
+		return nil, fmt.Errorf("sign: key allows only %v/%v signature scheme, requested %v/%v",
+			allowed.Alg, allowed.Hash, scheme.Alg, scheme.Hash)
+	}
+	return scheme, nil
 }
 
-func (t TPM) TLSConfig() *tls.Config {
-
-	return &tls.Config{
-		Certificates: []tls.Certificate{t.TLSCertificate()},
-
-		RootCAs:      t.ExtTLSConfig.RootCAs,
-		ClientCAs:    t.ExtTLSConfig.ClientCAs,
-		ClientAuth:   t.ExtTLSConfig.ClientAuth,
-		ServerName:   t.ExtTLSConfig.ServerName,
-		CipherSuites: t.ExtTLSConfig.CipherSuites,
-		MaxVersion:   t.ExtTLSConfig.MaxVersion,
-		MinVersion:   t.ExtTLSConfig.MinVersion,
+// encodeSignature converts TPM signature into format expected by crypto.Signer callers
+func encodeSignature(sig *tpm2.Signature) ([]byte, error) {
+	switch sig.Alg {
+	case tpm2.AlgRSASSA, tpm2.AlgRSAPSS:
+		return sig.RSA.Signature, nil
+	case tpm2.AlgECDSA:
+		return asn1.Marshal(ecdsaSignature{R: sig.ECC.R, S: sig.ECC.S})
+	default:
+		return nil, fmt.Errorf("sign: unsupported signature algorithm %v", sig.Alg)
 	}
 }
@@ -0,0 +1,501 @@
+package tpm_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+
+	"github.com/shuvava/tpm/pkg/tpm"
+	"github.com/shuvava/tpm/pkg/tpm/tpmtest"
+)
+
+func newTPM(t *testing.T, conf *tpm.TPM) tpm.TPM {
+	t.Helper()
+	k, err := tpm.NewTPMCrypto(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = k.Close()
+	})
+	return k
+}
+
+func verify(t *testing.T, pub crypto.PublicKey, digest, sig []byte, opts crypto.SignerOpts) {
+	t.Helper()
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		var err error
+		if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
+			err = rsa.VerifyPSS(pub, opts.HashFunc(), digest, sig, pssOpts)
+		} else {
+			err = rsa.VerifyPKCS1v15(pub, opts.HashFunc(), digest, sig)
+		}
+		if err != nil {
+			t.Errorf("signature verification failed: %v", err)
+		}
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest, sig) {
+			t.Error("signature verification failed")
+		}
+	default:
+		t.Fatalf("unexpected public key type %T", pub)
+	}
+}
+
+func TestNewTPMCryptoValidation(t *testing.T) {
+	sim := tpmtest.New(t)
+	tests := []struct {
+		name string
+		conf tpm.TPM
+	}{
+		{"no key", tpm.TPM{}},
+		{"unsupported signature algorithm", tpm.TPM{TpmHandle: 0x81000001, SignatureAlgorithm: x509.SHA1WithRSA}},
+		{"unknown flush policy", tpm.TPM{TpmHandle: 0x81000001, FlushHandles: "everything"}},
+		{"auth required", tpm.TPM{Tss: &tpm.TSS{EmptyAuth: false}}},
+		{"certificates in TLS config", tpm.TPM{TpmHandle: 0x81000001, ExtTLSConfig: &tls.Config{Certificates: []tls.Certificate{{}}}}},
+		{"certificate callback in TLS config", tpm.TPM{TpmHandle: 0x81000001, ExtTLSConfig: &tls.Config{
+			GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return nil, nil }}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := tt.conf
+			conf.Opener = sim.Open
+			if _, err := tpm.NewTPMCrypto(&conf); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestSign(t *testing.T) {
+	sim := tpmtest.New(t)
+	rsaTSS := sim.TSSKey(tpm2.HandleOwner, tpmtest.ECCParentTemplate, "", tpmtest.RSASigningTemplate)
+	eccTSS := sim.TSSKey(tpm2.HandleOwner, tpmtest.ECCParentTemplate, "", tpmtest.ECCSigningTemplate)
+	sum256 := sha256.Sum256([]byte("data"))
+	sum384 := sha512.Sum384([]byte("data"))
+
+	tests := []struct {
+		name   string
+		tss    *tpm.TSS
+		alg    x509.SignatureAlgorithm
+		digest []byte
+		opts   crypto.SignerOpts
+	}{
+		{"RSA PKCS1v15 SHA256", rsaTSS, x509.SHA256WithRSA, sum256[:], crypto.SHA256},
+		{"RSA PKCS1v15 SHA384", rsaTSS, x509.SHA256WithRSA, sum384[:], crypto.SHA384},
+		{"RSA PSS", rsaTSS, x509.SHA256WithRSAPSS, sum256[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}},
+		{"RSA PSS SHA384", rsaTSS, x509.SHA256WithRSAPSS, sum384[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto, Hash: crypto.SHA384}},
+		{"ECDSA SHA256", eccTSS, x509.ECDSAWithSHA256, sum256[:], crypto.SHA256},
+		{"ECDSA SHA384", eccTSS, x509.ECDSAWithSHA384, sum384[:], crypto.SHA384},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := newTPM(t, &tpm.TPM{Tss: tt.tss, Opener: sim.Open, SignatureAlgorithm: tt.alg})
+			pub := k.Public()
+			if pub == nil {
+				t.Fatal("public key is nil")
+			}
+			sig, err := k.Sign(rand.Reader, tt.digest, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			verify(t, pub, tt.digest, sig, tt.opts)
+		})
+	}
+}
+
+func TestDefaultSignatureAlgorithm(t *testing.T) {
+	sim := tpmtest.New(t)
+	p384 := tpmtest.ECCSigningTemplate
+	p384.ECCParameters = &tpm2.ECCParams{Sign: &tpm2.SigScheme{Alg: tpm2.AlgNull}, CurveID: tpm2.CurveNISTP384}
+	sum256 := sha256.Sum256([]byte("data"))
+	sum384 := sha512.Sum384([]byte("data"))
+
+	tests := []struct {
+		name     string
+		template tpm2.Public
+		digest   []byte
+		opts     crypto.SignerOpts
+	}{
+		{"RSA", tpmtest.RSASigningTemplate, sum256[:], crypto.SHA256},
+		{"RSA-PSS", withScheme(tpmtest.RSASigningTemplate, tpm2.SigScheme{Alg: tpm2.AlgRSAPSS, Hash: tpm2.AlgSHA256}), sum256[:], &rsa.PSSOptions{Hash: crypto.SHA256}},
+		{"ECC P-256", tpmtest.ECCSigningTemplate, sum256[:], crypto.SHA256},
+		{"ECC P-384", p384, sum384[:], crypto.SHA384},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tss := sim.TSSKey(tpm2.HandleOwner, tpmtest.ECCParentTemplate, "", tt.template)
+			k := newTPM(t, &tpm.TPM{Tss: tss, Opener: sim.Open})
+			// nil opts use signature algorithm derived from the key
+			sig, err := k.Sign(rand.Reader, tt.digest, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			verify(t, k.Public(), tt.digest, sig, tt.opts)
+			if _, err = k.BuildTLSConfig(); err != nil {
+				t.Errorf("BuildTLSConfig() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestSignErrors(t *testing.T) {
+	sim := tpmtest.New(t)
+	eccTSS := sim.TSSKey(tpm2.HandleOwner, tpmtest.ECCParentTemplate, "", tpmtest.ECCSigningTemplate)
+	rsaTSS := sim.TSSKey(tpm2.HandleOwner, tpmtest.ECCParentTemplate, "", tpmtest.RSASigningTemplate)
+	sum := sha256.Sum256([]byte("data"))
+
+	tests := []struct {
+		name   string
+		tss    *tpm.TSS
+		digest []byte
+		opts   crypto.SignerOpts
+	}{
+		{"digest length mismatch", eccTSS, sum[:20], crypto.SHA256},
+		{"digest length mismatch without opts", eccTSS, sum[:20], nil},
+		{"unsupported hash", eccTSS, sum[:], crypto.MD5},
+		{"PSS with ECC key", eccTSS, sum[:], &rsa.PSSOptions{Hash: crypto.SHA256}},
+		{"PSS salt length", rsaTSS, sum[:], &rsa.PSSOptions{SaltLength: 10, Hash: crypto.SHA256}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := newTPM(t, &tpm.TPM{Tss: tt.tss, Opener: sim.Open})
+			_, err := k.Sign(rand.Reader, tt.digest, tt.opts)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			// invalid arguments are rejected before reaching TPM
+			var rcErr *tpm.RCError
+			if errors.As(err, &rcErr) {
+				t.Errorf("expected validation error, got TPM error %v", err)
+			}
+		})
+	}
+}
+
+func TestSignHandleAndContextFile(t *testing.T) {
+	sim := tpmtest.New(t)
+	const handle = 0x81000020
+	sim.PersistKey(tpmtest.RSASigningTemplate, "secret", handle)
+	ctxFile := sim.ContextFile(tpmtest.ECCSigningTemplate, "key.ctx")
+	sum := sha256.Sum256([]byte("data"))
+
+	tests := []struct {
+		name string
+		conf tpm.TPM
+	}{
+		{"persistent handle with auth", tpm.TPM{TpmHandle: handle, KeyAuth: tpm.StaticAuth("secret")}},
+		{"context file", tpm.TPM{TpmHandleFile: ctxFile, SignatureAlgorithm: x509.ECDSAWithSHA256}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := tt.conf
+			conf.Opener = sim.Open
+			k := newTPM(t, &conf)
+			sig, err := k.Sign(rand.Reader, sum[:], crypto.SHA256)
+			if err != nil {
+				t.Fatal(err)
+			}
+			verify(t, k.Public(), sum[:], sig, crypto.SHA256)
+		})
+	}
+
+	k := newTPM(t, &tpm.TPM{TpmHandle: handle, KeyAuth: tpm.StaticAuth("wrong"), Opener: sim.Open})
+	_, err := k.Sign(rand.Reader, sum[:], crypto.SHA256)
+	if !errors.Is(err, tpm.ErrAuthFailed) {
+		t.Errorf("expected authorization error, got %v", err)
+	}
+	var rcErr *tpm.RCError
+	if !errors.As(err, &rcErr) || rcErr.Name != "TPM_RC_AUTH_FAIL" {
+		t.Errorf("expected TPM_RC_AUTH_FAIL response code, got %v", err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	sim := tpmtest.New(t)
+	tests := []struct {
+		name string
+		conf tpm.TPM
+		want error
+	}{
+		{"no key", tpm.TPM{Opener: sim.Open}, tpm.ErrNoKey},
+		{"auth required", tpm.TPM{Tss: &tpm.TSS{}, Opener: sim.Open}, tpm.ErrAuthRequired},
+		{"device open", tpm.TPM{TpmHandle: 0x81000001, TpmDevice: filepath.Join(sim.Dir, "tpm0")}, tpm.ErrDeviceOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := tt.conf
+			if _, err := tpm.NewTPMCrypto(&conf); !errors.Is(err, tt.want) {
+				t.Errorf("got error %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	k := newTPM(t, &tpm.TPM{TpmHandle: 0x81000001, Opener: sim.Open})
+	if _, err := k.PublicKey(); !errors.Is(err, tpm.ErrKeyLoad) {
+		t.Errorf("got error %v, want %v", err, tpm.ErrKeyLoad)
+	}
+	if k.Public() != nil {
+		t.Error("expected nil public key")
+	}
+	if _, err := k.Certificate(); !errors.Is(err, tpm.ErrNoCertificate) {
+		t.Errorf("got error %v, want %v", err, tpm.ErrNoCertificate)
+	}
+	if _, err := (tpm.TPM{}).PublicKey(); !errors.Is(err, tpm.ErrNotInitialized) {
+		t.Errorf("got error %v, want %v", err, tpm.ErrNotInitialized)
+	}
+}
+
+func TestKeepOpen(t *testing.T) {
+	sim := tpmtest.New(t)
+	tss := sim.TSSKey(tpm2.HandleOwner, tpmtest.ECCParentTemplate, "", tpmtest.ECCSigningTemplate)
+	k := newTPM(t, &tpm.TPM{Tss: tss, Opener: sim.Open, KeepOpen: true, SignatureAlgorithm: x509.ECDSAWithSHA256})
+	sum := sha256.Sum256([]byte("data"))
+
+	if _, err := k.Sign(rand.Reader, sum[:], crypto.SHA256); err != nil {
+		t.Fatal(err)
+	}
+	if got := sim.Handles(tpm2.HandleTypeTransient); len(got) != 1 {
+		t.Errorf("expected loaded key handle, got %v", got)
+	}
+	// key is reloaded transparently after TPM reset
+	sim.Reset()
+	sig, err := k.Sign(rand.Reader, sum[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify(t, k.Public(), sum[:], sig, crypto.SHA256)
+
+	if err = k.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := sim.Handles(tpm2.HandleTypeTransient); len(got) != 0 {
+		t.Errorf("transient handles left after close %v", got)
+	}
+}
+
+func TestForeignHandlesAreKept(t *testing.T) {
+	sim := tpmtest.New(t)
+	tss := sim.TSSKey(tpm2.HandleOwner, tpmtest.ECCParentTemplate, "", tpmtest.ECCSigningTemplate)
+	foreign := sim.CreatePrimary(tpm2.HandleOwner, tpmtest.ECCParentTemplate)
+	sum := sha256.Sum256([]byte("data"))
+
+	k := newTPM(t, &tpm.TPM{Tss: tss, Opener: sim.Open, SignatureAlgorithm: x509.ECDSAWithSHA256})
+	if _, err := k.Sign(rand.Reader, sum[:], crypto.SHA256); err != nil {
+		t.Fatal(err)
+	}
+	if got := sim.Handles(tpm2.HandleTypeTransient); !reflect.DeepEqual(got, []tpmutil.Handle{foreign}) {
+		t.Errorf("got transient handles %v, want only %v", got, foreign)
+	}
+
+	newTPM(t, &tpm.TPM{Tss: tss, Opener: sim.Open, FlushHandles: "transient"})
+	if got := sim.Handles(tpm2.HandleTypeTransient); len(got) != 0 {
+		t.Errorf("transient handles left after flush %v", got)
+	}
+}
+
+func TestPublicPerInstance(t *testing.T) {
+	sim := tpmtest.New(t)
+	first := newTPM(t, &tpm.TPM{
+		Tss:    sim.TSSKey(tpm2.HandleOwner, tpmtest.ECCParentTemplate, "", tpmtest.ECCSigningTemplate),
+		Opener: sim.Open,
+	})
+	second := newTPM(t, &tpm.TPM{
+		Tss:    sim.TSSKey(tpm2.HandleOwner, tpmtest.ECCParentTemplate, "", tpmtest.ECCSigningTemplate),
+		Opener: sim.Open,
+	})
+	firstPub, secondPub := first.Public().(*ecdsa.PublicKey), second.Public().(*ecdsa.PublicKey)
+	if firstPub.Equal(secondPub) {
+		t.Error("different keys have the same public key")
+	}
+	first.Invalidate()
+	if !firstPub.Equal(first.Public()) {
+		t.Error("public key changed after invalidation")
+	}
+}
+
+func TestTLSCertificate(t *testing.T) {
+	sim := tpmtest.New(t)
+	k := newTPM(t, &tpm.TPM{
+		Tss:    sim.TSSKey(tpm2.HandleOwner, tpmtest.ECCParentTemplate, "", tpmtest.ECCSigningTemplate),
+		Opener: sim.Open,
+	})
+	ca := sim.NewCA()
+	k.PublicCertFile = sim.Issue(ca, k.Public(), "client.local", "client.crt")
+
+	cert := k.TLSCertificate()
+	if cert.Leaf == nil || len(cert.Certificate) != 1 {
+		t.Fatalf("unexpected certificate %+v", cert)
+	}
+	if _, err := cert.Leaf.Verify(x509.VerifyOptions{Roots: ca.Pool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Error(err)
+	}
+
+	// leaf is followed by intermediates up to root CA
+	intermediate := sim.Intermediate(sim.Intermediate(ca, "intermediate 1"), "intermediate 2")
+	k.PublicCertFile = sim.Issue(intermediate, k.Public(), "client.local", "chain.crt")
+	cert, err := k.Certificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.Certificate) != 3 {
+		t.Fatalf("expected leaf and 2 intermediates, got %d certificates", len(cert.Certificate))
+	}
+	intermediates := x509.NewCertPool()
+	for _, der := range cert.Certificate[1:] {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		intermediates.AddCert(c)
+	}
+	if _, err = cert.Leaf.Verify(x509.VerifyOptions{Roots: ca.Pool, Intermediates: intermediates,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Error(err)
+	}
+
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.PublicCertFile = sim.Issue(ca, other.Public(), "other.local", "other.crt")
+	if _, err = k.Certificate(); !errors.Is(err, tpm.ErrCertificateMismatch) {
+		t.Errorf("expected ErrCertificateMismatch, got %v", err)
+	}
+	if _, err = k.GetCertificate(nil); !errors.Is(err, tpm.ErrCertificateMismatch) {
+		t.Errorf("expected ErrCertificateMismatch from GetCertificate, got %v", err)
+	}
+}
+
+func TestGetCertificateReload(t *testing.T) {
+	sim := tpmtest.New(t)
+	logger := &recordLogger{}
+	k := newTPM(t, &tpm.TPM{
+		Tss:    sim.TSSKey(tpm2.HandleOwner, tpmtest.ECCParentTemplate, "", tpmtest.ECCSigningTemplate),
+		Opener: sim.Open,
+		Logger: logger,
+	})
+	ca := sim.NewCA()
+	k.PublicCertFile = sim.Issue(ca, k.Public(), "v1.local", "client.crt")
+
+	// rewrite replaces content and modification time of certificate file
+	modTime := time.Now()
+	rewrite := func(content []byte) {
+		modTime = modTime.Add(time.Second)
+		if err := os.WriteFile(k.PublicCertFile, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(k.PublicCertFile, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	subject := func(want string) {
+		t.Helper()
+		cert, err := k.GetClientCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert.Leaf.Subject.CommonName != want {
+			t.Errorf("expected certificate of %s, got %s", want, cert.Leaf.Subject.CommonName)
+		}
+	}
+	subject("v1.local")
+
+	renewed, err := os.ReadFile(sim.Issue(ca, k.Public(), "v2.local", "renewed.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewrite(renewed)
+	subject("v2.local")
+
+	// broken renewal keeps previous certificate
+	rewrite([]byte("not a certificate"))
+	subject("v2.local")
+	if !logger.contains("WARN unable to reload TLS certificate, using loaded one") {
+		t.Errorf("reload error is not logged: %q", logger.records)
+	}
+	rewrite(renewed)
+	cert, err := k.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf.Subject.CommonName != "v2.local" {
+		t.Errorf("unexpected certificate %s", cert.Leaf.Subject.CommonName)
+	}
+}
+
+// recordLogger records messages of log records
+type recordLogger struct {
+	mu      sync.Mutex
+	records []string
+}
+
+func (l *recordLogger) add(level, msg string, args []any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = append(l.records, fmt.Sprintln(append([]any{level, msg}, args...)...))
+}
+
+func (l *recordLogger) Debug(msg string, args ...any) { l.add("DEBUG", msg, args) }
+func (l *recordLogger) Info(msg string, args ...any)  { l.add("INFO", msg, args) }
+func (l *recordLogger) Warn(msg string, args ...any)  { l.add("WARN", msg, args) }
+func (l *recordLogger) Error(msg string, args ...any) { l.add("ERROR", msg, args) }
+
+func (l *recordLogger) contains(prefix string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, r := range l.records {
+		if strings.HasPrefix(r, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLogger(t *testing.T) {
+	sim := tpmtest.New(t)
+	const handle = 0x81000040
+	sim.PersistKey(tpmtest.ECCSigningTemplate, "secret", handle)
+	tss := sim.TSSKey(tpm2.HandleOwner, tpmtest.ECCParentTemplate, "", tpmtest.ECCSigningTemplate)
+	sum := sha256.Sum256([]byte("data"))
+
+	logger := &recordLogger{}
+	k := newTPM(t, &tpm.TPM{Tss: tss, Opener: sim.Open, Logger: logger, SignatureAlgorithm: x509.ECDSAWithSHA256})
+	if _, err := k.Sign(rand.Reader, sum[:], crypto.SHA256); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"DEBUG TPM device opened", "DEBUG TSS key loaded under primary parent", "DEBUG key loaded",
+		"DEBUG digest signed", "DEBUG handle flushed"} {
+		if !logger.contains(want) {
+			t.Errorf("log record %q not found in %q", want, logger.records)
+		}
+	}
+
+	logger = &recordLogger{}
+	k = newTPM(t, &tpm.TPM{TpmHandle: handle, KeyAuth: tpm.StaticAuth("wrong"), Opener: sim.Open, Logger: logger})
+	if _, err := k.Sign(rand.Reader, sum[:], crypto.SHA256); err == nil {
+		t.Fatal("expected error")
+	}
+	if !logger.contains("ERROR unable to sign digest rc TPM_RC_AUTH_FAIL") {
+		t.Errorf("TPM response code is not logged %q", logger.records)
+	}
+}
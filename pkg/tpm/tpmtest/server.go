@@ -0,0 +1,171 @@
+package tpmtest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+)
+
+// maxResponse is maximal size of TPM response
+const maxResponse = 4096
+
+// ServeSwtpm serves simulator as swtpm raw command socket on "tcp" or "unix" network
+// and returns TPM device string of the server
+func (s *Simulator) ServeSwtpm(network string) string {
+	s.tb.Helper()
+	var l net.Listener
+	var err error
+	if network == "unix" {
+		l, err = net.Listen("unix", filepath.Join(s.Dir, "swtpm.sock"))
+	} else {
+		l, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		s.tb.Fatal(err)
+	}
+	s.tb.Cleanup(func() {
+		_ = l.Close()
+	})
+	go s.accept(l, s.serveStream)
+	if network == "unix" {
+		return "swtpm:path=" + l.Addr().String()
+	}
+	addr := l.Addr().(*net.TCPAddr)
+	return fmt.Sprintf("swtpm:host=127.0.0.1,port=%d", addr.Port)
+}
+
+// ServeMSSim serves simulator with Microsoft simulator protocol on command port and
+// port+1 platform port and returns TPM device string of the server
+func (s *Simulator) ServeMSSim() string {
+	s.tb.Helper()
+	for i := 0; i < 10; i++ {
+		cmd, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			s.tb.Fatal(err)
+		}
+		port := cmd.Addr().(*net.TCPAddr).Port
+		platform, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port+1)))
+		if err != nil {
+			_ = cmd.Close()
+			continue
+		}
+		s.tb.Cleanup(func() {
+			_ = cmd.Close()
+			_ = platform.Close()
+		})
+		go s.accept(cmd, s.serveMSSimCommand)
+		go s.accept(platform, servePlatform)
+		return fmt.Sprintf("mssim:host=127.0.0.1,port=%d", port)
+	}
+	s.tb.Fatal("can't find free ports for TPM simulator")
+	return ""
+}
+
+func (s *Simulator) accept(l net.Listener, serve func(conn net.Conn) error) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			_ = serve(conn)
+		}()
+	}
+}
+
+// exec runs TPM command on simulator
+func (s *Simulator) exec(cmd []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.sim.Write(cmd); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, maxResponse)
+	n, err := s.sim.Read(resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp[:n], nil
+}
+
+// serveStream executes raw TPM commands, response is written in two parts
+// to exercise clients reading partial responses
+func (s *Simulator) serveStream(conn net.Conn) error {
+	for {
+		header := make([]byte, 10)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return err
+		}
+		cmd := make([]byte, binary.BigEndian.Uint32(header[2:6]))
+		copy(cmd, header)
+		if _, err := io.ReadFull(conn, cmd[len(header):]); err != nil {
+			return err
+		}
+		resp, err := s.exec(cmd)
+		if err != nil {
+			return err
+		}
+		if _, err = conn.Write(resp[:len(resp)/2]); err != nil {
+			return err
+		}
+		if _, err = conn.Write(resp[len(resp)/2:]); err != nil {
+			return err
+		}
+	}
+}
+
+// serveMSSimCommand executes TPM commands framed with Microsoft simulator protocol
+func (s *Simulator) serveMSSimCommand(conn net.Conn) error {
+	for {
+		var code uint32
+		if err := binary.Read(conn, binary.BigEndian, &code); err != nil {
+			return err
+		}
+		if code != 8 { // TPM_SEND_COMMAND
+			return nil
+		}
+		var hdr struct {
+			Locality uint8
+			Size     uint32
+		}
+		if err := binary.Read(conn, binary.BigEndian, &hdr); err != nil {
+			return err
+		}
+		cmd := make([]byte, hdr.Size)
+		if _, err := io.ReadFull(conn, cmd); err != nil {
+			return err
+		}
+		resp, err := s.exec(cmd)
+		if err != nil {
+			return err
+		}
+		var out bytes.Buffer
+		_ = binary.Write(&out, binary.BigEndian, uint32(len(resp)))
+		out.Write(resp)
+		_ = binary.Write(&out, binary.BigEndian, uint32(0))
+		if _, err = out.WriteTo(conn); err != nil {
+			return err
+		}
+	}
+}
+
+// servePlatform acknowledges platform signals, simulator is always powered on
+func servePlatform(conn net.Conn) error {
+	for {
+		var signal uint32
+		if err := binary.Read(conn, binary.BigEndian, &signal); err != nil {
+			return err
+		}
+		if signal == 20 { // TPM_SESSION_END
+			return nil
+		}
+		if err := binary.Write(conn, binary.BigEndian, uint32(0)); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,393 @@
+// Package tpmtest provides TPM simulator backed harness for testing code built on tpm package.
+// The simulator requires cgo.
+package tpmtest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+
+	"github.com/shuvava/tpm/pkg/tpm"
+)
+
+var (
+	// RSASigningTemplate is unrestricted RSA 2048 signing key template without fixed scheme
+	RSASigningTemplate = tpm2.Public{
+		Type:       tpm2.AlgRSA,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin | tpm2.FlagUserWithAuth | tpm2.FlagSign,
+		RSAParameters: &tpm2.RSAParams{
+			Sign:    &tpm2.SigScheme{Alg: tpm2.AlgNull},
+			KeyBits: 2048,
+		},
+	}
+
+	// ECCSigningTemplate is unrestricted NIST P-256 signing key template without fixed scheme
+	ECCSigningTemplate = tpm2.Public{
+		Type:       tpm2.AlgECC,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin | tpm2.FlagUserWithAuth | tpm2.FlagSign,
+		ECCParameters: &tpm2.ECCParams{
+			Sign:    &tpm2.SigScheme{Alg: tpm2.AlgNull},
+			CurveID: tpm2.CurveNISTP256,
+		},
+	}
+
+	// ECCParentTemplate is tpm2-tss-engine ECC storage primary key template
+	ECCParentTemplate = tpm2.Public{
+		Type:       tpm2.AlgECC,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin | tpm2.FlagUserWithAuth | tpm2.FlagNoDA | tpm2.FlagRestricted | tpm2.FlagDecrypt,
+		ECCParameters: &tpm2.ECCParams{
+			CurveID: tpm2.CurveNISTP256,
+			KDF:     &tpm2.KDFScheme{Alg: tpm2.AlgNull},
+			Symmetric: &tpm2.SymScheme{
+				Alg:     tpm2.AlgAES,
+				KeyBits: 128,
+				Mode:    tpm2.AlgCFB,
+			},
+		},
+	}
+
+	// RSAParentTemplate is default tpm2_createprimary RSA storage primary key template
+	RSAParentTemplate = tpm2.Public{
+		Type:       tpm2.AlgRSA,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagStorageDefault,
+		RSAParameters: &tpm2.RSAParams{
+			Symmetric: &tpm2.SymScheme{
+				Alg:     tpm2.AlgAES,
+				KeyBits: 128,
+				Mode:    tpm2.AlgCFB,
+			},
+			KeyBits: 2048,
+		},
+	}
+)
+
+// ParentHandle is persistent handle used by tests for parent keys provisioned by PersistPrimary
+const ParentHandle tpmutil.Handle = 0x81000060
+
+// Simulator is in-process TPM simulator with helpers provisioning keys and files
+type Simulator struct {
+	tb  testing.TB
+	sim *simulator.Simulator
+	// mu serializes access of device servers and cleanup to simulator
+	mu sync.Mutex
+	// Dir is temporary directory for provisioned files
+	Dir string
+}
+
+// New starts TPM simulator, it is closed on test cleanup.
+// Only one simulator can be running at a time, New blocks until previous one is closed
+func New(tb testing.TB) *Simulator {
+	tb.Helper()
+	sim, err := simulator.Get()
+	if err != nil {
+		tb.Fatalf("can't start TPM simulator: %v", err)
+	}
+	s := &Simulator{tb: tb, sim: sim, Dir: tb.TempDir()}
+	tb.Cleanup(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		_ = sim.Close()
+	})
+	return s
+}
+
+// Command starts simulator for tests of command line tool and replaces its TPM device opener
+// by simulator, original opener is restored on test cleanup
+func Command(tb testing.TB, opener *func(string) (io.ReadWriteCloser, error)) *Simulator {
+	tb.Helper()
+	s := New(tb)
+	orig := *opener
+	*opener = func(string) (io.ReadWriteCloser, error) {
+		return s.Open()
+	}
+	tb.Cleanup(func() {
+		*opener = orig
+	})
+	return s
+}
+
+// RW returns simulator command channel
+func (s *Simulator) RW() io.ReadWriter {
+	return s.sim
+}
+
+// Open is TPM device opener, returned device doesn't close the simulator
+func (s *Simulator) Open() (io.ReadWriteCloser, error) {
+	return nopCloser{s.sim}, nil
+}
+
+// Reset simulates TPM reset, all transient objects and sessions are lost
+func (s *Simulator) Reset() {
+	s.tb.Helper()
+	if err := s.sim.Reset(); err != nil {
+		s.tb.Fatalf("TPM reset failed: %v", err)
+	}
+}
+
+// Handles returns handles of given type loaded in simulator
+func (s *Simulator) Handles(handleType tpm2.HandleType) []tpmutil.Handle {
+	s.tb.Helper()
+	vals, _, err := tpm2.GetCapability(s.sim, tpm2.CapabilityHandles, 100, uint32(handleType)<<24)
+	if err != nil {
+		s.tb.Fatalf("get handles failed: %v", err)
+	}
+	handles := make([]tpmutil.Handle, len(vals))
+	for i, v := range vals {
+		handles[i] = v.(tpmutil.Handle)
+	}
+	return handles
+}
+
+// CreatePrimary creates primary key in hierarchy
+func (s *Simulator) CreatePrimary(hierarchy tpmutil.Handle, template tpm2.Public) tpmutil.Handle {
+	s.tb.Helper()
+	h, _, err := tpm2.CreatePrimary(s.sim, hierarchy, tpm2.PCRSelection{}, "", "", template)
+	if err != nil {
+		s.tb.Fatalf("create primary failed: %v", err)
+	}
+	return h
+}
+
+// PersistPrimary creates primary key in owner hierarchy and makes it persistent at handle
+func (s *Simulator) PersistPrimary(template tpm2.Public, persistent tpmutil.Handle) {
+	s.tb.Helper()
+	h := s.CreatePrimary(tpm2.HandleOwner, template)
+	defer s.Flush(h)
+	if err := tpm2.EvictControl(s.sim, "", tpm2.HandleOwner, h, persistent); err != nil {
+		s.tb.Fatalf("evict control failed: %v", err)
+	}
+}
+
+// Flush flushes transient handle
+func (s *Simulator) Flush(h tpmutil.Handle) {
+	s.tb.Helper()
+	if err := tpm2.FlushContext(s.sim, h); err != nil {
+		s.tb.Fatalf("flush 0x%x failed: %v", h, err)
+	}
+}
+
+// CreateKey creates key under loaded parent, returned blobs are TPM2B encoded as in TSS2 files
+func (s *Simulator) CreateKey(parent tpmutil.Handle, parentAuth, keyAuth string, template tpm2.Public) (public, private []byte) {
+	s.tb.Helper()
+	priv, pub, _, _, _, err := tpm2.CreateKey(s.sim, parent, tpm2.PCRSelection{}, parentAuth, keyAuth, template)
+	if err != nil {
+		s.tb.Fatalf("create key failed: %v", err)
+	}
+	public, err = tpmutil.Pack(tpmutil.U16Bytes(pub))
+	if err != nil {
+		s.tb.Fatal(err)
+	}
+	private, err = tpmutil.Pack(tpmutil.U16Bytes(priv))
+	if err != nil {
+		s.tb.Fatal(err)
+	}
+	return public, private
+}
+
+// TSSKey creates key under parent and returns TSS describing it.
+// Parent is either hierarchy handle, primary key is created with parentTemplate then, or persistent key handle
+func (s *Simulator) TSSKey(parent tpmutil.Handle, parentTemplate tpm2.Public, keyAuth string, template tpm2.Public) *tpm.TSS {
+	s.tb.Helper()
+	ph := parent
+	if parent>>24 == tpmutil.Handle(tpm2.HandleTypePermanent) {
+		ph = s.CreatePrimary(parent, parentTemplate)
+		defer s.Flush(ph)
+	}
+	public, private := s.CreateKey(ph, "", keyAuth, template)
+	return &tpm.TSS{
+		Type:      tpm.OIDLoadableKey,
+		EmptyAuth: keyAuth == "",
+		Parent:    parent,
+		RSAParent: parentTemplate.Type == tpm2.AlgRSA,
+		Public:    public,
+		Private:   private,
+	}
+}
+
+// TSSFile saves TSS into file in Dir and returns its path
+func (s *Simulator) TSSFile(tss *tpm.TSS, name string) string {
+	s.tb.Helper()
+	f := filepath.Join(s.Dir, name)
+	if err := tss.SaveToFile(f); err != nil {
+		s.tb.Fatalf("save TSS file failed: %v", err)
+	}
+	return f
+}
+
+// ContextFile creates key under ECC primary key, saves its context into file in Dir and returns file path
+func (s *Simulator) ContextFile(template tpm2.Public, name string) string {
+	s.tb.Helper()
+	ph := s.CreatePrimary(tpm2.HandleOwner, ECCParentTemplate)
+	defer s.Flush(ph)
+	priv, pub, _, _, _, err := tpm2.CreateKey(s.sim, ph, tpm2.PCRSelection{}, "", "", template)
+	if err != nil {
+		s.tb.Fatalf("create key failed: %v", err)
+	}
+	kh, _, err := tpm2.Load(s.sim, ph, "", pub, priv)
+	if err != nil {
+		s.tb.Fatalf("load key failed: %v", err)
+	}
+	defer s.Flush(kh)
+	b, err := tpm2.ContextSave(s.sim, kh)
+	if err != nil {
+		s.tb.Fatalf("context save failed: %v", err)
+	}
+	f := filepath.Join(s.Dir, name)
+	if err = os.WriteFile(f, b, 0600); err != nil {
+		s.tb.Fatal(err)
+	}
+	return f
+}
+
+// PersistKey creates key under ECC primary key and makes it persistent at handle
+func (s *Simulator) PersistKey(template tpm2.Public, keyAuth string, persistent tpmutil.Handle) {
+	s.tb.Helper()
+	ph := s.CreatePrimary(tpm2.HandleOwner, ECCParentTemplate)
+	defer s.Flush(ph)
+	priv, pub, _, _, _, err := tpm2.CreateKey(s.sim, ph, tpm2.PCRSelection{}, "", keyAuth, template)
+	if err != nil {
+		s.tb.Fatalf("create key failed: %v", err)
+	}
+	kh, _, err := tpm2.Load(s.sim, ph, "", pub, priv)
+	if err != nil {
+		s.tb.Fatalf("load key failed: %v", err)
+	}
+	defer s.Flush(kh)
+	if err = tpm2.EvictControl(s.sim, "", tpm2.HandleOwner, kh, persistent); err != nil {
+		s.tb.Fatalf("evict control failed: %v", err)
+	}
+}
+
+// CA is test certificate authority issuing certificates for TPM keys
+type CA struct {
+	Cert *x509.Certificate
+	Pool *x509.CertPool
+	key  crypto.Signer
+	// File is path of pem encoded CA certificate
+	File string
+	// chain is pem encoded chain of intermediate CA certificates appended to issued certificates
+	chain []byte
+}
+
+// NewCA creates self-signed test CA, its certificate is saved into Dir
+func (s *Simulator) NewCA() *CA {
+	s.tb.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		s.tb.Fatal(err)
+	}
+	template := caTemplate("tpmtest CA")
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		s.tb.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		s.tb.Fatal(err)
+	}
+	ca := &CA{Cert: cert, Pool: x509.NewCertPool(), key: key}
+	ca.Pool.AddCert(cert)
+	ca.File = s.writePEM("ca.crt", "CERTIFICATE", der)
+	return ca
+}
+
+// Intermediate creates intermediate CA signed by parent. Certificates issued by it include
+// intermediate chain, its Pool and File are the ones of root CA
+func (s *Simulator) Intermediate(parent *CA, name string) *CA {
+	s.tb.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		s.tb.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, caTemplate(name), parent.Cert, key.Public(), parent.key)
+	if err != nil {
+		s.tb.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		s.tb.Fatal(err)
+	}
+	chain := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), parent.chain...)
+	return &CA{Cert: cert, Pool: parent.Pool, key: key, File: parent.File, chain: chain}
+}
+
+func caTemplate(name string) *x509.Certificate {
+	return &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+}
+
+// Issue issues certificate for public key with server and client auth usages and DNS name,
+// pem encoded certificate followed by intermediate chain of ca is saved into Dir and its path is returned
+func (s *Simulator) Issue(ca *CA, pub crypto.PublicKey, dnsName, name string) string {
+	s.tb.Helper()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: dnsName},
+		DNSNames:     []string{dnsName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, pub, ca.key)
+	if err != nil {
+		s.tb.Fatal(err)
+	}
+	return s.writePEM(name, "CERTIFICATE", der, ca.chain...)
+}
+
+// KeyFile saves pem encoded PKCS #8 private key into Dir and returns its path
+func (s *Simulator) KeyFile(key crypto.Signer, name string) string {
+	s.tb.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		s.tb.Fatal(err)
+	}
+	return s.writePEM(name, "PRIVATE KEY", der)
+}
+
+// writePEM saves pem encoded der followed by rest into Dir and returns the file path
+func (s *Simulator) writePEM(name, blockType string, der []byte, rest ...byte) string {
+	s.tb.Helper()
+	f := filepath.Join(s.Dir, name)
+	b := append(pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), rest...)
+	if err := os.WriteFile(f, b, 0600); err != nil {
+		s.tb.Fatal(err)
+	}
+	return f
+}
+
+// nopCloser prevents closing of simulator by code closing TPM device after use
+type nopCloser struct {
+	io.ReadWriter
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,256 @@
+package tpm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+const (
+	defaultDevice = "/dev/tpmrm0"
+	defaultHost   = "127.0.0.1"
+	defaultPort   = 2321
+	// tpmHeaderSize is size of TPM 2.0 command/response header (tag, size, code)
+	tpmHeaderSize = 10
+
+	// Microsoft simulator platform and command protocol codes
+	mssimSignalPowerOn uint32 = 1
+	mssimSendCommand   uint32 = 8
+	mssimSignalNVOn    uint32 = 11
+	mssimSessionEnd    uint32 = 20
+)
+
+// OpenDevice opens TPM device described by path or URI-style device string:
+//
+//	/dev/tpm0, /dev/tpmrm0          character device or Unix socket path
+//	device:/dev/tpmrm0              character device, /dev/tpmrm0 by default
+//	swtpm:path=/tmp/swtpm.sock      swtpm Unix socket
+//	swtpm:host=127.0.0.1,port=2321  swtpm TCP socket
+//	mssim:host=127.0.0.1,port=2321  Microsoft simulator TCP protocol (platform port is port+1)
+//
+// Empty device opens /dev/tpmrm0 or /dev/tpm0 when resource manager is not available
+func OpenDevice(device string) (io.ReadWriteCloser, error) {
+	scheme, conf, ok := strings.Cut(device, ":")
+	if !ok || strings.HasPrefix(device, "/") {
+		if device == "" {
+			return tpm2.OpenTPM()
+		}
+		return tpm2.OpenTPM(device)
+	}
+	params, err := parseDeviceParams(conf)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TPM device %q: %w", device, err)
+	}
+	switch scheme {
+	case "device":
+		if conf == "" {
+			conf = defaultDevice
+		}
+		return tpm2.OpenTPM(conf)
+	case "swtpm":
+		if path, ok := params["path"]; ok {
+			return openStream("unix", path)
+		}
+		addr, err := params.address(0)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TPM device %q: %w", device, err)
+		}
+		return openStream("tcp", addr)
+	case "mssim":
+		cmdAddr, err := params.address(0)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TPM device %q: %w", device, err)
+		}
+		platformAddr, _ := params.address(1)
+		return openMSSim(cmdAddr, platformAddr)
+	default:
+		return nil, fmt.Errorf("unsupported TPM device type %q", scheme)
+	}
+}
+
+// deviceParams are key=value parameters of TPM device string
+type deviceParams map[string]string
+
+// parseDeviceParams parses comma separated key=value list,
+// value without key is accepted for device type only
+func parseDeviceParams(conf string) (deviceParams, error) {
+	params := deviceParams{}
+	if conf == "" || !strings.Contains(conf, "=") {
+		return params, nil
+	}
+	for _, kv := range strings.Split(conf, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("parameter %q is not key=value", kv)
+		}
+		params[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return params, nil
+}
+
+// address returns host:port of TCP connection, offset is added to port
+func (p deviceParams) address(offset int) (string, error) {
+	host := defaultHost
+	if h, ok := p["host"]; ok && h != "" {
+		host = h
+	}
+	port := defaultPort
+	if s, ok := p["port"]; ok {
+		var err error
+		if port, err = strconv.Atoi(s); err != nil || port <= 0 || port+offset > 65535 {
+			return "", fmt.Errorf("invalid port %q", s)
+		}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port+offset)), nil
+}
+
+// streamConn is TPM connection over stream socket sending raw TPM commands.
+// tpmutil reads whole response with one Read call, so response is buffered
+// until it is read completely
+type streamConn struct {
+	conn net.Conn
+	resp bytes.Reader
+}
+
+// openStream connects to raw TPM command socket of swtpm
+func openStream(network, addr string) (io.ReadWriteCloser, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to TPM at %s: %w", addr, err)
+	}
+	return &streamConn{conn: conn}, nil
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	if c.resp.Len() == 0 {
+		var header [tpmHeaderSize]byte
+		if _, err := io.ReadFull(c.conn, header[:]); err != nil {
+			return 0, fmt.Errorf("unable to read TPM response header: %w", err)
+		}
+		size := binary.BigEndian.Uint32(header[2:6])
+		if size < tpmHeaderSize {
+			return 0, fmt.Errorf("invalid TPM response size %d", size)
+		}
+		resp := make([]byte, size)
+		copy(resp, header[:])
+		if _, err := io.ReadFull(c.conn, resp[tpmHeaderSize:]); err != nil {
+			return 0, fmt.Errorf("unable to read TPM response: %w", err)
+		}
+		c.resp.Reset(resp)
+	}
+	return c.resp.Read(p)
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	return c.conn.Write(p)
+}
+
+func (c *streamConn) Close() error {
+	return c.conn.Close()
+}
+
+// mssimConn is TPM connection using Microsoft simulator command protocol
+type mssimConn struct {
+	conn net.Conn
+	resp bytes.Reader
+}
+
+// openMSSim powers on Microsoft simulator and starts TPM if it is not started yet.
+// Unlike IBM powerup tool running simulator is not reset
+func openMSSim(cmdAddr, platformAddr string) (io.ReadWriteCloser, error) {
+	platform, err := net.Dial("tcp", platformAddr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to TPM simulator platform at %s: %w", platformAddr, err)
+	}
+	defer platform.Close()
+	for _, signal := range []uint32{mssimSignalPowerOn, mssimSignalNVOn} {
+		if err = mssimPlatformCommand(platform, signal); err != nil {
+			return nil, err
+		}
+	}
+	_ = binary.Write(platform, binary.BigEndian, mssimSessionEnd)
+
+	conn, err := net.Dial("tcp", cmdAddr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to TPM simulator at %s: %w", cmdAddr, err)
+	}
+	rwc := &mssimConn{conn: conn}
+	if err = tpm2.Startup(rwc, tpm2.StartupClear); err != nil {
+		var tpmErr tpm2.Error
+		if !errors.As(err, &tpmErr) || tpmErr.Code != tpm2.RCInitialize {
+			_ = rwc.Close()
+			return nil, fmt.Errorf("unable to start TPM simulator: %w", err)
+		}
+	}
+	return rwc, nil
+}
+
+// mssimPlatformCommand sends signal to simulator platform port
+func mssimPlatformCommand(conn net.Conn, signal uint32) error {
+	if err := binary.Write(conn, binary.BigEndian, signal); err != nil {
+		return fmt.Errorf("unable to send TPM simulator platform command %d: %w", signal, err)
+	}
+	var rc uint32
+	if err := binary.Read(conn, binary.BigEndian, &rc); err != nil {
+		return fmt.Errorf("unable to read TPM simulator platform response: %w", err)
+	}
+	if rc != 0 {
+		return fmt.Errorf("TPM simulator platform command %d failed with 0x%x", signal, rc)
+	}
+	return nil
+}
+
+func (c *mssimConn) Read(p []byte) (int, error) {
+	if c.resp.Len() == 0 {
+		var size uint32
+		if err := binary.Read(c.conn, binary.BigEndian, &size); err != nil {
+			return 0, fmt.Errorf("unable to read TPM simulator response header: %w", err)
+		}
+		resp := make([]byte, size)
+		if _, err := io.ReadFull(c.conn, resp); err != nil {
+			return 0, fmt.Errorf("unable to read TPM simulator response: %w", err)
+		}
+		var rc uint32
+		if err := binary.Read(c.conn, binary.BigEndian, &rc); err != nil {
+			return 0, fmt.Errorf("unable to read TPM simulator response code: %w", err)
+		}
+		if rc != 0 {
+			return 0, fmt.Errorf("TPM simulator returned 0x%x", rc)
+		}
+		c.resp.Reset(resp)
+	}
+	return c.resp.Read(p)
+}
+
+func (c *mssimConn) Write(p []byte) (int, error) {
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.BigEndian, mssimSendCommand)
+	buf.WriteByte(0) // locality
+	_ = binary.Write(&buf, binary.BigEndian, uint32(len(p)))
+	buf.Write(p)
+	if _, err := buf.WriteTo(c.conn); err != nil {
+		return 0, fmt.Errorf("unable to send TPM simulator command: %w", err)
+	}
+	return len(p), nil
+}
+
+func (c *mssimConn) Close() error {
+	_ = binary.Write(c.conn, binary.BigEndian, mssimSessionEnd)
+	return c.conn.Close()
+}
+
+// sharedDevice is TPM device provided by caller, it is not closed by TPM
+type sharedDevice struct {
+	io.ReadWriter
+}
+
+func (sharedDevice) Close() error {
+	return nil
+}
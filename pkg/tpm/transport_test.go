@@ -0,0 +1,193 @@
+package tpm_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/go-tpm/tpm2"
+
+	"github.com/shuvava/tpm/pkg/tpm"
+	"github.com/shuvava/tpm/pkg/tpm/tpmtest"
+)
+
+func TestOpenDevice(t *testing.T) {
+	sim := tpmtest.New(t)
+	tss := sim.TSSKey(tpm2.HandleOwner, tpmtest.ECCParentTemplate, "", tpmtest.ECCSigningTemplate)
+	sum := sha256.Sum256([]byte("data"))
+
+	tests := []struct {
+		name   string
+		device string
+	}{
+		{"swtpm tcp", sim.ServeSwtpm("tcp")},
+		{"swtpm unix", sim.ServeSwtpm("unix")},
+		{"mssim", sim.ServeMSSim()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, keepOpen := range []bool{false, true} {
+				k := newTPM(t, &tpm.TPM{
+					Tss:                tss,
+					TpmDevice:          tt.device,
+					KeepOpen:           keepOpen,
+					SignatureAlgorithm: x509.ECDSAWithSHA256,
+				})
+				sig, err := k.Sign(rand.Reader, sum[:], crypto.SHA256)
+				if err != nil {
+					t.Fatal(err)
+				}
+				verify(t, k.Public(), sum[:], sig, crypto.SHA256)
+				if err = k.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// mssimExchange is message expected by scripted Microsoft simulator and its reply, both hex encoded
+type mssimExchange struct {
+	expect, reply string
+}
+
+// TestMSSimFraming checks bytes of Microsoft simulator TCP protocol (TpmTcpProtocol.h of reference
+// TPM implementation) against fixtures instead of tpmtest server sharing assumptions of the client
+func TestMSSimFraming(t *testing.T) {
+	platform := []mssimExchange{
+		{"00000001", "00000000"}, // TPM_SIGNAL_POWER_ON
+		{"0000000b", "00000000"}, // TPM_SIGNAL_NV_ON
+		{"00000014", ""},         // TPM_SESSION_END
+	}
+	command := []mssimExchange{
+		// TPM_SEND_COMMAND, locality 0, size, TPM2_Startup(TPM_SU_CLEAR)
+		{"00000008" + "00" + "0000000c" + "80010000000c000001440000",
+			// size, TPM_RC_INITIALIZE response, trailing acknowledgement
+			"0000000a" + "80010000000a00000100" + "00000000"},
+		// TPM_SEND_COMMAND, locality 0, size, TPM2_GetRandom(8)
+		{"00000008" + "00" + "0000000c" + "80010000000c0000017b0008",
+			"00000014" + "800100000014000000000008" + "0102030405060708" + "00000000"},
+		{"00000014", ""}, // TPM_SESSION_END
+	}
+	device, errs := serveMSSimScript(t, command, platform)
+
+	rwc, err := tpm.OpenDevice(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := tpm2.GetRandom(rwc, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "0102030405060708"; hex.EncodeToString(got) != want {
+		t.Errorf("GetRandom() = %x, want %s", got, want)
+	}
+	if err = rwc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// serveMSSimScript starts Microsoft simulator command and platform listeners accepting single
+// connection each, errors of the scripts are sent to returned channel
+func serveMSSimScript(t *testing.T, command, platform []mssimExchange) (string, <-chan error) {
+	t.Helper()
+	errs := make(chan error, 2)
+	for i := 0; i < 10; i++ {
+		cmd, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := cmd.Addr().(*net.TCPAddr).Port
+		plat, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port+1)))
+		if err != nil {
+			_ = cmd.Close()
+			continue
+		}
+		t.Cleanup(func() {
+			_ = cmd.Close()
+			_ = plat.Close()
+		})
+		go func() { errs <- runMSSimScript(cmd, command) }()
+		go func() { errs <- runMSSimScript(plat, platform) }()
+		return fmt.Sprintf("mssim:host=127.0.0.1,port=%d", port), errs
+	}
+	t.Fatal("can't find free ports for TPM simulator")
+	return "", nil
+}
+
+func runMSSimScript(l net.Listener, script []mssimExchange) error {
+	conn, err := l.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// client waiting for reply to malformed message is unblocked by closed connection
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	addr := l.Addr()
+	for _, e := range script {
+		expect, _ := hex.DecodeString(e.expect)
+		got := make([]byte, len(expect))
+		if _, err = io.ReadFull(conn, got); err != nil {
+			return fmt.Errorf("%s: expected %s: %w", addr, e.expect, err)
+		}
+		if !bytes.Equal(got, expect) {
+			return fmt.Errorf("%s: received %x, want %s", addr, got, e.expect)
+		}
+		reply, _ := hex.DecodeString(e.reply)
+		if _, err = conn.Write(reply); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestOpenDeviceErrors(t *testing.T) {
+	tests := []string{
+		"unknown:foo",
+		"swtpm:host=127.0.0.1,port=http",
+		"mssim:host=127.0.0.1,port",
+		"swtpm:port=70000",
+		"device:/nonexistent/tpm",
+		"/nonexistent/tpm",
+	}
+	for _, device := range tests {
+		t.Run(device, func(t *testing.T) {
+			if rwc, err := tpm.OpenDevice(device); err == nil {
+				_ = rwc.Close()
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestSharedDevice(t *testing.T) {
+	sim := tpmtest.New(t)
+	tss := sim.TSSKey(tpm2.HandleOwner, tpmtest.ECCParentTemplate, "", tpmtest.ECCSigningTemplate)
+	sum := sha256.Sum256([]byte("data"))
+
+	k := newTPM(t, &tpm.TPM{Tss: tss, Device: sim.RW(), SignatureAlgorithm: x509.ECDSAWithSHA256})
+	if _, err := k.Sign(rand.Reader, sum[:], crypto.SHA256); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// device is still usable by its owner
+	if got := sim.Handles(tpm2.HandleTypeTransient); len(got) != 0 {
+		t.Errorf("transient handles left %v", got)
+	}
+}
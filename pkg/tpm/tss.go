@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"encoding/asn1"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/google/go-tpm-tools/client"
@@ -16,6 +18,16 @@ import (
 
 const defaultPassword = ""
 
+// TPM 2.0 key file types
+const (
+	// OIDLoadableKey is type of key which can be loaded by TPM2_Load
+	OIDLoadableKey = "2.23.133.10.1.3"
+	// OIDImportableKey is type of key which must be imported by TPM2_Import before loading
+	OIDImportableKey = "2.23.133.10.1.4"
+	// OIDSealedData is type of sealed data object
+	OIDSealedData = "2.23.133.10.1.5"
+)
+
 var (
 	pcrSelection = tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: []int{}}
 
@@ -56,15 +68,133 @@ var (
 			},
 		},
 	}
+
+	// hierarchies are TSS parent values meaning primary key of the hierarchy is the parent.
+	// Primary keys of null hierarchy are valid until TPM reset
+	hierarchies = map[tpmutil.Handle]bool{
+		tpm2.HandleOwner:       true,
+		tpm2.HandleEndorsement: true,
+		tpm2.HandlePlatform:    true,
+		tpm2.HandleNull:        true,
+	}
+
+	// tpm2ToolsPrimaryRSATemplate is default tpm2_createprimary RSA template
+	tpm2ToolsPrimaryRSATemplate = tpm2.Public{
+		Type:       tpm2.AlgRSA,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagStorageDefault,
+		RSAParameters: &tpm2.RSAParams{
+			Symmetric: &tpm2.SymScheme{
+				Alg:     tpm2.AlgAES,
+				KeyBits: 128,
+				Mode:    tpm2.AlgCFB,
+			},
+			KeyBits: 2048,
+		},
+	}
+
+	// tpm2ToolsPrimaryECCTemplate is default tpm2_createprimary ECC template
+	tpm2ToolsPrimaryECCTemplate = tpm2.Public{
+		Type:       tpm2.AlgECC,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagStorageDefault,
+		ECCParameters: &tpm2.ECCParams{
+			CurveID: tpm2.CurveNISTP256,
+			Symmetric: &tpm2.SymScheme{
+				Alg:     tpm2.AlgAES,
+				KeyBits: 128,
+				Mode:    tpm2.AlgCFB,
+			},
+		},
+	}
+
+	// eccPrimaryTemplates are ECC storage primary key templates tried in order when parent is hierarchy
+	eccPrimaryTemplates = []tpm2.Public{
+		// tpm2-tss-engine and TCG "H-2" unique-less template
+		defaultPrimaryECCTemplate,
+		// TCG TPM v2.0 Provisioning Guidance SRK template
+		client.SRKTemplateECC(),
+		tpm2ToolsPrimaryECCTemplate,
+	}
+
+	// rsaPrimaryTemplates are RSA storage primary key templates tried in order when parent is hierarchy
+	rsaPrimaryTemplates = []tpm2.Public{
+		// tpm2-tss-engine and TCG TPM v2.0 Provisioning Guidance SRK template
+		defaultPrimaryRSATemplate,
+		tpm2ToolsPrimaryRSATemplate,
+	}
 )
 
 // TSS OpenSSL TMP access key format
 type TSS struct {
+	// Type is key type OID, one of OIDLoadableKey, OIDImportableKey or OIDSealedData
 	Type      string
 	EmptyAuth bool
+	// Policy is list of policy commands which must be executed to authorize key use
+	Policy []TSSPolicy
+	// Secret is encrypted seed of importable key
+	Secret []byte
+	// AuthPolicy is list of signed policies
+	AuthPolicy  []TSSAuthPolicy
+	Description string
+	// RSAParent is true when parent is RSA storage key
+	RSAParent bool
 	Parent    tpmutil.Handle
 	Public    []byte
 	Private   []byte
+
+	// ParentAuth provides authorization value of persistent parent key, it is not serialized
+	ParentAuth AuthFunc
+	// HierarchyAuth provides authorization value of the parent hierarchy, it is not serialized
+	HierarchyAuth AuthFunc
+	// ParentTemplate is template of primary parent key, it is not serialized.
+	// Standard storage key templates are tried when it is not specified
+	ParentTemplate *tpm2.Public
+	// AuthPolicyFile is file with signed policies written by TSSAuthPolicy.EncodePEM, they are tried
+	// after AuthPolicy. It is read by every policy session, so policies signed after key creation
+	// are used without reloading the key. It is not serialized
+	AuthPolicyFile string
+	// OnImport is called when importable key is imported and converted into loadable key,
+	// it can be used to persist converted key so subsequent loads skip the import
+	OnImport func(*TSS) error
+	// Logger receives key load events, it is not serialized
+	Logger Logger
+}
+
+// TSSPolicy is single policy command of TPM 2.0 key file
+type TSSPolicy struct {
+	CommandCode   tpmutil.Command
+	CommandPolicy []byte
+}
+
+// TSSAuthPolicy is named signed policy of TPM 2.0 key file
+type TSSAuthPolicy struct {
+	Name   string
+	Policy []TSSPolicy
+}
+
+// tpmKey is ASN.1 structure of TPM 2.0 key file
+type tpmKey struct {
+	Type        asn1.ObjectIdentifier
+	EmptyAuth   bool            `asn1:"optional,explicit,tag:0"`
+	Policy      []tpmPolicy     `asn1:"optional,explicit,tag:1"`
+	Secret      []byte          `asn1:"optional,explicit,tag:2"`
+	AuthPolicy  []tpmAuthPolicy `asn1:"optional,explicit,tag:3"`
+	Description string          `asn1:"optional,explicit,tag:4,utf8"`
+	RSAParent   bool            `asn1:"optional,explicit,tag:5"`
+	Parent      int64
+	PubKey      []byte
+	PrivKey     []byte
+}
+
+type tpmPolicy struct {
+	CommandCode   int64  `asn1:"explicit,tag:0"`
+	CommandPolicy []byte `asn1:"explicit,tag:1"`
+}
+
+type tpmAuthPolicy struct {
+	Name   string      `asn1:"optional,explicit,tag:0,utf8"`
+	Policy []tpmPolicy `asn1:"explicit,tag:1"`
 }
 
 func toHexStr(a []byte, sep string) string {
@@ -75,9 +205,10 @@ func toHexStr(a []byte, sep string) string {
 	return strings.Join(s, sep)
 }
 
+// Unmarshal parses ASN.1 DER encoded TPM 2.0 key structure including its optional fields
 func (msg *TSS) Unmarshal(b []byte) (rest []byte, err error) {
 	var raw asn1.RawValue
-	rest, err = asn1.Unmarshal(b, &raw)
+	_, err = asn1.Unmarshal(b, &raw)
 	if err != nil {
 		return
 	}
@@ -86,82 +217,91 @@ func (msg *TSS) Unmarshal(b []byte) (rest []byte, err error) {
 			"Invalid messageV1 object - Class [%02x], Tag [%02x] : [%s]",
 			raw.Class, raw.Tag, toHexStr(b, " "))}
 	}
-	next := raw.Bytes
-	var obj asn1.ObjectIdentifier
-	next, err = asn1.Unmarshal(next, &obj)
-	if err != nil {
-		return
-	}
-	var exProps asn1.RawValue
-	next, err = asn1.Unmarshal(next, &exProps)
+	var key tpmKey
+	rest, err = asn1.Unmarshal(b, &key)
 	if err != nil {
 		return
 	}
-	var auth asn1.Flag
-	_, err = asn1.Unmarshal(exProps.Bytes, &auth)
-	if err != nil {
-		return
+	msg.Type = key.Type.String()
+	msg.EmptyAuth = key.EmptyAuth
+	msg.Policy = fromASN1Policy(key.Policy)
+	msg.Secret = key.Secret
+	msg.AuthPolicy = make([]TSSAuthPolicy, len(key.AuthPolicy))
+	for i, p := range key.AuthPolicy {
+		msg.AuthPolicy[i] = TSSAuthPolicy{Name: p.Name, Policy: fromASN1Policy(p.Policy)}
 	}
-	var parent int32
-	next, err = asn1.Unmarshal(next, &parent)
-	if err != nil {
-		return
+	if len(msg.AuthPolicy) == 0 {
+		msg.AuthPolicy = nil
 	}
-	var pubKey []byte
-	next, err = asn1.Unmarshal(next, &pubKey)
-	if err != nil {
-		return
-	}
-	var privKey []byte
-	_, err = asn1.Unmarshal(next, &privKey)
-	if err != nil {
-		return
-	}
-	msg.Type = obj.String()
-	msg.EmptyAuth = bool(auth)
-	msg.Parent = tpmutil.Handle(parent)
-	msg.Public = pubKey
-	msg.Private = privKey
+	msg.Description = key.Description
+	msg.RSAParent = key.RSAParent
+	// parent handle is unsigned, files written by older versions encoded it as int32
+	msg.Parent = tpmutil.Handle(uint32(key.Parent))
+	msg.Public = key.PubKey
+	msg.Private = key.PrivKey
 	return
 }
 
+// Marshal encodes TSS into ASN.1 DER TPM 2.0 key structure, optional fields are omitted when empty
 func (msg *TSS) Marshal() (b []byte, err error) {
-	var buf []byte
-	raw := asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSequence, IsCompound: true}
-	obj := asn1.ObjectIdentifier([]int{2, 23, 133, 10, 1, 3})
-	buf, err = asn1.Marshal(obj)
-	if err != nil {
-		return
+	keyType := msg.Type
+	if keyType == "" {
+		keyType = OIDLoadableKey
 	}
-	raw.Bytes = buf
-
-	exProps := asn1.RawValue{Class: asn1.ClassContextSpecific, IsCompound: true}
-	exProps.Bytes = []byte{1, 1, 1}
-	buf, err = asn1.Marshal(exProps)
+	oid, err := parseOID(keyType)
 	if err != nil {
-		return
+		return nil, err
 	}
-	raw.Bytes = append(raw.Bytes, buf...)
-
-	buf, err = asn1.Marshal(int32(msg.Parent))
-	if err != nil {
-		return
+	key := tpmKey{
+		Type:        oid,
+		EmptyAuth:   msg.EmptyAuth,
+		Policy:      toASN1Policy(msg.Policy),
+		Secret:      msg.Secret,
+		Description: msg.Description,
+		RSAParent:   msg.RSAParent,
+		Parent:      int64(msg.Parent),
+		PubKey:      msg.Public,
+		PrivKey:     msg.Private,
 	}
-	raw.Bytes = append(raw.Bytes, buf...)
+	for _, p := range msg.AuthPolicy {
+		key.AuthPolicy = append(key.AuthPolicy, tpmAuthPolicy{Name: p.Name, Policy: toASN1Policy(p.Policy)})
+	}
+	return asn1.Marshal(key)
+}
 
-	buf, err = asn1.Marshal(msg.Public)
-	if err != nil {
-		return
+func fromASN1Policy(policy []tpmPolicy) []TSSPolicy {
+	if len(policy) == 0 {
+		return nil
+	}
+	res := make([]TSSPolicy, len(policy))
+	for i, p := range policy {
+		res[i] = TSSPolicy{CommandCode: tpmutil.Command(p.CommandCode), CommandPolicy: p.CommandPolicy}
 	}
-	raw.Bytes = append(raw.Bytes, buf...)
+	return res
+}
 
-	buf, err = asn1.Marshal(msg.Private)
-	if err != nil {
-		return
+func toASN1Policy(policy []TSSPolicy) []tpmPolicy {
+	if len(policy) == 0 {
+		return nil
 	}
-	raw.Bytes = append(raw.Bytes, buf...)
+	res := make([]tpmPolicy, len(policy))
+	for i, p := range policy {
+		res[i] = tpmPolicy{CommandCode: int64(p.CommandCode), CommandPolicy: p.CommandPolicy}
+	}
+	return res
+}
 
-	return asn1.Marshal(raw)
+func parseOID(s string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(s, ".")
+	oid := make(asn1.ObjectIdentifier, len(parts))
+	for i, p := range parts {
+		v, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key type OID %q", s)
+		}
+		oid[i] = v
+	}
+	return oid, nil
 }
 
 func decode(p []byte) ([]byte, error) {
@@ -187,24 +327,125 @@ func (msg *TSS) DecodePublic() (*tpm2.Public, error) {
 	return &pub, err
 }
 
-func (msg *TSS) loadPrimary(rw io.ReadWriter) (tpmutil.Handle, error) {
-	if msg.Parent != 0 && msg.Parent != tpm2.HandleOwner {
-		key, err := client.NewCachedKey(rw, tpm2.HandleOwner, defaultPrimaryECCTemplate, msg.Parent)
-		if err != nil {
-			return 0, err
+// hasPersistentParent reports whether key parent is persistent key rather than hierarchy primary key
+func (msg *TSS) hasPersistentParent() bool {
+	return msg.Parent != 0 && !hierarchies[msg.Parent]
+}
+
+// hierarchy returns hierarchy of primary parent key
+func (msg *TSS) hierarchy() tpmutil.Handle {
+	if msg.Parent == 0 {
+		return tpm2.HandleOwner
+	}
+	return msg.Parent
+}
+
+// parentTemplates returns primary key templates which can be used to recreate the key parent,
+// ParentTemplate is used when it is specified, otherwise standard templates are tried
+func (msg *TSS) parentTemplates() []tpm2.Public {
+	if msg.ParentTemplate != nil {
+		return []tpm2.Public{*msg.ParentTemplate}
+	}
+	var templates []tpm2.Public
+	if msg.hierarchy() == tpm2.HandleEndorsement {
+		if msg.RSAParent {
+			templates = append(templates, client.DefaultEKTemplateRSA())
+		} else {
+			templates = append(templates, client.DefaultEKTemplateECC(), client.DefaultEKTemplateRSA())
 		}
-		return key.Handle(), nil
 	}
-	pkh, _, err := tpm2.CreatePrimary(rw, tpm2.HandleOwner, pcrSelection, defaultPassword, defaultPassword, defaultPrimaryECCTemplate)
+	if !msg.RSAParent {
+		templates = append(templates, eccPrimaryTemplates...)
+	}
+	return append(templates, rsaPrimaryTemplates...)
+}
+
+func (msg *TSS) loadPrimary(rw io.ReadWriter, template tpm2.Public) (tpmutil.Handle, error) {
+	hierarchyAuth, err := msg.hierarchyAuth()
+	if err != nil {
+		return 0, err
+	}
+	pkh, _, err := tpm2.CreatePrimary(rw, msg.hierarchy(), pcrSelection, hierarchyAuth, defaultPassword, template)
 	if err != nil {
-		return 0, fmt.Errorf("error on creating primary key: %v", err)
+		return 0, fmt.Errorf("error on creating primary key: %w", err)
 	}
 	return pkh, nil
 }
 
+// isParentMismatch reports whether err means that key blobs were not created under the parent
+func isParentMismatch(err error) bool {
+	var pErr tpm2.ParameterError
+	if !errors.As(err, &pErr) {
+		return false
+	}
+	switch pErr.Code {
+	case tpm2.RCIntegrity, tpm2.RCValue, tpm2.RCSize, tpm2.RCECCPoint:
+		return true
+	}
+	return false
+}
+
+// parentAuth returns authorization value of the parent key,
+// primary keys created by loadPrimary always have empty authorization
+func (msg *TSS) parentAuth() (string, error) {
+	if !msg.hasPersistentParent() {
+		return defaultPassword, nil
+	}
+	auth, err := msg.ParentAuth.resolve()
+	if err != nil {
+		return "", fmt.Errorf("parent authorization error: %w", err)
+	}
+	return auth, nil
+}
+
+// hierarchyAuth returns authorization value of the parent hierarchy
+func (msg *TSS) hierarchyAuth() (string, error) {
+	auth, err := msg.HierarchyAuth.resolve()
+	if err != nil {
+		return "", fmt.Errorf("hierarchy authorization error: %w", err)
+	}
+	return auth, nil
+}
+
+// withParentAuth runs TPM command with authorization of the parent key.
+// Parents without user role authorization (EK templates) are authorized
+// by PolicySecret session of the endorsement hierarchy
+func (msg *TSS) withParentAuth(rw io.ReadWriter, parentAttrs tpm2.KeyProp, cmd func(auth tpm2.AuthCommand) error) error {
+	if parentAttrs&tpm2.FlagUserWithAuth != 0 {
+		auth, err := msg.parentAuth()
+		if err != nil {
+			return err
+		}
+		return cmd(passwordAuth(auth))
+	}
+	hierarchyAuth, err := msg.hierarchyAuth()
+	if err != nil {
+		return err
+	}
+	session, _, err := tpm2.StartAuthSession(rw, tpm2.HandleNull, tpm2.HandleNull,
+		make([]byte, 16), nil, tpm2.SessionPolicy, tpm2.AlgNull, tpm2.AlgSHA256)
+	if err != nil {
+		return fmt.Errorf("start policy session error: %w", err)
+	}
+	defer func() {
+		_ = tpm2.FlushContext(rw, session)
+	}()
+	_, _, err = tpm2.PolicySecret(rw, tpm2.HandleEndorsement, passwordAuth(hierarchyAuth), session, nil, nil, nil, 0)
+	if err != nil {
+		return fmt.Errorf("policy secret error: %w", err)
+	}
+	return cmd(tpm2.AuthCommand{Session: session, Attributes: tpm2.AttrContinueSession})
+}
+
 // LoadKey load TSS 2.0 key into transient TPM memory
-// caller should execute tpm2.FlushContext for returned handle
+// caller should execute tpm2.FlushContext for returned handle.
+// Importable key is imported under its parent first and converted into loadable key
 func (msg *TSS) LoadKey(rw io.ReadWriter) (tpmutil.Handle, error) {
+	switch msg.Type {
+	case "", OIDLoadableKey, OIDSealedData, OIDImportableKey:
+	default:
+		return 0, fmt.Errorf("unsupported key type %s", msg.Type)
+	}
 	publicBlob, err := decode(msg.Public)
 	if err != nil {
 		return 0, err
@@ -213,20 +454,113 @@ func (msg *TSS) LoadKey(rw io.ReadWriter) (tpmutil.Handle, error) {
 	if err != nil {
 		return 0, err
 	}
-	primaryHandle, err := msg.loadPrimary(rw)
-	if err != nil {
-		return 0, err
+	if msg.hasPersistentParent() {
+		parentPub, _, _, err := tpm2.ReadPublic(rw, msg.Parent)
+		if err != nil {
+			return 0, fmt.Errorf("parent key 0x%x is not available: %w", msg.Parent, err)
+		}
+		return msg.loadUnder(rw, msg.Parent, parentPub.Attributes, publicBlob, privateBlob)
 	}
-	defer func(rw io.ReadWriter, handle tpmutil.Handle) {
+	// primary key is regenerated from template, template is found by trying to load the key under it
+	var lastErr error
+	for _, template := range msg.parentTemplates() {
+		primaryHandle, err := msg.loadPrimary(rw, template)
+		if err != nil {
+			msg.log().Debug("unable to create parent primary key", "hierarchy", handleAttr(msg.hierarchy()),
+				"type", template.Type.String(), "error", err)
+			lastErr = err
+			continue
+		}
+		keyHandle, err := msg.loadUnder(rw, primaryHandle, template.Attributes, publicBlob, privateBlob)
 		_ = tpm2.FlushContext(rw, primaryHandle)
-	}(rw, primaryHandle)
-	keyHandle, _, err := tpm2.Load(rw, primaryHandle, "", publicBlob, privateBlob)
+		if err == nil {
+			msg.log().Debug("TSS key loaded under primary parent", "hierarchy", handleAttr(msg.hierarchy()),
+				"type", template.Type.String(), "handle", handleAttr(keyHandle))
+			parentTemplate := template
+			msg.ParentTemplate = &parentTemplate
+			return keyHandle, nil
+		}
+		if !isParentMismatch(err) {
+			return 0, err
+		}
+		msg.log().Debug("parent template doesn't match key, trying next one", "hierarchy", handleAttr(msg.hierarchy()),
+			"type", template.Type.String(), "error", err)
+		lastErr = err
+	}
+	return 0, lastErr
+}
+
+// loadUnder loads key under loaded parent, importable key is imported first
+func (msg *TSS) loadUnder(rw io.ReadWriter, parent tpmutil.Handle, parentAttrs tpm2.KeyProp, publicBlob, privateBlob []byte) (tpmutil.Handle, error) {
+	var err error
+	if msg.Type == OIDImportableKey {
+		err = msg.withParentAuth(rw, parentAttrs, func(auth tpm2.AuthCommand) error {
+			privateBlob, err = msg.importKey(rw, parent, auth, publicBlob, privateBlob)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	var keyHandle tpmutil.Handle
+	err = msg.withParentAuth(rw, parentAttrs, func(auth tpm2.AuthCommand) error {
+		keyHandle, _, err = tpm2.LoadUsingAuth(rw, parent, auth, publicBlob, privateBlob)
+		return err
+	})
 	if err != nil {
-		return 0, fmt.Errorf("load key error: %v\n", err)
+		return 0, fmt.Errorf("load key error: %w", err)
 	}
 	return keyHandle, nil
 }
 
+// importKey executes TPM2_Import of importable key under parent and converts msg into loadable key.
+// OnImport callback is executed with converted key
+func (msg *TSS) importKey(rw io.ReadWriter, parent tpmutil.Handle, auth tpm2.AuthCommand, publicBlob, duplicate []byte) ([]byte, error) {
+	seed, err := decode(msg.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("importable key secret %v", err)
+	}
+	privateBlob, err := tpm2.Import(rw, parent, auth, publicBlob, duplicate, seed, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("import key error: %w", err)
+	}
+	private, err := tpmutil.Pack(tpmutil.U16Bytes(privateBlob))
+	if err != nil {
+		return nil, err
+	}
+	msg.Type = OIDLoadableKey
+	msg.Private = private
+	msg.Secret = nil
+	msg.log().Info("importable TSS key imported", "parent", handleAttr(parent))
+	if msg.OnImport != nil {
+		if err = msg.OnImport(msg); err != nil {
+			return nil, fmt.Errorf("import key callback error: %w", err)
+		}
+	}
+	return privateBlob, nil
+}
+
+// EncodePEM encodes TSS into TSS2 PRIVATE KEY pem block
+func (msg *TSS) EncodePEM() ([]byte, error) {
+	b, err := msg.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "TSS2 PRIVATE KEY",
+		Bytes: b,
+	}), nil
+}
+
+// SaveToFile saves TSS into TSS2 pem encoded file
+func (msg *TSS) SaveToFile(f string) error {
+	b, err := msg.EncodePEM()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(f, b, 0600)
+}
+
 // LoadFromFile loads TSS2 pem encoded file into TSS struct
 func LoadFromFile(f string) (*TSS, error) {
 	b, err := os.ReadFile(f)
@@ -234,11 +568,14 @@ func LoadFromFile(f string) (*TSS, error) {
 		return nil, err
 	}
 	block, _ := pem.Decode(b)
-	if block.Type != "TSS2 PRIVATE KEY" {
+	if block == nil || block.Type != "TSS2 PRIVATE KEY" {
 		return nil, fmt.Errorf("failed to find corrent block type")
 	}
 	msg := &TSS{}
 	rest, err := msg.Unmarshal(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
 	if len(rest) > 0 {
 		return nil, fmt.Errorf("unexpected block size")
 	}
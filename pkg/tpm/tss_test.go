@@ -0,0 +1,135 @@
+package tpm_test
+
+import (
+	"encoding/asn1"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+
+	"github.com/shuvava/tpm/pkg/tpm"
+	"github.com/shuvava/tpm/pkg/tpm/tpmtest"
+)
+
+func TestTSSMarshalRoundTrip(t *testing.T) {
+	in := tpm.TSS{
+		Type:   tpm.OIDImportableKey,
+		Policy: []tpm.TSSPolicy{{CommandCode: tpm2.CmdPolicyPCR, CommandPolicy: []byte{1, 2}}},
+		Secret: []byte{3},
+		AuthPolicy: []tpm.TSSAuthPolicy{{
+			Name:   "approved",
+			Policy: []tpm.TSSPolicy{{CommandCode: tpm2.CmdPolicyPCR, CommandPolicy: []byte{4}}},
+		}},
+		Description: "test key",
+		RSAParent:   true,
+		Parent:      0x81000001,
+		Public:      []byte{5},
+		Private:     []byte{6},
+	}
+	b, err := in.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out tpm.TSS
+	rest, err := out.Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) > 0 {
+		t.Errorf("unexpected rest %x", rest)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("got %+v, want %+v", out, in)
+	}
+}
+
+func TestTSSUnmarshalLegacyParent(t *testing.T) {
+	// files written by older versions encoded parent handle as int32
+	legacy := struct {
+		Type      asn1.ObjectIdentifier
+		EmptyAuth bool `asn1:"explicit,tag:0"`
+		Parent    int32
+		Public    []byte
+		Private   []byte
+	}{asn1.ObjectIdentifier{2, 23, 133, 10, 1, 3}, true, int32(-2130706431), []byte{1}, []byte{2}}
+	b, err := asn1.Marshal(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out tpm.TSS
+	if _, err = out.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	if out.Parent != 0x81000001 || !out.EmptyAuth || out.Type != tpm.OIDLoadableKey {
+		t.Errorf("unexpected result %+v", out)
+	}
+}
+
+func TestLoadFromFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "key.tss")
+	if err := os.WriteFile(notPEM, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tpm.LoadFromFile(notPEM); err == nil {
+		t.Error("expected error for non PEM file")
+	}
+	if _, err := tpm.LoadFromFile(filepath.Join(dir, "missing.tss")); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+func TestTSSLoadKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		parent   tpmutil.Handle
+		template tpm2.Public
+	}{
+		{"ECC parent", tpm2.HandleOwner, tpmtest.ECCParentTemplate},
+		{"RSA parent", tpm2.HandleOwner, tpmtest.RSAParentTemplate},
+		{"null hierarchy", tpm2.HandleNull, tpmtest.ECCParentTemplate},
+		{"endorsement hierarchy", tpm2.HandleEndorsement, tpmtest.ECCParentTemplate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sim := tpmtest.New(t)
+			tss := sim.TSSKey(tt.parent, tt.template, "", tpmtest.ECCSigningTemplate)
+			f := sim.TSSFile(tss, "key.tss")
+
+			loaded, err := tpm.LoadFromFile(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kh, err := loaded.LoadKey(sim.RW())
+			if err != nil {
+				t.Fatal(err)
+			}
+			sim.Flush(kh)
+			if got := sim.Handles(tpm2.HandleTypeTransient); len(got) != 0 {
+				t.Errorf("transient handles left after load %v", got)
+			}
+		})
+	}
+}
+
+func TestTSSLoadKeyPersistentParent(t *testing.T) {
+	sim := tpmtest.New(t)
+	const parent = tpmutil.Handle(0x81000010)
+	sim.PersistPrimary(tpmtest.RSAParentTemplate, parent)
+	tss := sim.TSSKey(parent, tpm2.Public{}, "", tpmtest.RSASigningTemplate)
+
+	kh, err := tss.LoadKey(sim.RW())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim.Flush(kh)
+
+	missing := *tss
+	missing.Parent = 0x81000011
+	if _, err = missing.LoadKey(sim.RW()); err == nil {
+		t.Error("expected error for missing persistent parent")
+	}
+}